@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -18,6 +20,7 @@ func runBackup(ctx context.Context) {
 	backupCmd := flag.NewFlagSet("backup", flag.ExitOnError)
 	relay := backupCmd.String("relay", "", "Relay name (use then the file parameter ends in jsonl)")
 	relayShort := backupCmd.String("r", "", "Relay name (shorthand)")
+	tenant := backupCmd.String("tenant", "", "Tenant host (defaults to the first tenant)")
 	output := backupCmd.String("output", "", "Output file (shorthand)")
 	outputShort := backupCmd.String("o", "", "Output file (shorthand)")
 
@@ -29,7 +32,7 @@ func runBackup(ctx context.Context) {
 		if strings.HasPrefix(arg, "-") {
 			flags = append(flags, arg)
 			// Check if it's a flag that takes a value
-			// In our case, all flags (relay, r, output, o) take values.
+			// In our case, all flags (relay, r, tenant, output, o) take values.
 			if !strings.Contains(arg, "=") && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
 				flags = append(flags, args[i+1])
 				i++
@@ -46,6 +49,7 @@ func runBackup(ctx context.Context) {
 		return
 	}
 
+	t := tenantByName(*tenant)
 	targetRelay := *relay
 	if targetRelay == "" {
 		targetRelay = *relayShort
@@ -69,11 +73,11 @@ func runBackup(ctx context.Context) {
 		if targetRelay == "" {
 			log.Fatal("🚫 --relay parameter is required when exporting to .jsonl")
 		}
-		if err := exportToJSONL(ctx, targetRelay, fileName); err != nil {
+		if err := t.exportToJSONL(ctx, targetRelay, fileName); err != nil {
 			log.Fatal("🚫 export failed:", err)
 		}
 	} else {
-		if err := exportToZip(ctx, fileName); err != nil {
+		if err := t.exportToZip(ctx, fileName); err != nil {
 			log.Fatal("🚫 backup failed:", err)
 		}
 	}
@@ -83,6 +87,7 @@ func runRestore(ctx context.Context) {
 	restoreCmd := flag.NewFlagSet("restore", flag.ExitOnError)
 	relay := restoreCmd.String("relay", "", "Relay name (use then the file parameter ends in jsonl)")
 	relayShort := restoreCmd.String("r", "", "Relay name (shorthand)")
+	tenant := restoreCmd.String("tenant", "", "Tenant host (defaults to the first tenant)")
 	input := restoreCmd.String("input", "", "Input file (shorthand)")
 	inputShort := restoreCmd.String("i", "", "Input file (shorthand)")
 
@@ -109,6 +114,7 @@ func runRestore(ctx context.Context) {
 		return
 	}
 
+	t := tenantByName(*tenant)
 	targetRelay := *relay
 	if targetRelay == "" {
 		targetRelay = *relayShort
@@ -135,11 +141,11 @@ func runRestore(ctx context.Context) {
 		if targetRelay == "" {
 			log.Fatal("🚫 --relay parameter is required when restoring from .jsonl")
 		}
-		if err := importFromJSONL(ctx, targetRelay, fileName); err != nil {
+		if err := t.importFromJSONL(ctx, targetRelay, fileName); err != nil {
 			log.Fatal("🚫 restore failed:", err)
 		}
 	} else {
-		if err := importFromZip(ctx, fileName); err != nil {
+		if err := t.importFromZip(ctx, fileName); err != nil {
 			log.Fatal("🚫 restore failed:", err)
 		}
 	}
@@ -155,8 +161,11 @@ func startPeriodicCloudBackups(ctx context.Context) {
 		return
 	}
 
+	// A backup that has started is finished even if HAVEN is shutting down
+	backupCtx := context.WithoutCancel(ctx)
+
 	// Trigger backup immediately on startup
-	performBackup(ctx)
+	performBackup(backupCtx)
 
 	ticker := time.NewTicker(time.Duration(config.BackupIntervalHours) * time.Hour)
 	defer ticker.Stop()
@@ -167,37 +176,57 @@ func startPeriodicCloudBackups(ctx context.Context) {
 			return
 
 		case <-ticker.C:
-			performBackup(ctx)
+			performBackup(backupCtx)
 		}
 	}
 }
 
 func performBackup(ctx context.Context) {
-	zipFileName := "haven_backup.zip"
 	log.Println("⏰ starting periodic backup...")
-	if err := exportToZip(ctx, zipFileName); err != nil {
+	for _, t := range tenants {
+		t.performBackup(ctx)
+	}
+}
+
+// performBackup uploads the backup of a tenant, named after its host in multi-tenant mode.
+func (t *Tenant) performBackup(ctx context.Context) {
+	start := time.Now()
+	err := t.uploadBackup(ctx)
+	observeBackup(t, start, err)
+	if err == nil {
+		t.lastBackup.Store(time.Now().Unix())
+	}
+}
+
+func (t *Tenant) uploadBackup(ctx context.Context) error {
+	zipFileName := "haven_backup.zip"
+	if t.Host != "" {
+		zipFileName = "haven_backup_" + t.Host + ".zip"
+	}
+	if err := t.exportToZip(ctx, zipFileName); err != nil {
 		log.Println("🚫 error exporting to zip:", err)
-		return
+		return err
 	}
 	switch config.BackupProvider {
 	case "s3":
-		S3Upload(ctx, zipFileName)
+		return S3Upload(ctx, zipFileName)
 	case "aws":
-		AwsUpload(ctx, zipFileName)
+		return AwsUpload(ctx, zipFileName)
 	case "gcp":
-		GCPBucketUpload(ctx, zipFileName)
+		return GCPBucketUpload(ctx, zipFileName)
 	default:
 		log.Println("🚫 we only support AWS, GCP, and S3 at this time")
+		return fmt.Errorf("unsupported backup provider: %s", config.BackupProvider)
 	}
 }
 
 // Deprecated: Use S3Upload instead
 //
 //goland:noinspection GoUnhandledErrorResult
-func GCPBucketUpload(ctx context.Context, zipFileName string) {
+func GCPBucketUpload(ctx context.Context, zipFileName string) error {
 	if config.GcpConfig == nil {
 		log.Println("🚫 GCP specified as backup provider but no GCP config found. Check environment variables.")
-		return
+		return errors.New("missing GCP config")
 	}
 
 	bucket := config.GcpConfig.Bucket
@@ -205,7 +234,7 @@ func GCPBucketUpload(ctx context.Context, zipFileName string) {
 	client, err := storage.NewClient(ctx)
 	if err != nil {
 		log.Println("🚫 GCP client creation failed:", err)
-		return
+		return err
 	}
 	defer client.Close()
 
@@ -213,7 +242,7 @@ func GCPBucketUpload(ctx context.Context, zipFileName string) {
 	f, err := os.Open(zipFileName)
 	if err != nil {
 		log.Println("🚫 GCP file open failed:", err)
-		return
+		return err
 	}
 	defer f.Close()
 
@@ -223,12 +252,12 @@ func GCPBucketUpload(ctx context.Context, zipFileName string) {
 	wc := obj.NewWriter(ctx)
 	if _, err = io.Copy(wc, f); err != nil {
 		log.Println("🚫 GCP upload failed:", err)
-		return
+		return err
 	}
 
 	if err := wc.Close(); err != nil {
 		log.Println("🚫 GCP writer close failed:", err)
-		return
+		return err
 	}
 
 	log.Printf("✅ Successfully uploaded %q to %q\n", zipFileName, bucket)
@@ -238,15 +267,16 @@ func GCPBucketUpload(ctx context.Context, zipFileName string) {
 	if err != nil {
 		log.Println("🚫 error removing zip file:", err)
 	}
+	return nil
 }
 
 // Deprecated: Use S3Upload instead
 //
 //goland:noinspection GoUnhandledErrorResult
-func AwsUpload(ctx context.Context, zipFileName string) {
+func AwsUpload(ctx context.Context, zipFileName string) error {
 	if config.AwsConfig == nil {
 		log.Println("🚫 AWS specified as backup provider but no AWS config found. Check environment variables.")
-		return
+		return errors.New("missing AWS config")
 	}
 
 	if err := s3UploadShared(
@@ -260,14 +290,15 @@ func AwsUpload(ctx context.Context, zipFileName string) {
 		true,
 	); err != nil {
 		log.Println("🚫 AWS upload failed:", err)
-		return
+		return err
 	}
+	return nil
 }
 
-func S3Upload(ctx context.Context, zipFileName string) {
+func S3Upload(ctx context.Context, zipFileName string) error {
 	if config.S3Config == nil {
 		log.Println("🚫 S3 specified as backup provider but no S3 config found. Check environment variables.")
-		return
+		return errors.New("missing S3 config")
 	}
 
 	if err := s3UploadShared(
@@ -281,8 +312,9 @@ func S3Upload(ctx context.Context, zipFileName string) {
 		true,
 	); err != nil {
 		log.Println("🚫 S3 upload failed:", err)
-		return
+		return err
 	}
+	return nil
 }
 
 func s3UploadShared(
@@ -8,19 +8,23 @@ import (
 	"github.com/nbd-wtf/go-nostr"
 )
 
-func blast(ctx context.Context, ev *nostr.Event) {
-	for _, url := range config.BlastrRelays {
+func (t *Tenant) blast(ctx context.Context, ev *nostr.Event) {
+	for _, url := range t.config().BlastrRelays {
 		ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 		relay, err := pool.EnsureRelay(url)
 		if err != nil {
 			cancel()
 			log.Println("error connecting to relay", relay, err)
+			blasts.WithLabelValues(t.Host, url, "failure").Inc()
 			continue
 		}
 		if err := relay.Publish(ctx, *ev); err != nil {
 			log.Println("🚫 error publishing to relay", relay, err)
+			blasts.WithLabelValues(t.Host, url, "failure").Inc()
+		} else {
+			blasts.WithLabelValues(t.Host, url, "success").Inc()
 		}
 		cancel()
 	}
-	log.Println("🔫 blasted", ev.ID, "to", len(config.BlastrRelays), "relays")
+	log.Println("🔫 blasted", ev.ID, "to", len(t.config().BlastrRelays), "relays")
 }
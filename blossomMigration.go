@@ -7,12 +7,12 @@ import (
 	"github.com/fiatjaf/khatru/blossom"
 )
 
-func migrateBlossomMetadata(ctx context.Context, bl *blossom.BlossomServer) {
+func (t *Tenant) migrateBlossomMetadata(ctx context.Context, bl *blossom.BlossomServer, outboxDB DBBackend) {
 	// Create a temporary Blossom dbWrapper for the migration
-	outboxDBWrapper := blossom.EventStoreBlobIndexWrapper{Store: outboxDB, ServiceURL: "https://" + config.RelayURL}
+	outboxDBWrapper := blossom.EventStoreBlobIndexWrapper{Store: outboxDB, ServiceURL: "https://" + t.config().RelayURL}
 
 	// List all BlobDescriptor for the relay owner pubkey
-	ownerPubkey := nPubToPubkey(config.OwnerNpub)
+	ownerPubkey := nPubToPubkey(t.config().OwnerNpub)
 	blobsChan, err := outboxDBWrapper.List(ctx, ownerPubkey)
 	if err != nil {
 		slog.Error("🚫 Failed to list blobs", "error", err)
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// chatAllowedKinds are the allowed_kinds of the default chat relay.
+var chatAllowedKinds = map[int]struct{}{
+	// Regular kinds
+	nostr.KindSimpleGroupChatMessage:   {},
+	nostr.KindSimpleGroupThreadedReply: {},
+	nostr.KindSimpleGroupThread:        {},
+	nostr.KindSimpleGroupReply:         {},
+	nostr.KindChannelMessage:           {},
+	nostr.KindChannelHideMessage:       {},
+
+	nostr.KindGiftWrap: {},
+
+	nostr.KindSimpleGroupPutUser:      {},
+	nostr.KindSimpleGroupRemoveUser:   {},
+	nostr.KindSimpleGroupEditMetadata: {},
+	nostr.KindSimpleGroupDeleteEvent:  {},
+	nostr.KindSimpleGroupCreateGroup:  {},
+	nostr.KindSimpleGroupDeleteGroup:  {},
+	nostr.KindSimpleGroupCreateInvite: {},
+	nostr.KindSimpleGroupJoinRequest:  {},
+	nostr.KindSimpleGroupLeaveRequest: {},
+
+	// Addressable kinds
+	nostr.KindSimpleGroupMetadata: {},
+	nostr.KindSimpleGroupAdmins:   {},
+	nostr.KindSimpleGroupMembers:  {},
+	nostr.KindSimpleGroupRoles:    {},
+}
+
+// rejectChatFilter enforces NIP-17 read rules on the chat relay: the owner can read everything, other
+// WoT members must be authenticated and can only read gift wraps addressed to them.
+func (t *Tenant) rejectChatFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	authenticatedUser := khatru.GetAuthed(ctx)
+	if authenticatedUser == "" {
+		return true, "auth-required: this query requires you to be authenticated"
+	}
+
+	if authenticatedUser == t.config().OwnerNpubKey {
+		return false, ""
+	}
+
+	if !t.wot.Has(ctx, authenticatedUser) && !t.isChatGroupMember(authenticatedUser) && !t.chat.management.isPubkeyAllowed(authenticatedUser) {
+		return true, t.notInWoT("you must be in the web of trust to chat with the relay owner")
+	}
+
+	if t.chatGroups != nil {
+		for _, id := range filter.Tags["h"] {
+			if !t.chatGroups.canRead(id, authenticatedUser) {
+				return true, fmt.Sprintf("restricted: only members can read group %s", id)
+			}
+		}
+	}
+
+	if !slices.Contains(filter.Kinds, nostr.KindGiftWrap) {
+		// Filters without kinds are allowed, gift wraps not addressed to the user are dropped by queryChatEvents
+		return false, ""
+	}
+
+	recipients, ok := filter.Tags["p"]
+	if !ok || len(recipients) == 0 {
+		return true, "restricted: gift wrap queries must include a #p tag with your authenticated pubkey"
+	}
+	for _, recipient := range recipients {
+		if recipient != authenticatedUser {
+			return true, "restricted: you can only read gift wraps addressed to you"
+		}
+	}
+
+	return false, ""
+}
+
+// rejectChatCountFilter applies the same rules as rejectChatFilter to COUNT requests. Counts can't be
+// post-filtered, so non-owners must also say which kinds they are counting and which groups, gift wraps are
+// already limited to the ones addressed to them.
+func (t *Tenant) rejectChatCountFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	if reject, msg := t.rejectChatFilter(ctx, filter); reject {
+		return reject, msg
+	}
+
+	if khatru.GetAuthed(ctx) == t.config().OwnerNpubKey {
+		return false, ""
+	}
+	if len(filter.Kinds) == 0 {
+		return true, "restricted: count queries must specify kinds"
+	}
+	if slices.ContainsFunc(filter.Kinds, isGroupKind) && len(filter.Tags["h"]) == 0 {
+		return true, "restricted: group count queries must include a #h tag with the groups you can read"
+	}
+
+	return false, ""
+}
+
+// queryChatEvents wraps the QueryEvents of the chat database and drops gift wraps that aren't addressed to the
+// authenticated user and events of groups they can't read, so filters that don't name a kind or a
+// group can't be used to read other people's messages.
+func (t *Tenant) queryChatEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ch, err := t.chat.db.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticatedUser := khatru.GetAuthed(ctx)
+	if authenticatedUser == t.config().OwnerNpubKey || khatru.IsInternalCall(ctx) {
+		return ch, nil
+	}
+
+	filtered := make(chan *nostr.Event)
+	go func() {
+		defer close(filtered)
+		for evt := range ch {
+			if evt.Kind == nostr.KindGiftWrap && evt.Tags.FindWithValue("p", authenticatedUser) == nil {
+				continue
+			}
+			if id := groupID(evt); id != "" && t.chatGroups != nil && !t.chatGroups.canRead(id, authenticatedUser) {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case filtered <- evt:
+			}
+		}
+	}()
+
+	return filtered, nil
+}
+
+// preventChatBroadcast applies the rules of queryChatEvents to new events: a filter without kinds or groups
+// must not stream other people's gift wraps and the events of groups the subscriber can't read.
+func (t *Tenant) preventChatBroadcast(ws *khatru.WebSocket, event *nostr.Event) bool {
+	reader := ws.AuthedPublicKey
+	if reader == t.config().OwnerNpubKey {
+		return false
+	}
+	if event.Kind == nostr.KindGiftWrap && event.Tags.FindWithValue("p", reader) == nil {
+		return true
+	}
+	if id := groupID(event); id != "" && t.chatGroups != nil && !t.chatGroups.canRead(id, reader) {
+		return true
+	}
+	return false
+}
+
+// rejectChatEvent keeps the chat relay from being used as a general purpose DM relay: gift wraps must be
+// addressed to the owner or to a member of a group hosted here, and group events are validated by t.chatGroups.
+func (t *Tenant) rejectChatEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	switch {
+	case event.Kind == nostr.KindGiftWrap:
+		recipients := 0
+		for tag := range event.Tags.FindAll("p") {
+			recipients++
+			if tag[1] != t.config().OwnerNpubKey && !t.isChatGroupMember(tag[1]) {
+				return true, "blocked: gift wraps must be addressed to the relay owner or a member of a group hosted here"
+			}
+		}
+		if recipients == 0 {
+			return true, "invalid: gift wraps must have a p tag with the recipient"
+		}
+
+	case nip29.MetadataEventKinds.Includes(event.Kind):
+		return true, "blocked: group state events can only be published by this relay"
+
+	case isGroupKind(event.Kind):
+		if t.chatGroups == nil {
+			return true, "blocked: group hosting is not enabled on this relay"
+		}
+		return t.chatGroups.rejectEvent(ctx, event)
+	}
+
+	return false, ""
+}
+
+func isGroupKind(kind int) bool {
+	switch kind {
+	case nostr.KindSimpleGroupChatMessage,
+		nostr.KindSimpleGroupThreadedReply,
+		nostr.KindSimpleGroupThread,
+		nostr.KindSimpleGroupReply,
+		nostr.KindSimpleGroupJoinRequest,
+		nostr.KindSimpleGroupLeaveRequest:
+		return true
+	}
+
+	return nip29.ModerationEventKinds.Includes(kind)
+}
+
+// isChatGroupMember reports whether pubkey is a member of any group hosted on the relay.
+func (t *Tenant) isChatGroupMember(pubkey string) bool {
+	return t.chatGroups != nil && t.chatGroups.isMemberOfAny(pubkey)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+func newTestChatTenant(t *testing.T) (tenant *Tenant, owner, friend, member, stranger string) {
+	owner, friend, member, stranger = testPubkey(), testPubkey(), testPubkey(), testPubkey()
+	tenant = newTestTenant(t, owner, testWoT{friend: true})
+	tenant.chatGroups = &ChatGroups{
+		tenant: tenant,
+		groups: map[string]*nip29.Group{
+			"closed": {Closed: true, Members: map[string][]*nip29.Role{member: nil}},
+			"open":   {Members: map[string][]*nip29.Role{}},
+		},
+		invites: make(map[string]map[string]bool),
+	}
+	return tenant, owner, friend, member, stranger
+}
+
+func TestRejectChatFilter(t *testing.T) {
+	tenant, owner, friend, member, stranger := newTestChatTenant(t)
+
+	tests := []struct {
+		name   string
+		reader string
+		filter nostr.Filter
+		reject bool
+	}{
+		{"unauthenticated", "", nostr.Filter{}, true},
+		{"owner reads everything", owner, nostr.Filter{Kinds: []int{nostr.KindGiftWrap}}, false},
+		{"stranger", stranger, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupChatMessage}}, true},
+		{"wot member without kinds", friend, nostr.Filter{}, false},
+		{"gift wraps without #p", friend, nostr.Filter{Kinds: []int{nostr.KindGiftWrap}}, true},
+		{"gift wraps to someone else", friend, nostr.Filter{Kinds: []int{nostr.KindGiftWrap}, Tags: nostr.TagMap{"p": {owner}}}, true},
+		{"own gift wraps", friend, nostr.Filter{Kinds: []int{nostr.KindGiftWrap}, Tags: nostr.TagMap{"p": {friend}}}, false},
+		{"closed group as non-member", friend, nostr.Filter{Tags: nostr.TagMap{"h": {"closed"}}}, true},
+		{"closed group as member", member, nostr.Filter{Tags: nostr.TagMap{"h": {"closed"}}}, false},
+		{"open group", friend, nostr.Filter{Tags: nostr.TagMap{"h": {"open"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reject, msg := tenant.rejectChatFilter(authedContext(tt.reader), tt.filter); reject != tt.reject {
+				t.Errorf("rejectChatFilter() = %v %q, want %v", reject, msg, tt.reject)
+			}
+		})
+	}
+}
+
+func TestRejectChatCountFilter(t *testing.T) {
+	tenant, owner, friend, member, _ := newTestChatTenant(t)
+
+	tests := []struct {
+		name   string
+		reader string
+		filter nostr.Filter
+		reject bool
+	}{
+		{"owner without kinds", owner, nostr.Filter{}, false},
+		{"without kinds", friend, nostr.Filter{}, true},
+		{"group kinds without #h", member, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupChatMessage}}, true},
+		{"group kinds of a closed group as non-member", friend, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupChatMessage}, Tags: nostr.TagMap{"h": {"closed"}}}, true},
+		{"group kinds of a closed group as member", member, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupChatMessage}, Tags: nostr.TagMap{"h": {"closed"}}}, false},
+		{"gift wraps to someone else", friend, nostr.Filter{Kinds: []int{nostr.KindGiftWrap}, Tags: nostr.TagMap{"p": {owner}}}, true},
+		{"own gift wraps", friend, nostr.Filter{Kinds: []int{nostr.KindGiftWrap}, Tags: nostr.TagMap{"p": {friend}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reject, msg := tenant.rejectChatCountFilter(authedContext(tt.reader), tt.filter); reject != tt.reject {
+				t.Errorf("rejectChatCountFilter() = %v %q, want %v", reject, msg, tt.reject)
+			}
+		})
+	}
+}
+
+func TestPreventChatBroadcast(t *testing.T) {
+	tenant, owner, friend, member, _ := newTestChatTenant(t)
+
+	giftWrap := &nostr.Event{Kind: nostr.KindGiftWrap, Tags: nostr.Tags{{"p", owner}}}
+	closedMessage := &nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Tags: nostr.Tags{{"h", "closed"}}}
+	openMessage := &nostr.Event{Kind: nostr.KindSimpleGroupChatMessage, Tags: nostr.Tags{{"h", "open"}}}
+
+	tests := []struct {
+		name    string
+		reader  string
+		event   *nostr.Event
+		prevent bool
+	}{
+		{"gift wrap to the owner", owner, giftWrap, false},
+		{"gift wrap to someone else", friend, giftWrap, true},
+		{"closed group as non-member", friend, closedMessage, true},
+		{"closed group as member", member, closedMessage, false},
+		{"open group", friend, openMessage, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := &khatru.WebSocket{AuthedPublicKey: tt.reader}
+			if prevent := tenant.preventChatBroadcast(ws, tt.event); prevent != tt.prevent {
+				t.Errorf("preventChatBroadcast() = %v, want %v", prevent, tt.prevent)
+			}
+		})
+	}
+}
+
+func TestRejectLimitZero(t *testing.T) {
+	tenant, owner, friend, _, _ := newTestChatTenant(t)
+	overwrite := rejectLimitZero(tenant.rejectChatFilter)
+
+	for _, tt := range []struct {
+		name      string
+		reader    string
+		filter    nostr.Filter
+		limitZero bool
+	}{
+		{"unauthenticated", "", nostr.Filter{LimitZero: true}, false},
+		{"gift wraps to someone else", friend, nostr.Filter{Kinds: []int{nostr.KindGiftWrap}, Tags: nostr.TagMap{"p": {owner}}, LimitZero: true}, false},
+		{"owner", owner, nostr.Filter{LimitZero: true}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := tt.filter
+			overwrite(authedContext(tt.reader), &filter)
+			if filter.LimitZero != tt.limitZero {
+				t.Errorf("LimitZero = %v, want %v", filter.LimitZero, tt.limitZero)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseIPList reads a list of IPs and CIDRs, a bare IP is a prefix of its own.
+func parseIPList(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %s", value)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %s", value)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// realIPHandler replaces the remote address of requests coming from a trusted proxy with the client address in
+// X-Forwarded-For or X-Real-IP, and drops those headers from every request. khatru reads the headers itself and
+// would believe any client otherwise, with them gone its rate limiters and everything else use the remote address.
+// Requests on the Unix socket always come from the local reverse proxy and are trusted.
+func realIPHandler(trusted []netip.Prefix, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor := r.Header.Values("X-Forwarded-For")
+		realIP := r.Header.Get("X-Real-IP")
+		if len(forwardedFor) == 0 && realIP == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("X-Real-IP")
+
+		peer, ok := remoteIP(r)
+		_, unixSocket := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr)
+		if unixSocket || (ok && containsIP(trusted, peer)) {
+			if client, ok := forwardedClientIP(trusted, forwardedFor, realIP); ok {
+				r.RemoteAddr = netip.AddrPortFrom(client, 0).String()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClientIP walks X-Forwarded-For from the closest hop and stops at the first address that isn't a
+// trusted proxy, the hops before it could have been written by the client.
+func forwardedClientIP(trusted []netip.Prefix, forwardedFor []string, realIP string) (netip.Addr, bool) {
+	var hops []string
+	for _, header := range forwardedFor {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = ip.Unmap()
+		if !containsIP(trusted, client) {
+			break
+		}
+	}
+	if client.IsValid() {
+		return client, true
+	}
+
+	if ip, err := netip.ParseAddr(strings.TrimSpace(realIP)); err == nil {
+		return ip.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// remoteIP is the client address once realIPHandler has run, Unix socket requests without proxy headers have none.
+func remoteIP(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
+
+// ipRules are the IP_ALLOW and IP_DENY lists of a relay, a denied address is refused even when it is also allowed.
+type ipRules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newIPRules(spec RelaySpec) *ipRules {
+	// the lists were checked by validateRelaySpecs
+	allow, _ := parseIPList(spec.IPAllow)
+	deny, _ := parseIPList(spec.IPDeny)
+	return &ipRules{allow: allow, deny: deny}
+}
+
+func (r *TenantRelay) allowsIP(req *http.Request) bool {
+	rules := r.ipRules.Load()
+	if len(rules.allow) == 0 && len(rules.deny) == 0 {
+		return true
+	}
+
+	// without an address only a relay with no allow list can be reached
+	ip, ok := remoteIP(req)
+	allowed := !containsIP(rules.deny, ip) && (len(rules.allow) == 0 || ok && containsIP(rules.allow, ip))
+	if !allowed {
+		slog.Debug("🚫 request refused by the IP lists", "relay", r.spec.Name, "ip", ip)
+	}
+	return allowed
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIPHandler(t *testing.T) {
+	trusted, err := parseIPList([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		realIP       string
+		want         string
+	}{
+		{"direct", "203.0.113.7:4000", nil, "", "203.0.113.7:4000"},
+		{"untrusted peer", "203.0.113.7:4000", []string{"198.51.100.1"}, "198.51.100.2", "203.0.113.7:4000"},
+		{"trusted proxy", "10.0.0.1:4000", []string{"198.51.100.1"}, "", "198.51.100.1:0"},
+		{"spoofed hops before the proxies", "10.0.0.1:4000", []string{"1.2.3.4, 198.51.100.1, 192.168.1.1"}, "", "198.51.100.1:0"},
+		{"hops in several headers", "10.0.0.1:4000", []string{"1.2.3.4", "198.51.100.1"}, "", "198.51.100.1:0"},
+		{"every hop trusted", "10.0.0.1:4000", []string{"192.168.1.2, 192.168.1.1"}, "", "192.168.1.2:0"},
+		{"mapped IPv4", "10.0.0.1:4000", []string{"::ffff:198.51.100.1"}, "", "198.51.100.1:0"},
+		{"real IP", "10.0.0.1:4000", nil, "198.51.100.1", "198.51.100.1:0"},
+		{"garbage", "10.0.0.1:4000", []string{"unknown"}, "", "10.0.0.1:4000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			handler := realIPHandler(trusted, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) { got = r }))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got.RemoteAddr != tt.want {
+				t.Errorf("RemoteAddr = %q, want %q", got.RemoteAddr, tt.want)
+			}
+			if got.Header.Get("X-Forwarded-For") != "" || got.Header.Get("X-Real-IP") != "" {
+				t.Error("the proxy headers reached the relays")
+			}
+		})
+	}
+}
+
+func TestAllowsIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    RelaySpec
+		allowed []string
+		denied  []string
+	}{
+		{"no lists", RelaySpec{}, []string{"203.0.113.7:1", "@"}, nil},
+		{"allow list", RelaySpec{IPAllow: []string{"10.0.0.0/8"}}, []string{"10.1.2.3:1"}, []string{"203.0.113.7:1", "@"}},
+		{"deny list", RelaySpec{IPDeny: []string{"203.0.113.0/24"}}, []string{"10.1.2.3:1", "@"}, []string{"203.0.113.7:1"}},
+		{"denied within the allowed", RelaySpec{IPAllow: []string{"10.0.0.0/8"}, IPDeny: []string{"10.6.6.6"}}, []string{"10.1.2.3:1"}, []string{"10.6.6.6:1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &TenantRelay{spec: tt.spec}
+			r.ipRules.Store(newIPRules(tt.spec))
+
+			for _, addrs := range []struct {
+				list []string
+				want bool
+			}{{tt.allowed, true}, {tt.denied, false}} {
+				for _, addr := range addrs.list {
+					req := httptest.NewRequest("GET", "/", nil)
+					// "@" is a Unix socket request without proxy headers
+					req.RemoteAddr = addr
+					if got := r.allowsIP(req); got != addrs.want {
+						t.Errorf("allowsIP(%s) = %v, want %v", addr, got, addrs.want)
+					}
+				}
+			}
+		})
+	}
+}
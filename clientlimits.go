@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"unsafe"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// clientTracker counts the connections and the open subscriptions of the clients of a relay, the caps are read
+// from the current limits so a reload applies them to the clients already connected.
+type clientTracker struct {
+	mu      sync.Mutex
+	ips     map[string]int
+	pubkeys map[string]int
+	conns   map[*khatru.WebSocket]*clientState
+}
+
+type clientState struct {
+	pubkey string
+	// filters seen so far in each REQ, khatru cancels the context of a REQ when it is closed or replaced
+	subscriptions map[context.Context]int
+	// reasons for closing the REQs over a cap, from OverwriteFilter to RejectFilter
+	closing map[context.Context]string
+}
+
+func newClientTracker() *clientTracker {
+	return &clientTracker{
+		ips:     make(map[string]int),
+		pubkeys: make(map[string]int),
+		conns:   make(map[*khatru.WebSocket]*clientState),
+	}
+}
+
+// rejectConnectionCount refuses a connection from an IP already holding max_connections_per_ip.
+func (r *TenantRelay) rejectConnectionCount(req *http.Request) bool {
+	limit := r.limiters.Load().limits.MaxConnectionsPerIP
+	ip := khatru.GetIPFromRequest(req)
+	if limit <= 0 || ip == "" {
+		return false
+	}
+
+	r.clients.mu.Lock()
+	defer r.clients.mu.Unlock()
+	return r.clients.ips[ip] >= limit
+}
+
+func (r *TenantRelay) trackConnect(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	c := r.clients
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conns[ws] = &clientState{
+		subscriptions: make(map[context.Context]int),
+		closing:       make(map[context.Context]string),
+	}
+	if ip := khatru.GetIP(ctx); ip != "" {
+		c.ips[ip]++
+	}
+}
+
+func (r *TenantRelay) trackDisconnect(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	c := r.clients
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ip := khatru.GetIP(ctx); ip != "" {
+		if c.ips[ip]--; c.ips[ip] <= 0 {
+			delete(c.ips, ip)
+		}
+	}
+	if state, ok := c.conns[ws]; ok && state.pubkey != "" {
+		if c.pubkeys[state.pubkey]--; c.pubkeys[state.pubkey] <= 0 {
+			delete(c.pubkeys, state.pubkey)
+		}
+	}
+	delete(c.conns, ws)
+}
+
+// overwriteFilterCaps counts the subscriptions and filters of each REQ and clamps its limit. It runs for every
+// filter, even those with limit 0 that skip RejectFilter, so REQs over a cap are marked here and lose their
+// limit 0 to reach rejectFilterCaps. A NIP-77 sync holds the IDs of every event it compares until it ends, its
+// limit is clamped to max_negentropy_limit.
+func (r *TenantRelay) overwriteFilterCaps(ctx context.Context, filter *nostr.Filter) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+	limits := r.limiters.Load().limits
+
+	if eventstore.IsNegentropySession(ctx) {
+		if limits.MaxNegentropyLimit > 0 && (filter.Limit == 0 || filter.Limit > limits.MaxNegentropyLimit) {
+			filter.Limit = limits.MaxNegentropyLimit
+		}
+		return
+	}
+
+	if maxLimit := r.maxLimit(limits); maxLimit > 0 && filter.Limit > maxLimit {
+		filter.Limit = maxLimit
+	} else if filter.Limit == 0 && !filter.LimitZero && limits.DefaultLimit > 0 {
+		filter.Limit = min(limits.DefaultLimit, maxLimit)
+	}
+
+	c := r.clients
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state, ok := c.conns[ws]
+	if !ok {
+		return
+	}
+
+	reason := ""
+	if authed := khatru.GetAuthed(ctx); authed != "" && state.pubkey == "" {
+		if limits.MaxConnectionsPerPubkey > 0 && c.pubkeys[authed] >= limits.MaxConnectionsPerPubkey {
+			reason = fmt.Sprintf("rate-limited: at most %d connections can be authenticated as the same pubkey", limits.MaxConnectionsPerPubkey)
+		} else {
+			state.pubkey = authed
+			c.pubkeys[authed]++
+		}
+	}
+
+	if reason == "" {
+		filters, open := state.subscriptions[ctx]
+		switch {
+		case !open && limits.MaxSubscriptions > 0 && len(state.subscriptions)+negentropySessions(ws) >= limits.MaxSubscriptions:
+			reason = fmt.Sprintf("rate-limited: at most %d subscriptions can be open at once", limits.MaxSubscriptions)
+		case limits.MaxFilters > 0 && filters >= limits.MaxFilters:
+			reason = fmt.Sprintf("invalid: at most %d filters are allowed per REQ", limits.MaxFilters)
+		default:
+			state.subscriptions[ctx] = filters + 1
+			if !open {
+				context.AfterFunc(ctx, func() {
+					c.mu.Lock()
+					defer c.mu.Unlock()
+					delete(state.subscriptions, ctx)
+				})
+			}
+		}
+	}
+
+	if reason != "" {
+		if _, marked := state.closing[ctx]; !marked {
+			context.AfterFunc(ctx, func() {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				delete(state.closing, ctx)
+			})
+		}
+		state.closing[ctx] = reason
+		filter.LimitZero = false
+	}
+}
+
+// rejectFilterCaps closes the REQs marked by overwriteFilterCaps, and refuses the NIP-77 syncs over
+// max_subscriptions: they count as subscriptions until they end.
+func (r *TenantRelay) rejectFilterCaps(ctx context.Context, _ nostr.Filter) (bool, string) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return false, ""
+	}
+
+	r.clients.mu.Lock()
+	defer r.clients.mu.Unlock()
+	if eventstore.IsNegentropySession(ctx) {
+		state, ok := r.clients.conns[ws]
+		limit := r.limiters.Load().limits.MaxSubscriptions
+		if ok && limit > 0 && len(state.subscriptions)+negentropySessions(ws) >= limit {
+			return true, fmt.Sprintf("rate-limited: at most %d subscriptions can be open at once", limit)
+		}
+		return false, ""
+	}
+	if state, ok := r.clients.conns[ws]; ok {
+		if reason, closing := state.closing[ctx]; closing {
+			return true, reason
+		}
+	}
+	return false, ""
+}
+
+// negentropySessions is the number of NIP-77 syncs open on a connection, khatru keeps them unexported.
+func negentropySessions(ws *khatru.WebSocket) int {
+	field := reflect.ValueOf(ws).Elem().FieldByName("negentropySessions")
+	sessions := reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+	if sessions.IsNil() {
+		return 0
+	}
+	return int(sessions.MethodByName("Size").Call(nil)[0].Int())
+}
+
+// maxLimit is the max_limit of a relay, never above what its database honors.
+func (r *TenantRelay) maxLimit(limits RelayLimits) int {
+	maxLimit := dbMaxLimit(r.db)
+	if limits.MaxLimit > 0 && (maxLimit == 0 || limits.MaxLimit < maxLimit) {
+		maxLimit = limits.MaxLimit
+	}
+	return maxLimit
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy/storage/vector"
+)
+
+// connect opens a connection from ip, authenticated as pubkey unless empty, and returns its context.
+func connect(r *TenantRelay, ip string, pubkey string) context.Context {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = ip + ":1234"
+	ctx := context.WithValue(context.Background(), 0, &khatru.WebSocket{Request: req, AuthedPublicKey: pubkey})
+	r.trackConnect(ctx)
+	return ctx
+}
+
+func TestClientCaps(t *testing.T) {
+	r := &TenantRelay{clients: newClientTracker()}
+	r.limiters.Store(newRelayLimiters(RelayLimits{
+		MaxConnectionsPerIP:     2,
+		MaxConnectionsPerPubkey: 1,
+		MaxSubscriptions:        2,
+		MaxFilters:              2,
+		MaxLimit:                50,
+		DefaultLimit:            20,
+	}))
+
+	// a REQ is a context of its own, each of its filters goes through both hooks and a rejected REQ is closed
+	req := func(conn context.Context, filters ...nostr.Filter) (func(), []nostr.Filter, bool) {
+		ctx, cancel := context.WithCancel(conn)
+		closeREQ := func() {
+			cancel()
+			waitForgotten(t, r, ctx)
+		}
+		rejected := false
+		for i := range filters {
+			r.overwriteFilterCaps(ctx, &filters[i])
+			if reject, _ := r.rejectFilterCaps(ctx, filters[i]); reject {
+				rejected = true
+			}
+		}
+		if rejected {
+			closeREQ()
+		}
+		return closeREQ, filters, rejected
+	}
+
+	conn := connect(r, "203.0.113.7", "")
+	_, filters, rejected := req(conn, nostr.Filter{Limit: 500}, nostr.Filter{})
+	if rejected {
+		t.Fatal("a REQ within the caps was rejected")
+	}
+	if filters[0].Limit != 50 || filters[1].Limit != 20 {
+		t.Errorf("limits = %d and %d, want max_limit 50 and default_limit 20", filters[0].Limit, filters[1].Limit)
+	}
+	if _, _, rejected := req(conn, nostr.Filter{}, nostr.Filter{}, nostr.Filter{}); !rejected {
+		t.Error("a REQ with too many filters was accepted")
+	}
+
+	closeFirst, _, _ := req(conn, nostr.Filter{})
+	if _, _, rejected := req(conn, nostr.Filter{LimitZero: true}); !rejected {
+		t.Error("a limit:0 REQ over max_subscriptions was accepted")
+	}
+	closeFirst()
+	if _, _, rejected := req(conn, nostr.Filter{}); rejected {
+		t.Error("a closed subscription still counts")
+	}
+
+	connect(r, "203.0.113.7", "")
+	if !r.rejectConnectionCount(khatru.GetConnection(conn).Request) {
+		t.Error("a connection over max_connections_per_ip was accepted")
+	}
+	r.trackDisconnect(conn)
+	if r.rejectConnectionCount(khatru.GetConnection(conn).Request) {
+		t.Error("a closed connection still counts")
+	}
+
+	pubkey := testPubkey()
+	if _, _, rejected := req(connect(r, "198.51.100.1", pubkey), nostr.Filter{}); rejected {
+		t.Error("the first connection of a pubkey was rejected")
+	}
+	if _, _, rejected := req(connect(r, "198.51.100.2", pubkey), nostr.Filter{}); !rejected {
+		t.Error("a connection over max_connections_per_pubkey was accepted")
+	}
+}
+
+// waitForgotten waits for the closed REQ ctx to leave the tracker, context.AfterFunc runs in a goroutine of its own.
+func waitForgotten(t *testing.T, r *TenantRelay, ctx context.Context) {
+	t.Helper()
+
+	for range 1000 {
+		r.clients.mu.Lock()
+		state := r.clients.conns[khatru.GetConnection(ctx)]
+		_, open := state.subscriptions[ctx]
+		_, marked := state.closing[ctx]
+		r.clients.mu.Unlock()
+		if !open && !marked {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("a closed REQ is still tracked")
+}
+
+func TestNegentropyCaps(t *testing.T) {
+	r := &TenantRelay{clients: newClientTracker(), relay: khatru.NewRelay(), db: newTestDB(t)}
+	r.limiters.Store(newRelayLimiters(RelayLimits{MaxSubscriptions: 2, MaxNegentropyLimit: 3}))
+	relay := r.relay
+	relay.Negentropy = true
+	relay.OnConnect = append(relay.OnConnect, r.trackConnect)
+	relay.OnDisconnect = append(relay.OnDisconnect, r.trackDisconnect)
+	relay.OverwriteFilter = append(relay.OverwriteFilter, r.overwriteFilterCaps)
+	relay.RejectFilter = append(relay.RejectFilter, r.rejectFilterCaps)
+	relay.QueryEvents = append(relay.QueryEvents, r.db.QueryEvents)
+	for i := range 5 {
+		event := &nostr.Event{PubKey: testPubkey(), Kind: nostr.KindTextNote, CreatedAt: nostr.Timestamp(i + 1)}
+		event.ID = event.GetID()
+		if err := r.db.SaveEvent(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(relay)
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// send writes a message and returns its answer, khatru answers every message of a NIP-77 sync
+	send := func(message ...any) []json.RawMessage {
+		t.Helper()
+		if err := conn.WriteJSON(message); err != nil {
+			t.Fatal(err)
+		}
+		var answer []json.RawMessage
+		if err := conn.ReadJSON(&answer); err != nil {
+			t.Fatal(err)
+		}
+		return answer
+	}
+	client := negentropy.New(vector.New(), 0)
+	open := client.Start()
+
+	answer := send("NEG-OPEN", "a", nostr.Filter{}, open)
+	var msg string
+	if string(answer[0]) != `"NEG-MSG"` || json.Unmarshal(answer[2], &msg) != nil {
+		t.Fatalf("NEG-OPEN answer = %s", answer)
+	}
+	if _, err := client.Reconcile(msg); err != nil {
+		t.Fatal(err)
+	}
+	if missing := len(client.HaveNots); missing != 3 {
+		t.Errorf("the sync compared %d events, want max_negentropy_limit 3", missing)
+	}
+
+	if answer := send("NEG-OPEN", "b", nostr.Filter{}, open); string(answer[0]) != `"NEG-MSG"` {
+		t.Fatalf("a sync within max_subscriptions was refused: %s", answer)
+	}
+	if answer := send("NEG-OPEN", "c", nostr.Filter{}, open); string(answer[0]) == `"NEG-MSG"` {
+		t.Errorf("a sync over max_subscriptions was accepted: %s", answer)
+	}
+	if answer := send("REQ", "d", nostr.Filter{}); string(answer[0]) != `"CLOSED"` {
+		t.Errorf("a REQ over max_subscriptions with the syncs open was accepted: %s", answer)
+	}
+}
@@ -1,16 +1,25 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"maps"
+	"net"
+	"net/url"
 	"os"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/nbd-wtf/go-nostr/nip19"
+	"go.yaml.in/yaml/v3"
 )
 
 type AwsConfig struct {
@@ -51,6 +60,7 @@ type Config struct {
 	ChatRelayNpub                        string        `json:"chat_relay_npub"`
 	ChatRelayDescription                 string        `json:"chat_relay_description"`
 	ChatRelayIcon                        string        `json:"chat_relay_icon"`
+	ChatRelayNsec                        string        `json:"chat_relay_nsec"`
 	OutboxRelayName                      string        `json:"outbox_relay_name"`
 	OutboxRelayNpub                      string        `json:"outbox_relay_npub"`
 	OutboxRelayDescription               string        `json:"outbox_relay_description"`
@@ -72,59 +82,410 @@ type Config struct {
 	WotFetchTimeoutSeconds               int           `json:"wot_fetch_timeout_seconds"`
 	WotRefreshInterval                   time.Duration `json:"wot_refresh_interval"`
 	LogLevel                             string        `json:"log_level"`
+	TenantsFile                          string        `json:"tenants_file"`
+	RelaysFile                           string        `json:"relays_file"`
+	ShutdownTimeout                      time.Duration `json:"shutdown_timeout"`
+	RelayUnixSocket                      string        `json:"relay_unix_socket"`
+	AdminAddress                         string        `json:"admin_address"`
+	TLSCertFile                          string        `json:"tls_cert_file"`
+	TLSKeyFile                           string        `json:"tls_key_file"`
+	TrustedProxies                       []string      `json:"trusted_proxies"`
+	ExpirationSweepInterval              time.Duration `json:"expiration_sweep_interval"`
 	BlastrRelays                         []string      `json:"blastr_relays"`
+	ReplicationPrimaryURL                string        `json:"replication_primary_url"`
+	ReplicationSecret                    string        `json:"replication_secret"`
+	ReplicationAddress                   string        `json:"replication_address"`
+	ReplicationAllowedIPs                []string      `json:"replication_allowed_ips"`
+	ReplicationInterval                  time.Duration `json:"replication_interval"`
+	ReplicationReconcileInterval         time.Duration `json:"replication_reconcile_interval"`
 	AwsConfig                            *AwsConfig    `json:"aws_config"`
 	S3Config                             *S3Config     `json:"s3_config"`
 	GcpConfig                            *GcpConfig    `json:"gcp_config"`
 }
 
+// envSource looks up a configuration value, tenants use it to layer their own variables over the
+// process environment.
+type envSource func(key string) (string, bool)
+
+// processEnv holds the variables set before .env was loaded, they keep precedence over .env when the
+// configuration is reloaded.
+var processEnv map[string]string
+
 func loadConfig() Config {
+	snapshotProcessEnv()
 	_ = godotenv.Load(".env")
 
-	return Config{
-		OwnerNpub:                            getEnv("OWNER_NPUB"),
-		OwnerNpubKey:                         nPubToPubkey(getEnv("OWNER_NPUB")),
-		DBEngine:                             getEnvString("DB_ENGINE", "lmdb"),
-		LmdbMapSize:                          getEnvInt64("LMDB_MAPSIZE", 0),
-		BlossomPath:                          getEnvString("BLOSSOM_PATH", "blossom"),
-		RelayURL:                             getEnv("RELAY_URL"),
-		RelayPort:                            getEnvInt("RELAY_PORT", 3355),
-		RelayBindAddress:                     getEnvString("RELAY_BIND_ADDRESS", "0.0.0.0"),
+	env, err := baseEnv()
+	if err != nil {
+		log.Fatalf("🚫 %s", err)
+	}
+	cfg, err := loadConfigFrom(env)
+	if err != nil {
+		log.Fatalf("🚫 invalid configuration:\n%s", err)
+	}
+	return cfg
+}
+
+func snapshotProcessEnv() {
+	processEnv = make(map[string]string)
+	for _, kv := range os.Environ() {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			processEnv[key] = value
+		}
+	}
+}
+
+// baseEnv reads .env and the config file again. The process environment takes precedence over .env, which
+// takes precedence over the config file.
+func baseEnv() (envSource, error) {
+	vars, err := godotenv.Read(".env")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read .env: %w", err)
+	}
+
+	fileVars, err := readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(key string) (string, bool) {
+		if value, ok := processEnv[key]; ok {
+			return value, true
+		}
+		if value, ok := vars[key]; ok {
+			return value, true
+		}
+		value, ok := fileVars[key]
+		return value, ok
+	}, nil
+}
+
+// readConfigFile reads the YAML file set by HAVEN_CONFIG, or haven.yaml if it exists. Nested keys are
+// joined with underscores and upper-cased, so chat_relay: {name: Chat} sets CHAT_RELAY_NAME.
+func readConfigFile() (map[string]string, error) {
+	path, explicit := os.LookupEnv("HAVEN_CONFIG")
+	if !explicit {
+		path = "haven.yaml"
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var tree map[string]any
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	vars := make(map[string]string)
+	if err := flattenConfig("", tree, vars); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return vars, nil
+}
+
+func flattenConfig(prefix string, tree map[string]any, vars map[string]string) error {
+	for key, value := range tree {
+		name := strings.ToUpper(key)
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+
+		switch v := value.(type) {
+		case map[string]any:
+			if err := flattenConfig(name, v, vars); err != nil {
+				return err
+			}
+		case []any:
+			return fmt.Errorf("%s: lists are not supported", name)
+		case nil:
+			vars[name] = ""
+		default:
+			vars[name] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// configLoader reads a Config from an envSource. It collects every invalid value instead of stopping at
+// the first one, and records the effective value of every variable it reads for haven config print.
+type configLoader struct {
+	env      envSource
+	problems []error
+	values   map[string]string
+}
+
+func newConfigLoader(env envSource) *configLoader {
+	return &configLoader{env: env, values: make(map[string]string)}
+}
+
+func (l *configLoader) problem(format string, args ...any) {
+	l.problems = append(l.problems, fmt.Errorf(format, args...))
+}
+
+// errSince joins the problems found after the first n.
+func (l *configLoader) errSince(n int) error {
+	return errors.Join(l.problems[n:]...)
+}
+
+func (l *configLoader) err() error {
+	return l.errSince(0)
+}
+
+func loadConfigFrom(env envSource) (Config, error) {
+	l := newConfigLoader(env)
+	cfg := l.load()
+	return cfg, l.err()
+}
+
+func (l *configLoader) load() Config {
+	ownerNpub := l.getEnv("OWNER_NPUB")
+
+	cfg := Config{
+		OwnerNpub:                            ownerNpub,
+		OwnerNpubKey:                         l.npubToPubkey("OWNER_NPUB", ownerNpub),
+		DBEngine:                             l.getEnvString("DB_ENGINE", "lmdb"),
+		LmdbMapSize:                          l.getEnvInt64("LMDB_MAPSIZE", 0),
+		BlossomPath:                          l.getEnvString("BLOSSOM_PATH", "blossom"),
+		RelayURL:                             l.getEnv("RELAY_URL"),
+		RelayPort:                            l.getEnvInt("RELAY_PORT", 3355),
+		RelayBindAddress:                     l.getEnvString("RELAY_BIND_ADDRESS", "0.0.0.0"),
 		RelaySoftware:                        "https://github.com/bitvora/haven",
 		RelayVersion:                         getVersion(),
-		PrivateRelayName:                     getEnv("PRIVATE_RELAY_NAME"),
-		PrivateRelayNpub:                     getEnv("PRIVATE_RELAY_NPUB"),
-		PrivateRelayDescription:              getEnv("PRIVATE_RELAY_DESCRIPTION"),
-		PrivateRelayIcon:                     getEnv("PRIVATE_RELAY_ICON"),
-		ChatRelayName:                        getEnv("CHAT_RELAY_NAME"),
-		ChatRelayNpub:                        getEnv("CHAT_RELAY_NPUB"),
-		ChatRelayDescription:                 getEnv("CHAT_RELAY_DESCRIPTION"),
-		ChatRelayIcon:                        getEnv("CHAT_RELAY_ICON"),
-		OutboxRelayName:                      getEnv("OUTBOX_RELAY_NAME"),
-		OutboxRelayNpub:                      getEnv("OUTBOX_RELAY_NPUB"),
-		OutboxRelayDescription:               getEnv("OUTBOX_RELAY_DESCRIPTION"),
-		OutboxRelayIcon:                      getEnv("OUTBOX_RELAY_ICON"),
-		InboxRelayName:                       getEnv("INBOX_RELAY_NAME"),
-		InboxRelayNpub:                       getEnv("INBOX_RELAY_NPUB"),
-		InboxRelayDescription:                getEnv("INBOX_RELAY_DESCRIPTION"),
-		InboxRelayIcon:                       getEnv("INBOX_RELAY_ICON"),
-		InboxPullIntervalSeconds:             getEnvInt("INBOX_PULL_INTERVAL_SECONDS", 3600),
-		ImportStartDate:                      getEnv("IMPORT_START_DATE"),
-		ImportOwnerNotesFetchTimeoutSeconds:  getEnvInt("IMPORT_OWNER_NOTES_FETCH_TIMEOUT_SECONDS", 30),
-		ImportTaggedNotesFetchTimeoutSeconds: getEnvInt("IMPORT_TAGGED_NOTES_FETCH_TIMEOUT_SECONDS", 120),
-		ImportQueryIntervalSeconds:           getEnvInt("IMPORT_QUERY_INTERVAL_SECONDS", 360000),
-		ImportSeedRelays:                     getRelayListFromFile(getEnv("IMPORT_SEED_RELAYS_FILE")),
-		BackupProvider:                       getEnvString("BACKUP_PROVIDER", "none"),
-		BackupIntervalHours:                  getEnvInt("BACKUP_INTERVAL_HOURS", 24),
-		WotDepth:                             getEnvInt("WOT_DEPTH", 3),
-		WotMinimumFollowers:                  getEnvInt("WOT_MINIMUM_FOLLOWERS", 0),
-		WotFetchTimeoutSeconds:               getEnvInt("WOT_FETCH_TIMEOUT_SECONDS", 30),
-		WotRefreshInterval:                   getEnvDuration("WOT_REFRESH_INTERVAL", 24*time.Hour),
-		LogLevel:                             getEnvString("HAVEN_LOG_LEVEL", "INFO"),
-		BlastrRelays:                         getRelayListFromFile(getEnv("BLASTR_RELAYS_FILE")),
-		AwsConfig:                            getAwsConfig(),
-		S3Config:                             getS3Config(),
-		GcpConfig:                            getGcpConfig(),
+		PrivateRelayName:                     l.getEnv("PRIVATE_RELAY_NAME"),
+		PrivateRelayNpub:                     l.getEnv("PRIVATE_RELAY_NPUB"),
+		PrivateRelayDescription:              l.getEnv("PRIVATE_RELAY_DESCRIPTION"),
+		PrivateRelayIcon:                     l.getEnv("PRIVATE_RELAY_ICON"),
+		ChatRelayName:                        l.getEnv("CHAT_RELAY_NAME"),
+		ChatRelayNpub:                        l.getEnv("CHAT_RELAY_NPUB"),
+		ChatRelayDescription:                 l.getEnv("CHAT_RELAY_DESCRIPTION"),
+		ChatRelayIcon:                        l.getEnv("CHAT_RELAY_ICON"),
+		ChatRelayNsec:                        l.getEnvString("CHAT_RELAY_NSEC", ""),
+		OutboxRelayName:                      l.getEnv("OUTBOX_RELAY_NAME"),
+		OutboxRelayNpub:                      l.getEnv("OUTBOX_RELAY_NPUB"),
+		OutboxRelayDescription:               l.getEnv("OUTBOX_RELAY_DESCRIPTION"),
+		OutboxRelayIcon:                      l.getEnv("OUTBOX_RELAY_ICON"),
+		InboxRelayName:                       l.getEnv("INBOX_RELAY_NAME"),
+		InboxRelayNpub:                       l.getEnv("INBOX_RELAY_NPUB"),
+		InboxRelayDescription:                l.getEnv("INBOX_RELAY_DESCRIPTION"),
+		InboxRelayIcon:                       l.getEnv("INBOX_RELAY_ICON"),
+		InboxPullIntervalSeconds:             l.getEnvInt("INBOX_PULL_INTERVAL_SECONDS", 3600),
+		ImportStartDate:                      l.getEnv("IMPORT_START_DATE"),
+		ImportOwnerNotesFetchTimeoutSeconds:  l.getEnvInt("IMPORT_OWNER_NOTES_FETCH_TIMEOUT_SECONDS", 30),
+		ImportTaggedNotesFetchTimeoutSeconds: l.getEnvInt("IMPORT_TAGGED_NOTES_FETCH_TIMEOUT_SECONDS", 120),
+		ImportQueryIntervalSeconds:           l.getEnvInt("IMPORT_QUERY_INTERVAL_SECONDS", 360000),
+		ImportSeedRelays:                     l.getRelayList("IMPORT_SEED_RELAYS_FILE"),
+		BackupProvider:                       l.getEnvString("BACKUP_PROVIDER", "none"),
+		BackupIntervalHours:                  l.getEnvInt("BACKUP_INTERVAL_HOURS", 24),
+		WotDepth:                             l.getEnvInt("WOT_DEPTH", 3),
+		WotMinimumFollowers:                  l.getEnvInt("WOT_MINIMUM_FOLLOWERS", 0),
+		WotFetchTimeoutSeconds:               l.getEnvInt("WOT_FETCH_TIMEOUT_SECONDS", 30),
+		WotRefreshInterval:                   l.getEnvDuration("WOT_REFRESH_INTERVAL", 24*time.Hour),
+		LogLevel:                             l.getEnvString("HAVEN_LOG_LEVEL", "INFO"),
+		TenantsFile:                          l.getEnvString("TENANTS_FILE", ""),
+		RelaysFile:                           l.getEnvString("RELAYS_FILE", ""),
+		ShutdownTimeout:                      l.getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		RelayUnixSocket:                      l.getEnvString("RELAY_UNIX_SOCKET", ""),
+		AdminAddress:                         l.getAdminAddress(),
+		TLSCertFile:                          l.getEnvString("TLS_CERT_FILE", ""),
+		TLSKeyFile:                           l.getEnvString("TLS_KEY_FILE", ""),
+		TrustedProxies:                       l.getIPList("TRUSTED_PROXIES"),
+		ExpirationSweepInterval:              l.getEnvDuration("EXPIRATION_SWEEP_INTERVAL", time.Hour),
+		BlastrRelays:                         l.getRelayList("BLASTR_RELAYS_FILE"),
+		ReplicationPrimaryURL:                strings.TrimSuffix(l.getEnvString("REPLICATION_PRIMARY_URL", ""), "/"),
+		ReplicationSecret:                    l.getEnvString("REPLICATION_SECRET", ""),
+		ReplicationAddress:                   l.getEnvString("REPLICATION_ADDRESS", ""),
+		ReplicationAllowedIPs:                l.getIPList("REPLICATION_ALLOWED_IPS"),
+		ReplicationInterval:                  l.getEnvDuration("REPLICATION_INTERVAL", 30*time.Second),
+		ReplicationReconcileInterval:         l.getEnvDuration("REPLICATION_RECONCILE_INTERVAL", 6*time.Hour),
+		AwsConfig:                            l.getAwsConfig(),
+		S3Config:                             l.getS3Config(),
+		GcpConfig:                            l.getGcpConfig(),
+	}
+	l.checkListeners(&cfg)
+	l.checkReplication(&cfg)
+	return cfg
+}
+
+func (l *configLoader) checkListeners(cfg *Config) {
+	if cfg.RelayPort == 0 && cfg.RelayUnixSocket == "" {
+		l.problem("RELAY_PORT is 0 and RELAY_UNIX_SOCKET is not set, the relays would not be served")
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		l.problem("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	} else if cfg.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			l.problem("TLS_CERT_FILE, TLS_KEY_FILE: %w", err)
+		}
+	}
+}
+
+// minReplicationSecretLength keeps the shared secret of the replicas out of reach of a brute force.
+const minReplicationSecretLength = 32
+
+func (l *configLoader) checkReplication(cfg *Config) {
+	if cfg.ReplicationSecret != "" && len(cfg.ReplicationSecret) < minReplicationSecretLength {
+		l.problem("REPLICATION_SECRET must be at least %d characters long", minReplicationSecretLength)
+	}
+	if cfg.ReplicationAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.ReplicationAddress); err != nil {
+			l.problem("REPLICATION_ADDRESS: invalid address %q", cfg.ReplicationAddress)
+		}
+		if cfg.ReplicationSecret == "" {
+			l.problem("REPLICATION_SECRET is required when REPLICATION_ADDRESS is set")
+		}
+	}
+	if cfg.ReplicationPrimaryURL == "" {
+		return
+	}
+
+	if u, err := url.Parse(cfg.ReplicationPrimaryURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		l.problem("REPLICATION_PRIMARY_URL: %q is not an http or https URL", cfg.ReplicationPrimaryURL)
+	}
+	if cfg.ReplicationSecret == "" {
+		l.problem("REPLICATION_SECRET is required when REPLICATION_PRIMARY_URL is set")
+	}
+	if cfg.ReplicationInterval <= 0 {
+		l.problem("REPLICATION_INTERVAL must be positive")
+	}
+	if cfg.ReplicationReconcileInterval < cfg.ReplicationInterval {
+		l.problem("REPLICATION_RECONCILE_INTERVAL must be at least REPLICATION_INTERVAL")
+	}
+}
+
+// metricsAddressWarning is logged once, the configuration is loaded again for every tenant and reload.
+var metricsAddressWarning sync.Once
+
+// getAdminAddress reads ADMIN_ADDRESS, or METRICS_ADDRESS, its name before it also served the health checks
+// and reloads.
+func (l *configLoader) getAdminAddress() string {
+	legacy, _ := l.env("METRICS_ADDRESS")
+	if legacy == "" {
+		return l.getLoopbackAddress("ADMIN_ADDRESS")
+	}
+
+	if admin, _ := l.env("ADMIN_ADDRESS"); admin != "" {
+		l.problem("METRICS_ADDRESS was renamed ADMIN_ADDRESS, remove it")
+		return ""
+	}
+	metricsAddressWarning.Do(func() {
+		log.Println("⚠️ METRICS_ADDRESS was renamed ADMIN_ADDRESS, it now also serves /healthz, /readyz and /reload")
+	})
+	return l.getLoopbackAddress("METRICS_ADDRESS")
+}
+
+// getLoopbackAddress reads a host:port that must only be reachable from this machine.
+func (l *configLoader) getLoopbackAddress(key string) string {
+	addr := l.getEnvString(key, "")
+	if addr == "" {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		l.problem("%s: invalid address %q", key, addr)
+		return ""
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		l.problem("%s: %s is not a loopback address", key, addr)
+		return ""
+	}
+	return addr
+}
+
+// configReport is the effective configuration of the process or of a tenant, and its problems.
+type configReport struct {
+	tenant string
+	values map[string]string
+	err    error
+}
+
+// checkConfig loads the configuration like HAVEN does at startup, reporting every problem instead of
+// exiting on the first one.
+func checkConfig() []configReport {
+	base, err := baseEnv()
+	if err != nil {
+		return []configReport{{err: err}}
+	}
+
+	l := newConfigLoader(base)
+	cfg := l.load()
+	cfgErr := l.err()
+
+	if cfg.TenantsFile == "" {
+		_, specsErr := readRelaySpecs(&cfg, l)
+		return []configReport{{values: l.values, err: errors.Join(cfgErr, specsErr)}}
+	}
+
+	tenants, tenantsErr := readTenants(&cfg, base)
+	reports := []configReport{{values: l.values, err: errors.Join(cfgErr, tenantsErr)}}
+	for _, t := range tenants {
+		tl := newConfigLoader(t.env)
+		tenantCfg := tl.load()
+		_, specsErr := readRelaySpecs(&tenantCfg, tl)
+		reports = append(reports, configReport{tenant: t.Host, values: tl.values, err: specsErr})
+	}
+	return reports
+}
+
+// runConfig implements haven config validate and haven config print.
+func runConfig() {
+	if len(os.Args) < 3 || (os.Args[2] != "validate" && os.Args[2] != "print") {
+		fmt.Println("usage: haven config [validate|print]")
+		os.Exit(1)
+	}
+
+	snapshotProcessEnv()
+	reports := checkConfig()
+
+	if os.Args[2] == "print" {
+		for _, report := range reports {
+			printConfigValues(report)
+		}
+	}
+
+	valid := true
+	for _, report := range reports {
+		if report.err == nil {
+			continue
+		}
+		valid = false
+		if report.tenant != "" {
+			fmt.Fprintf(os.Stderr, "🚫 tenant %s:\n", report.tenant)
+		} else {
+			fmt.Fprintln(os.Stderr, "🚫 configuration problems:")
+		}
+		for _, line := range strings.Split(report.err.Error(), "\n") {
+			fmt.Fprintln(os.Stderr, "  "+line)
+		}
+	}
+
+	if !valid {
+		os.Exit(1)
+	}
+	if os.Args[2] == "validate" {
+		fmt.Println("✅ configuration is valid")
+	}
+}
+
+// secretKeys are the variables haven config print redacts.
+var secretKeys = []string{"CHAT_RELAY_NSEC", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "S3_ACCESS_KEY_ID", "S3_SECRET_KEY", "REPLICATION_SECRET"}
+
+func printConfigValues(report configReport) {
+	if report.tenant != "" {
+		fmt.Printf("\n# tenant %s\n", report.tenant)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(report.values)) {
+		value := report.values[key]
+		if value != "" && slices.Contains(secretKeys, key) {
+			value = "<redacted>"
+		}
+		fmt.Printf("%s=%q\n", key, value)
 	}
 }
 
@@ -136,58 +497,66 @@ func getVersion() string {
 	return info.Main.Version
 }
 
-func getAwsConfig() *AwsConfig {
-	backupProvider := getEnvString("BACKUP_PROVIDER", "none")
+func (l *configLoader) getAwsConfig() *AwsConfig {
+	backupProvider := l.getEnvString("BACKUP_PROVIDER", "none")
 
 	if backupProvider == "aws" {
 		return &AwsConfig{
-			AccessKeyID:     getEnv("AWS_ACCESS_KEY_ID"),
-			SecretAccessKey: getEnv("AWS_SECRET_ACCESS_KEY"),
-			Region:          getEnv("AWS_REGION"),
-			Bucket:          getEnv("AWS_BUCKET"),
+			AccessKeyID:     l.getEnv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: l.getEnv("AWS_SECRET_ACCESS_KEY"),
+			Region:          l.getEnv("AWS_REGION"),
+			Bucket:          l.getEnv("AWS_BUCKET"),
 		}
 	}
 
 	return nil
 }
 
-func getS3Config() *S3Config {
-	backupProvider := getEnvString("BACKUP_PROVIDER", "none")
+func (l *configLoader) getS3Config() *S3Config {
+	backupProvider := l.getEnvString("BACKUP_PROVIDER", "none")
 
 	if backupProvider == "s3" {
 		return &S3Config{
-			AccessKeyID: getEnv("S3_ACCESS_KEY_ID"),
-			SecretKey:   getEnv("S3_SECRET_KEY"),
-			Endpoint:    getEnv("S3_ENDPOINT"),
-			BucketName:  getEnv("S3_BUCKET_NAME"),
-			Region:      getEnv("S3_REGION"),
+			AccessKeyID: l.getEnv("S3_ACCESS_KEY_ID"),
+			SecretKey:   l.getEnv("S3_SECRET_KEY"),
+			Endpoint:    l.getEnv("S3_ENDPOINT"),
+			BucketName:  l.getEnv("S3_BUCKET_NAME"),
+			Region:      l.getEnv("S3_REGION"),
 		}
 	}
 
 	return nil
 }
 
-func getGcpConfig() *GcpConfig {
-	backupProvider := getEnvString("BACKUP_PROVIDER", "none")
+func (l *configLoader) getGcpConfig() *GcpConfig {
+	backupProvider := l.getEnvString("BACKUP_PROVIDER", "none")
 
 	if backupProvider == "gcp" {
 		return &GcpConfig{
-			Bucket: getEnv("GCP_BUCKET_NAME"),
+			Bucket: l.getEnv("GCP_BUCKET_NAME"),
 		}
 	}
 
 	return nil
 }
 
-func getRelayListFromFile(filePath string) []string {
+// getRelayList reads the JSON list of relay URLs in the file named by key.
+func (l *configLoader) getRelayList(key string) []string {
+	filePath := l.getEnv(key)
+	if filePath == "" {
+		return nil
+	}
+
 	file, err := os.ReadFile(filePath)
 	if err != nil {
-		log.Fatalf("Failed to read file: %s", err)
+		l.problem("%s: failed to read relay list: %w", key, err)
+		return nil
 	}
 
 	var relayList []string
 	if err := json.Unmarshal(file, &relayList); err != nil {
-		log.Fatalf("Failed to parse JSON: %s", err)
+		l.problem("%s: failed to parse relay list %s: %w", key, filePath, err)
+		return nil
 	}
 
 	for i, relay := range relayList {
@@ -200,65 +569,114 @@ func getRelayListFromFile(filePath string) []string {
 	return relayList
 }
 
-func getEnv(key string) string {
-	value, exists := os.LookupEnv(key)
+func (l *configLoader) getEnv(key string) string {
+	value, exists := l.env(key)
 	if !exists {
-		log.Fatalf("Environment variable %s not set", key)
+		l.problem("%s is not set", key)
 	}
+	l.values[key] = value
 	return value
 }
 
-func getEnvString(key string, defaultValue string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+func (l *configLoader) getEnvString(key string, defaultValue string) string {
+	value, ok := l.env(key)
+	if !ok {
+		value = defaultValue
 	}
-	return defaultValue
+	l.values[key] = value
+	return value
 }
 
-func getEnvInt(key string, defaultValue int) int {
-	if value, ok := os.LookupEnv(key); ok {
+func (l *configLoader) getEnvInt(key string, defaultValue int) int {
+	if value, ok := l.env(key); ok {
+		l.values[key] = value
 		intValue, err := strconv.Atoi(value)
 		if err != nil {
-			panic(err)
+			l.problem("%s: invalid integer %q", key, value)
+			return defaultValue
 		}
 		return intValue
 	}
+	l.values[key] = strconv.Itoa(defaultValue)
 	return defaultValue
 }
 
-func getEnvInt64(key string, defaultValue int64) int64 {
-	if value, ok := os.LookupEnv(key); ok {
+func (l *configLoader) getEnvInt64(key string, defaultValue int64) int64 {
+	if value, ok := l.env(key); ok {
+		l.values[key] = value
 		intValue, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
-			panic(err)
+			l.problem("%s: invalid integer %q", key, value)
+			return defaultValue
 		}
 		return intValue
 	}
+	l.values[key] = strconv.FormatInt(defaultValue, 10)
 	return defaultValue
 }
 
-func getEnvBool(key string, defaultValue bool) bool {
-	if value, ok := os.LookupEnv(key); ok {
+func (l *configLoader) getEnvBool(key string, defaultValue bool) bool {
+	if value, ok := l.env(key); ok {
+		l.values[key] = value
 		boolValue, err := strconv.ParseBool(value)
 		if err != nil {
-			panic(err)
+			l.problem("%s: invalid boolean %q", key, value)
+			return defaultValue
 		}
 		return boolValue
 	}
+	l.values[key] = strconv.FormatBool(defaultValue)
 	return defaultValue
 }
 
-func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
-	if value, ok := os.LookupEnv(key); ok {
+func (l *configLoader) getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, ok := l.env(key); ok {
+		l.values[key] = value
 		durationValue, err := time.ParseDuration(value)
 		if err != nil {
-			panic(err)
+			l.problem("%s: invalid duration %q", key, value)
+			return defaultValue
 		}
 		return durationValue
 	}
+	l.values[key] = defaultValue.String()
 	return defaultValue
 }
 
+// getEnvList reads a comma-separated list, empty items are dropped.
+func (l *configLoader) getEnvList(key string, defaultValue string) []string {
+	var list []string
+	for _, item := range strings.Split(l.getEnvString(key, defaultValue), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getIPList reads a comma-separated list of IPs and CIDRs.
+func (l *configLoader) getIPList(key string) []string {
+	list := l.getEnvList(key, "")
+	if _, err := parseIPList(list); err != nil {
+		l.problem("%s: %w", key, err)
+		return nil
+	}
+	return list
+}
+
+// npubToPubkey decodes the npub read from key, a missing value has already been reported by getEnv.
+func (l *configLoader) npubToPubkey(key string, nPub string) string {
+	if nPub == "" {
+		return ""
+	}
+	prefix, v, err := nip19.Decode(nPub)
+	if err != nil || prefix != "npub" {
+		l.problem("%s: invalid npub %q", key, nPub)
+		return ""
+	}
+	return v.(string)
+}
+
 func nPubToPubkey(nPub string) string {
 	_, v, err := nip19.Decode(nPub)
 	if err != nil {
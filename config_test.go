@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAdminAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    string
+		invalid bool
+	}{
+		{"unset", nil, "", false},
+		{"admin address", map[string]string{"ADMIN_ADDRESS": "127.0.0.1:9100"}, "127.0.0.1:9100", false},
+		{"former metrics address", map[string]string{"METRICS_ADDRESS": "127.0.0.1:9100"}, "127.0.0.1:9100", false},
+		{"both", map[string]string{"ADMIN_ADDRESS": "127.0.0.1:9100", "METRICS_ADDRESS": "127.0.0.1:9101"}, "", true},
+		{"public metrics address", map[string]string{"METRICS_ADDRESS": "0.0.0.0:9100"}, "", true},
+		{"public admin address", map[string]string{"ADMIN_ADDRESS": "0.0.0.0:9100"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfigFrom(exampleEnv(t, tt.env))
+			if (err != nil) != tt.invalid {
+				t.Fatalf("loadConfigFrom() error = %v, want invalid %v", err, tt.invalid)
+			}
+			if err == nil && cfg.AdminAddress != tt.want {
+				t.Errorf("AdminAddress = %q, want %q", cfg.AdminAddress, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplicationConfig(t *testing.T) {
+	secret := strings.Repeat("s", minReplicationSecretLength)
+	tests := []struct {
+		name    string
+		env     map[string]string
+		invalid bool
+	}{
+		{"disabled", nil, false},
+		{"primary", map[string]string{"REPLICATION_SECRET": secret, "REPLICATION_ADDRESS": "10.0.0.1:9200", "REPLICATION_ALLOWED_IPS": "10.0.0.2,10.0.1.0/24"}, false},
+		{"replica", map[string]string{"REPLICATION_SECRET": secret, "REPLICATION_PRIMARY_URL": "https://10.0.0.1:9200"}, false},
+		{"short secret", map[string]string{"REPLICATION_SECRET": "short", "REPLICATION_ADDRESS": "10.0.0.1:9200"}, true},
+		{"primary without secret", map[string]string{"REPLICATION_ADDRESS": "10.0.0.1:9200"}, true},
+		{"invalid address", map[string]string{"REPLICATION_SECRET": secret, "REPLICATION_ADDRESS": "10.0.0.1"}, true},
+		{"invalid allowed IP", map[string]string{"REPLICATION_SECRET": secret, "REPLICATION_ADDRESS": "10.0.0.1:9200", "REPLICATION_ALLOWED_IPS": "replica"}, true},
+		{"replica without secret", map[string]string{"REPLICATION_PRIMARY_URL": "https://10.0.0.1:9200"}, true},
+		{"primary URL not http", map[string]string{"REPLICATION_SECRET": secret, "REPLICATION_PRIMARY_URL": "wss://10.0.0.1:9200"}, true},
+		{"reconcile more often than sync", map[string]string{"REPLICATION_SECRET": secret, "REPLICATION_PRIMARY_URL": "https://10.0.0.1:9200", "REPLICATION_INTERVAL": "1m", "REPLICATION_RECONCILE_INTERVAL": "30s"}, true},
+		{"no interval", map[string]string{"REPLICATION_SECRET": secret, "REPLICATION_PRIMARY_URL": "https://10.0.0.1:9200", "REPLICATION_INTERVAL": "0s"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadConfigFrom(exampleEnv(t, tt.env)); (err != nil) != tt.invalid {
+				t.Errorf("loadConfigFrom() error = %v, want invalid %v", err, tt.invalid)
+			}
+		})
+	}
+}
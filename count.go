@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"slices"
+
+	lmdbgo "github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/fiatjaf/eventstore/lmdb"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip45/hyperloglog"
+)
+
+// The LMDB backend of eventstore v0.17.5 never advances its cursor once an event matches in CountEvents and
+// CountEventsHLL, a COUNT spins forever. LMDB counts walk the index keys of the filter instead, reading the raw
+// events only for their kind or pubkey, and fall back to walking the matching events a page at a time for the
+// filters the indexes can't answer alone. Badger counts straight from its indexes.
+
+// countEvents is the NIP-45 COUNT of a database.
+func countEvents(db DBBackend) func(ctx context.Context, filter nostr.Filter) (int64, error) {
+	ldb, ok := db.(*lmdb.LMDBBackend)
+	if !ok {
+		return db.CountEvents
+	}
+
+	return func(ctx context.Context, filter nostr.Filter) (int64, error) {
+		var count int64
+		if plan, ok := planLMDBCount(filter); ok {
+			err := plan.walk(ctx, ldb, false, func([]byte) {
+				count++
+			})
+			return count, err
+		}
+
+		err := forEachEvent(ctx, db, filter, func(*nostr.Event) {
+			count++
+		})
+		return count, err
+	}
+}
+
+// countEventsHLL is the NIP-45 COUNT of a database for the filters khatru computes a HyperLogLog for, the
+// followers of a pubkey and the reactions and comments to an event. The registers are built from the pubkeys
+// of the matching events at the offset derived from the filter.
+func countEventsHLL(db DBBackend) func(ctx context.Context, filter nostr.Filter, offset int) (int64, *hyperloglog.HyperLogLog, error) {
+	ldb, ok := db.(*lmdb.LMDBBackend)
+	if !ok {
+		return db.CountEventsHLL
+	}
+
+	return func(ctx context.Context, filter nostr.Filter, offset int) (int64, *hyperloglog.HyperLogLog, error) {
+		var count int64
+		hll := hyperloglog.New(offset)
+		if plan, ok := planLMDBCount(filter); ok {
+			err := plan.walk(ctx, ldb, true, func(raw []byte) {
+				count++
+				hll.AddBytes(raw[32:64])
+			})
+			return count, hll, err
+		}
+
+		err := forEachEvent(ctx, db, filter, func(event *nostr.Event) {
+			count++
+			hll.Add(event.PubKey)
+		})
+		return count, hll, err
+	}
+}
+
+// lmdbCountPlan is the index keys a count walks: the keys of an index starting with one of the prefixes, of
+// keySize bytes ending with the created_at, and the kinds the raw events must have when the index doesn't hold
+// them. The index is named after its field in the LMDB backend.
+type lmdbCountPlan struct {
+	index    string
+	prefixes [][]byte
+	keySize  int
+	kinds    [][2]byte
+	since    uint32
+	until    uint32
+}
+
+// planLMDBCount picks the index a count of filter walks the way the query planner of eventstore does, for the
+// filters an index answers alone: kinds, authors, and a single "p" or 32-byte tag with kinds.
+func planLMDBCount(filter nostr.Filter) (lmdbCountPlan, bool) {
+	plan := lmdbCountPlan{until: ^uint32(0)}
+	if filter.Since != nil {
+		plan.since = uint32(*filter.Since)
+	}
+	if filter.Until != nil {
+		plan.until = uint32(*filter.Until)
+	}
+
+	switch {
+	case len(filter.IDs) > 0 || filter.Search != "" || len(filter.Tags) > 1:
+		return plan, false
+
+	case len(filter.Tags) == 1:
+		if len(filter.Authors) > 0 {
+			return plan, false
+		}
+		for name, values := range filter.Tags {
+			if len(name) != 1 {
+				return plan, false
+			}
+			for _, value := range values {
+				id, err := hex.DecodeString(value)
+				if err != nil || len(id) != 32 {
+					return plan, false
+				}
+				if name != "p" {
+					plan.prefixes = append(plan.prefixes, append([]byte{name[0]}, id[:8]...))
+					continue
+				}
+				if len(filter.Kinds) == 0 {
+					plan.prefixes = append(plan.prefixes, id[:8])
+				}
+				for _, kind := range filter.Kinds {
+					plan.prefixes = append(plan.prefixes, binary.BigEndian.AppendUint16(id[:8:8], uint16(kind)))
+				}
+			}
+			plan.index, plan.keySize = "indexTag32", 1+8+4
+			if name == "p" {
+				plan.index, plan.keySize = "indexPTagKind", 8+2+4
+			} else {
+				for _, kind := range filter.Kinds {
+					plan.kinds = append(plan.kinds, [2]byte(binary.BigEndian.AppendUint16(nil, uint16(kind))))
+				}
+			}
+		}
+
+	case len(filter.Authors) > 0:
+		for _, author := range filter.Authors {
+			pubkey, err := hex.DecodeString(author)
+			if err != nil || len(pubkey) != 32 {
+				return plan, false
+			}
+			if len(filter.Kinds) == 0 {
+				plan.prefixes = append(plan.prefixes, pubkey[:8])
+			}
+			for _, kind := range filter.Kinds {
+				plan.prefixes = append(plan.prefixes, binary.BigEndian.AppendUint16(pubkey[:8:8], uint16(kind)))
+			}
+		}
+		plan.index, plan.keySize = "indexPubkey", 8+4
+		if len(filter.Kinds) > 0 {
+			plan.index, plan.keySize = "indexPubkeyKind", 8+2+4
+		}
+
+	case len(filter.Kinds) > 0:
+		for _, kind := range filter.Kinds {
+			plan.prefixes = append(plan.prefixes, binary.BigEndian.AppendUint16(nil, uint16(kind)))
+		}
+		plan.index, plan.keySize = "indexKind", 2+4
+
+	default:
+		plan.prefixes = [][]byte{{}}
+		plan.index, plan.keySize = "indexCreatedAt", 4
+	}
+	return plan, true
+}
+
+// walk calls fn for every event matching the plan, with its raw event when withRaw is set or the plan checks
+// kinds. An event tagging several of the values is counted once.
+func (p lmdbCountPlan) walk(ctx context.Context, db *lmdb.LMDBBackend, withRaw bool, fn func(raw []byte)) error {
+	withRaw = withRaw || len(p.kinds) > 0
+	var seen map[string]bool
+	if len(p.prefixes) > 1 && (p.index == "indexTag32" || p.index == "indexPTagKind") {
+		seen = make(map[string]bool)
+	}
+
+	// eventstore keeps the environment and the databases of the backend unexported
+	backend := reflect.ValueOf(db).Elem()
+	env := (*lmdbgo.Env)(backend.FieldByName("lmdbEnv").UnsafePointer())
+	index := lmdbgo.DBI(backend.FieldByName(p.index).Uint())
+	rawEvents := lmdbgo.DBI(backend.FieldByName("rawEventStore").Uint())
+
+	return env.View(func(txn *lmdbgo.Txn) error {
+		txn.RawRead = true
+		for _, prefix := range p.prefixes {
+			cursor, err := txn.OpenCursor(index)
+			if err != nil {
+				return err
+			}
+			err = p.walkPrefix(ctx, txn, cursor, rawEvents, prefix, withRaw, seen, fn)
+			cursor.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p lmdbCountPlan) walkPrefix(ctx context.Context, txn *lmdbgo.Txn, cursor *lmdbgo.Cursor, rawEvents lmdbgo.DBI, prefix []byte, withRaw bool, seen map[string]bool, fn func(raw []byte)) error {
+	// the keys of a prefix are ordered by created_at unless the prefix leaves out the kind of the "p" tag index
+	ordered := len(prefix)+4 == p.keySize
+	start := prefix
+	if ordered {
+		start = binary.BigEndian.AppendUint32(prefix[:len(prefix):len(prefix)], p.since)
+	}
+
+	key, serial, err := cursor.Get(start, nil, lmdbgo.SetRange)
+	for ; err == nil && bytes.HasPrefix(key, prefix); key, serial, err = cursor.Get(nil, nil, lmdbgo.Next) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if len(key) != p.keySize {
+			continue
+		}
+		createdAt := binary.BigEndian.Uint32(key[len(key)-4:])
+		if createdAt > p.until && ordered {
+			break
+		}
+		if createdAt < p.since || createdAt > p.until {
+			continue
+		}
+		if seen != nil {
+			if seen[string(serial)] {
+				continue
+			}
+			seen[string(serial)] = true
+		}
+
+		var raw []byte
+		if withRaw {
+			if raw, err = txn.Get(rawEvents, serial); err != nil {
+				return err
+			}
+			if len(p.kinds) > 0 && !slices.Contains(p.kinds, [2]byte(raw[132:134])) {
+				continue
+			}
+		}
+		fn(raw)
+	}
+	if err != nil && !lmdbgo.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/lmdb"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// newTestLMDB opens an empty LMDB database removed with the test.
+func newTestLMDB(tb testing.TB) *lmdb.LMDBBackend {
+	tb.Helper()
+
+	db := &lmdb.LMDBBackend{Path: tb.TempDir()}
+	if err := db.Init(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(db.Close)
+	return db
+}
+
+func TestCountEvents(t *testing.T) {
+	lmdbDB := newTestLMDB(t)
+	badgerDB := newTestDB(t)
+
+	// the followers of target, and a note that doesn't count
+	target := testPubkey()
+	events := []*nostr.Event{{PubKey: target, Kind: nostr.KindTextNote, CreatedAt: 1}}
+	for i := range 40 {
+		events = append(events, &nostr.Event{PubKey: testPubkey(), Kind: nostr.KindFollowList, CreatedAt: nostr.Timestamp(i + 1), Tags: nostr.Tags{{"p", target}}})
+	}
+	for _, event := range events {
+		event.ID = event.GetID()
+		for _, db := range []DBBackend{lmdbDB, badgerDB} {
+			if err := db.SaveEvent(context.Background(), event); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// a COUNT spinning forever fails the test instead of hanging it
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := nostr.Filter{Kinds: []int{nostr.KindFollowList}, Tags: nostr.TagMap{"p": []string{target}}}
+	const offset = 8
+
+	count, err := countEvents(lmdbDB)(ctx, filter)
+	if err != nil || count != 40 {
+		t.Errorf("LMDB count = %d, %v, want 40", count, err)
+	}
+
+	lmdbCount, lmdbHLL, err := countEventsHLL(lmdbDB)(ctx, filter, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badgerCount, badgerHLL, err := countEventsHLL(badgerDB)(ctx, filter, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lmdbCount != 40 || badgerCount != 40 {
+		t.Errorf("HLL counts = %d on LMDB and %d on Badger, want 40", lmdbCount, badgerCount)
+	}
+	if !bytes.Equal(lmdbHLL.GetRegisters(), badgerHLL.GetRegisters()) {
+		t.Error("the HyperLogLog registers of LMDB differ from Badger's")
+	}
+	if estimate := lmdbHLL.Count(); estimate < 30 || estimate > 50 {
+		t.Errorf("HyperLogLog estimate = %d, want about 40", estimate)
+	}
+}
+
+func TestCountEventsFilters(t *testing.T) {
+	lmdbDB := newTestLMDB(t)
+	badgerDB := newTestDB(t)
+
+	// notes and reactions of two authors, the reactions to a note tagging its author
+	alice, bob := testPubkey(), testPubkey()
+	note := &nostr.Event{PubKey: alice, Kind: nostr.KindTextNote, CreatedAt: 1}
+	note.ID = note.GetID()
+	events := []*nostr.Event{note}
+	for i := range 30 {
+		author := alice
+		if i%3 == 0 {
+			author = bob
+		}
+		events = append(events,
+			&nostr.Event{PubKey: author, Kind: nostr.KindTextNote, CreatedAt: nostr.Timestamp(i + 2), Content: strconv.Itoa(i)},
+			&nostr.Event{PubKey: author, Kind: nostr.KindReaction, CreatedAt: nostr.Timestamp(i + 2), Tags: nostr.Tags{{"e", note.ID}, {"p", alice}}},
+		)
+	}
+	for _, event := range events {
+		event.ID = event.GetID()
+		for _, db := range []DBBackend{lmdbDB, badgerDB} {
+			if err := db.SaveEvent(context.Background(), event); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	since, until := nostr.Timestamp(10), nostr.Timestamp(20)
+	tests := []struct {
+		name   string
+		filter nostr.Filter
+	}{
+		{"everything", nostr.Filter{}},
+		{"time range", nostr.Filter{Since: &since, Until: &until}},
+		{"kinds", nostr.Filter{Kinds: []int{nostr.KindReaction}, Since: &since}},
+		{"author", nostr.Filter{Authors: []string{bob}, Until: &until}},
+		{"author and kinds", nostr.Filter{Authors: []string{alice, bob}, Kinds: []int{nostr.KindTextNote}}},
+		{"p tag of any kind", nostr.Filter{Tags: nostr.TagMap{"p": {alice}}, Since: &since}},
+		{"e tag and kind", nostr.Filter{Kinds: []int{nostr.KindReaction}, Tags: nostr.TagMap{"e": {note.ID, bob}}}},
+		{"two tags", nostr.Filter{Tags: nostr.TagMap{"e": {note.ID}, "p": {alice}}}},
+		{"ids", nostr.Filter{IDs: []string{note.ID}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := badgerDB.CountEvents(context.Background(), tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := countEvents(lmdbDB)(context.Background(), tt.filter); err != nil || got != want {
+				t.Errorf("LMDB count = %d, %v, want %d", got, err, want)
+			}
+		})
+	}
+}
+
+func BenchmarkCountEvents(b *testing.B) {
+	db := newTestLMDB(b)
+	target := testPubkey()
+	for i := range 5000 {
+		event := &nostr.Event{PubKey: testPubkey(), Kind: nostr.KindFollowList, CreatedAt: nostr.Timestamp(i + 1), Tags: nostr.Tags{{"p", target}}}
+		event.ID = event.GetID()
+		if err := db.SaveEvent(context.Background(), event); err != nil {
+			b.Fatal(err)
+		}
+	}
+	filter := nostr.Filter{Kinds: []int{nostr.KindFollowList}, Tags: nostr.TagMap{"p": {target}}}
+
+	b.Run("count", func(b *testing.B) {
+		for b.Loop() {
+			if count, err := countEvents(db)(context.Background(), filter); err != nil || count != 5000 {
+				b.Fatalf("count = %d, %v, want 5000", count, err)
+			}
+		}
+	})
+	b.Run("hyperloglog", func(b *testing.B) {
+		for b.Loop() {
+			if count, _, err := countEventsHLL(db)(context.Background(), filter, 8); err != nil || count != 5000 {
+				b.Fatalf("count = %d, %v, want 5000", count, err)
+			}
+		}
+	})
+}
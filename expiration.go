@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip40"
+)
+
+// queryPageSize is the number of events read at once by forEachEvent, below the max limit of both databases.
+const queryPageSize = 1000
+
+func isExpired(event *nostr.Event, now nostr.Timestamp) bool {
+	expiration := nip40.GetExpiration(event.Tags)
+	return expiration != -1 && expiration <= now
+}
+
+// rejectExpired refuses events whose NIP-40 expiration has already passed.
+func rejectExpired(_ context.Context, event *nostr.Event) (bool, string) {
+	if isExpired(event, nostr.Now()) {
+		return true, "invalid: event has expired"
+	}
+	return false, ""
+}
+
+// withoutExpired drops the expired events a query returns, they stay in the database until the next sweep or
+// until the NIP-40 expiration manager of khatru deletes them. The internal queries of that manager see them.
+func withoutExpired(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		events, err := query(ctx, filter)
+		if err != nil || events == nil || khatru.IsInternalCall(ctx) {
+			return events, err
+		}
+
+		now := nostr.Now()
+		filtered := make(chan *nostr.Event)
+		go func() {
+			defer close(filtered)
+			for event := range events {
+				if isExpired(event, now) {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case filtered <- event:
+				}
+			}
+		}()
+		return filtered, nil
+	}
+}
+
+// startExpirationSweeper deletes the expired events of every database every EXPIRATION_SWEEP_INTERVAL. The
+// expiration manager of khatru only knows the events published through the relay and the newest ones at startup,
+// imported, restored, replicated and pulled events are left to the sweeper.
+func startExpirationSweeper(ctx context.Context) {
+	if config.ExpirationSweepInterval <= 0 {
+		slog.Info("🚫 expiration sweeper disabled")
+		return
+	}
+
+	ticker := time.NewTicker(config.ExpirationSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, t := range tenants {
+			t.sweepExpired(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *Tenant) sweepExpired(ctx context.Context) {
+	for _, r := range t.relays {
+		sweepExpired(ctx, t.Host, r.spec.Name, r.store())
+	}
+	if t.blossomDB != nil {
+		sweepExpired(ctx, t.Host, "blossom", t.blossomDB)
+	}
+}
+
+// sweepExpired deletes the expired events of db a page at a time, through the store of its relay so they leave
+// the search index too.
+func sweepExpired(ctx context.Context, tenant string, relay string, db DBBackend) {
+	now := nostr.Now()
+	var expired []*nostr.Event
+	err := forEachEvent(ctx, db, nostr.Filter{}, func(event *nostr.Event) {
+		if isExpired(event, now) {
+			expired = append(expired, event)
+		}
+	})
+	if err != nil {
+		slog.Error("🚫 error sweeping expired events", "tenant", tenant, "relay", relay, "error", err)
+		return
+	}
+
+	deleted := 0
+	for _, event := range expired {
+		if err := db.DeleteEvent(ctx, event); err != nil {
+			slog.Error("🚫 error deleting expired event", "tenant", tenant, "relay", relay, "id", event.ID, "error", err)
+			continue
+		}
+		deleted++
+	}
+
+	expiredEventsDeleted.WithLabelValues(tenant, relay).Add(float64(deleted))
+	slog.Info("🧹 swept expired events", "tenant", tenant, "relay", relay, "deleted", deleted)
+}
+
+// forEachEvent calls fn for every event of db matching filter, from the newest, a page at a time.
+func forEachEvent(ctx context.Context, db DBBackend, filter nostr.Filter, fn func(event *nostr.Event)) error {
+	until := filter.Until
+	// events at the until timestamp are returned again by the next page
+	seen := make(map[string]bool)
+
+	for {
+		filter.Limit = queryPageSize
+		filter.Until = until
+		events, err := db.QueryEvents(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		received, fresh := 0, 0
+		var oldest nostr.Timestamp
+		var oldestIDs []string
+		for event := range events {
+			received++
+			if seen[event.ID] {
+				continue
+			}
+			fresh++
+			fn(event)
+
+			if fresh == 1 || event.CreatedAt < oldest {
+				oldest = event.CreatedAt
+				oldestIDs = oldestIDs[:0]
+			}
+			if event.CreatedAt == oldest {
+				oldestIDs = append(oldestIDs, event.ID)
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if fresh == 0 {
+			if received < queryPageSize || until == nil || *until == 0 {
+				return nil
+			}
+			// more than a page of events share this second, the rest of them can't be reached
+			next := *until - 1
+			until = &next
+			clear(seen)
+			continue
+		}
+
+		if until == nil || oldest != *until {
+			clear(seen)
+		}
+		for _, id := range oldestIDs {
+			seen[id] = true
+		}
+		until = &oldest
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+var chatGroupRoles = []*nip29.Role{
+	{Name: "admin", Description: "can edit the group, manage members and invites, and delete events or the group itself"},
+	{Name: "moderator", Description: "can manage members and invites and delete events"},
+}
+
+var chatGroupRolePermissions = map[string][]int{
+	"admin": {
+		nostr.KindSimpleGroupPutUser,
+		nostr.KindSimpleGroupRemoveUser,
+		nostr.KindSimpleGroupEditMetadata,
+		nostr.KindSimpleGroupDeleteEvent,
+		nostr.KindSimpleGroupDeleteGroup,
+		nostr.KindSimpleGroupCreateInvite,
+	},
+	"moderator": {
+		nostr.KindSimpleGroupPutUser,
+		nostr.KindSimpleGroupRemoveUser,
+		nostr.KindSimpleGroupDeleteEvent,
+		nostr.KindSimpleGroupCreateInvite,
+	},
+}
+
+// ChatGroups holds the NIP-29 state of the groups hosted on the chat relay of a tenant. Tenant.chatGroups
+// is nil when group hosting is disabled because no CHAT_RELAY_NSEC is configured.
+type ChatGroups struct {
+	tenant *Tenant
+
+	mu      sync.RWMutex
+	groups  map[string]*nip29.Group
+	invites map[string]map[string]bool
+
+	secretKey string
+	pubkey    string
+	relayURL  string
+}
+
+func (t *Tenant) initChatGroups(ctx context.Context) {
+	if t.config().ChatRelayNsec == "" {
+		log.Println("ℹ️ CHAT_RELAY_NSEC not set, NIP-29 group hosting is disabled")
+		return
+	}
+
+	prefix, value, err := nip19.Decode(t.config().ChatRelayNsec)
+	if err != nil || prefix != "nsec" {
+		log.Fatal("🚫 CHAT_RELAY_NSEC must be a valid nsec")
+	}
+	secretKey := value.(string)
+
+	pubkey, err := nostr.GetPublicKey(secretKey)
+	if err != nil {
+		log.Fatal("🚫 error deriving chat relay pubkey:", err)
+	}
+	if pubkey != t.chat.relay.Info.PubKey {
+		log.Fatal("🚫 CHAT_RELAY_NSEC does not match CHAT_RELAY_NPUB")
+	}
+
+	cg := &ChatGroups{
+		tenant:    t,
+		groups:    make(map[string]*nip29.Group),
+		invites:   make(map[string]map[string]bool),
+		secretKey: secretKey,
+		pubkey:    pubkey,
+		relayURL:  t.chat.wsURL(t.config().RelayURL),
+	}
+	if err := cg.load(ctx); err != nil {
+		log.Fatal("🚫 error loading chat groups:", err)
+	}
+
+	t.chatGroups = cg
+}
+
+// load rebuilds the group state from the relay-signed addressable events and the invites stored in the chat database.
+func (cg *ChatGroups) load(ctx context.Context) error {
+	for _, kind := range []int{nostr.KindSimpleGroupMetadata, nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers} {
+		err := forEachEvent(ctx, cg.tenant.chat.db, nostr.Filter{Kinds: []int{kind}, Authors: []string{cg.pubkey}}, func(evt *nostr.Event) {
+			id := evt.Tags.GetD()
+			if kind == nostr.KindSimpleGroupMetadata {
+				group, err := nip29.NewGroupFromMetadataEvent(cg.relayURL, evt)
+				if err != nil {
+					slog.Error("🚫 invalid group metadata", "id", evt.ID, "error", err)
+					return
+				}
+				group.Roles = chatGroupRoles
+				cg.groups[id] = &group
+				return
+			}
+
+			group, ok := cg.groups[id]
+			if !ok {
+				return
+			}
+			var err error
+			if kind == nostr.KindSimpleGroupAdmins {
+				err = group.MergeInAdminsEvent(evt)
+			} else {
+				err = group.MergeInMembersEvent(evt)
+			}
+			if err != nil {
+				slog.Error("🚫 invalid group state", "id", evt.ID, "error", err)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := forEachEvent(ctx, cg.tenant.chat.db, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupCreateInvite}}, cg.addInvite)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("👥 loaded chat groups", "count", len(cg.groups))
+	return nil
+}
+
+func groupID(event *nostr.Event) string {
+	if tag := event.Tags.Find("h"); tag != nil {
+		return tag[1]
+	}
+	return ""
+}
+
+func (cg *ChatGroups) exists(id string) bool {
+	cg.mu.RLock()
+	defer cg.mu.RUnlock()
+
+	_, ok := cg.groups[id]
+	return ok
+}
+
+func (cg *ChatGroups) isMember(id string, pubkey string) bool {
+	cg.mu.RLock()
+	defer cg.mu.RUnlock()
+
+	return cg.isMemberLocked(id, pubkey)
+}
+
+func (cg *ChatGroups) isMemberLocked(id string, pubkey string) bool {
+	if pubkey == cg.tenant.config().OwnerNpubKey {
+		return true
+	}
+	group, ok := cg.groups[id]
+	if !ok {
+		return false
+	}
+	_, member := group.Members[pubkey]
+	return member
+}
+
+func (cg *ChatGroups) isMemberOfAny(pubkey string) bool {
+	cg.mu.RLock()
+	defer cg.mu.RUnlock()
+
+	for _, group := range cg.groups {
+		if _, member := group.Members[pubkey]; member {
+			return true
+		}
+	}
+	return false
+}
+
+func (cg *ChatGroups) isClosed(id string) bool {
+	cg.mu.RLock()
+	defer cg.mu.RUnlock()
+
+	group, ok := cg.groups[id]
+	return ok && group.Closed
+}
+
+// canRead reports whether pubkey may read the events of a group. Private and closed groups can only be
+// read by their members, events for groups that aren't hosted here are governed by the chat relay rules.
+func (cg *ChatGroups) canRead(id string, pubkey string) bool {
+	cg.mu.RLock()
+	defer cg.mu.RUnlock()
+
+	group, ok := cg.groups[id]
+	if !ok || (!group.Private && !group.Closed) {
+		return true
+	}
+	return cg.isMemberLocked(id, pubkey)
+}
+
+func (cg *ChatGroups) hasPermission(id string, pubkey string, kind int) bool {
+	if pubkey == cg.tenant.config().OwnerNpubKey {
+		return true
+	}
+
+	cg.mu.RLock()
+	defer cg.mu.RUnlock()
+
+	group, ok := cg.groups[id]
+	if !ok {
+		return false
+	}
+	for _, role := range group.Members[pubkey] {
+		if slices.Contains(chatGroupRolePermissions[role.Name], kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// roleRank is the position of a role in chatGroupRoles, lower ranks have more permissions.
+func roleRank(name string) int {
+	if idx := slices.IndexFunc(chatGroupRoles, func(r *nip29.Role) bool { return r.Name == name }); idx != -1 {
+		return idx
+	}
+	return len(chatGroupRoles)
+}
+
+// bestRank is the rank of the best role of pubkey in a group, the owner ranks above every role. The read lock must
+// be held.
+func (cg *ChatGroups) bestRank(group *nip29.Group, pubkey string) int {
+	if pubkey == cg.tenant.config().OwnerNpubKey {
+		return -1
+	}
+	rank := len(chatGroupRoles)
+	if group != nil {
+		for _, role := range group.Members[pubkey] {
+			rank = min(rank, roleRank(role.Name))
+		}
+	}
+	return rank
+}
+
+// outranksAuthor reports whether a put-user or remove-user event changes a member whose best role is above the best
+// role of its author, or gives someone a role above it.
+func (cg *ChatGroups) outranksAuthor(id string, event *nostr.Event) bool {
+	if event.PubKey == cg.tenant.config().OwnerNpubKey {
+		return false
+	}
+
+	cg.mu.RLock()
+	defer cg.mu.RUnlock()
+
+	group := cg.groups[id]
+	own := cg.bestRank(group, event.PubKey)
+	for tag := range event.Tags.FindAll("p") {
+		if cg.bestRank(group, tag[1]) < own {
+			return true
+		}
+		if event.Kind != nostr.KindSimpleGroupPutUser {
+			continue
+		}
+		for _, name := range tag[2:] {
+			if roleRank(name) < own {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (cg *ChatGroups) isInvite(id string, code string) bool {
+	cg.mu.RLock()
+	defer cg.mu.RUnlock()
+
+	return cg.invites[id][code]
+}
+
+func (cg *ChatGroups) addInvite(event *nostr.Event) {
+	id := groupID(event)
+	code := event.Tags.Find("code")
+	if id == "" || code == nil {
+		return
+	}
+	if cg.invites[id] == nil {
+		cg.invites[id] = make(map[string]bool)
+	}
+	cg.invites[id][code[1]] = true
+}
+
+// rejectEvent validates NIP-29 events against the group state and the roles of their author.
+func (cg *ChatGroups) rejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	id := groupID(event)
+	if id == "" {
+		return true, "invalid: group events must have an h tag with the group id"
+	}
+
+	if event.Kind == nostr.KindSimpleGroupCreateGroup {
+		if event.PubKey != cg.tenant.config().OwnerNpubKey {
+			return true, "restricted: only the relay owner can create groups"
+		}
+		if cg.exists(id) {
+			return true, fmt.Sprintf("duplicate: group %s already exists", id)
+		}
+		return false, ""
+	}
+
+	if !cg.exists(id) {
+		return true, fmt.Sprintf("blocked: group %s is not hosted on this relay", id)
+	}
+
+	if nip29.ModerationEventKinds.Includes(event.Kind) {
+		if !cg.hasPermission(id, event.PubKey, event.Kind) {
+			return true, "restricted: your role in this group doesn't allow this action"
+		}
+		if (event.Kind == nostr.KindSimpleGroupPutUser || event.Kind == nostr.KindSimpleGroupRemoveUser) && cg.outranksAuthor(id, event) {
+			return true, "restricted: you can't change a member or grant a role above your own"
+		}
+		return false, ""
+	}
+
+	switch event.Kind {
+	case nostr.KindSimpleGroupJoinRequest:
+		if cg.isMember(id, event.PubKey) {
+			return true, "duplicate: you are already a member of this group"
+		}
+		if code := event.Tags.Find("code"); code != nil {
+			if !cg.isInvite(id, code[1]) {
+				return true, "restricted: unknown invite code"
+			}
+		} else if !cg.tenant.wot.Has(ctx, event.PubKey) && !cg.tenant.chat.management.isPubkeyAllowed(event.PubKey) {
+			return true, cg.tenant.notInWoT("restricted: you must be in the web of trust or have an invite code to join this group")
+		}
+	case nostr.KindSimpleGroupLeaveRequest:
+		if !cg.isMember(id, event.PubKey) {
+			return true, "blocked: you are not a member of this group"
+		}
+	default:
+		if cg.isClosed(id) && !cg.isMember(id, event.PubKey) {
+			return true, "restricted: only members can post to this group"
+		}
+	}
+
+	return false, ""
+}
+
+// applyEvent updates the group state after a NIP-29 event has been stored and republishes the
+// relay-signed metadata, admins, members and roles events of the affected group.
+func (cg *ChatGroups) applyEvent(ctx context.Context, event *nostr.Event) {
+	id := groupID(event)
+	if id == "" {
+		return
+	}
+
+	var deleteIDs []string
+	deleteGroup := false
+	changed := true
+
+	cg.mu.Lock()
+	group := cg.groups[id]
+	if group == nil && event.Kind != nostr.KindSimpleGroupCreateGroup {
+		cg.mu.Unlock()
+		return
+	}
+
+	switch event.Kind {
+	case nostr.KindSimpleGroupCreateGroup:
+		group = &nip29.Group{
+			Address: nip29.GroupAddress{Relay: cg.relayURL, ID: id},
+			Name:    id,
+			Members: map[string][]*nip29.Role{event.PubKey: {chatGroupRoles[0]}},
+			Roles:   chatGroupRoles,
+		}
+		cg.groups[id] = group
+		slog.Info("👥 group created", "id", id)
+
+	case nostr.KindSimpleGroupPutUser:
+		for tag := range event.Tags.FindAll("p") {
+			var roles []*nip29.Role
+			for _, name := range tag[2:] {
+				if idx := slices.IndexFunc(chatGroupRoles, func(r *nip29.Role) bool { return r.Name == name }); idx != -1 {
+					roles = append(roles, chatGroupRoles[idx])
+				}
+			}
+			group.Members[tag[1]] = roles
+		}
+
+	case nostr.KindSimpleGroupRemoveUser:
+		for tag := range event.Tags.FindAll("p") {
+			delete(group.Members, tag[1])
+		}
+
+	case nostr.KindSimpleGroupEditMetadata:
+		if tag := event.Tags.Find("name"); tag != nil {
+			group.Name = tag[1]
+		}
+		if tag := event.Tags.Find("about"); tag != nil {
+			group.About = tag[1]
+		}
+		if tag := event.Tags.Find("picture"); tag != nil {
+			group.Picture = tag[1]
+		}
+		for _, tag := range event.Tags {
+			if len(tag) == 0 {
+				continue
+			}
+			switch tag[0] {
+			case "public":
+				group.Private = false
+			case "private":
+				group.Private = true
+			case "open":
+				group.Closed = false
+			case "closed":
+				group.Closed = true
+			}
+		}
+
+	case nostr.KindSimpleGroupDeleteEvent:
+		for tag := range event.Tags.FindAll("e") {
+			deleteIDs = append(deleteIDs, tag[1])
+		}
+		changed = false
+
+	case nostr.KindSimpleGroupDeleteGroup:
+		delete(cg.groups, id)
+		delete(cg.invites, id)
+		deleteGroup = true
+		changed = false
+		slog.Info("👥 group deleted", "id", id)
+
+	case nostr.KindSimpleGroupCreateInvite:
+		cg.addInvite(event)
+		changed = false
+
+	case nostr.KindSimpleGroupJoinRequest:
+		code := event.Tags.Find("code")
+		if !group.Closed || (code != nil && cg.invites[id][code[1]]) {
+			group.Members[event.PubKey] = nil
+		} else {
+			// closed groups keep the request around for the admins to act on
+			changed = false
+		}
+
+	case nostr.KindSimpleGroupLeaveRequest:
+		delete(group.Members, event.PubKey)
+
+	default:
+		changed = false
+	}
+
+	var stateEvents []*nostr.Event
+	if changed {
+		stateEvents = cg.stateEvents(group)
+	}
+	cg.mu.Unlock()
+
+	for _, evt := range stateEvents {
+		if err := cg.tenant.chat.db.ReplaceEvent(ctx, evt); err != nil {
+			slog.Error("🚫 error storing group state", "id", id, "kind", evt.Kind, "error", err)
+			continue
+		}
+		cg.tenant.chat.relay.BroadcastEvent(evt)
+	}
+
+	if len(deleteIDs) > 0 {
+		cg.deleteEvents(ctx, nostr.Filter{IDs: deleteIDs, Tags: nostr.TagMap{"h": []string{id}}})
+	}
+
+	if deleteGroup {
+		cg.deleteEvents(ctx, nostr.Filter{Tags: nostr.TagMap{"h": []string{id}}})
+		cg.deleteEvents(ctx, nostr.Filter{
+			Kinds:   nip29.MetadataEventKinds,
+			Authors: []string{cg.pubkey},
+			Tags:    nostr.TagMap{"d": []string{id}},
+		})
+	}
+}
+
+// stateEvents builds and signs the addressable events describing group. It must be called with the
+// lock held, it bumps the group timestamps so consecutive updates always replace each other.
+func (cg *ChatGroups) stateEvents(group *nip29.Group) []*nostr.Event {
+	ts := nostr.Now()
+	if ts <= group.LastMetadataUpdate {
+		ts = group.LastMetadataUpdate + 1
+	}
+	group.LastMetadataUpdate = ts
+	group.LastAdminsUpdate = ts
+	group.LastMembersUpdate = ts
+	group.LastRolesUpdate = ts
+
+	events := []*nostr.Event{
+		group.ToMetadataEvent(),
+		group.ToAdminsEvent(),
+		group.ToMembersEvent(),
+		group.ToRolesEvent(),
+	}
+	for _, evt := range events {
+		evt.CreatedAt = ts
+		if err := evt.Sign(cg.secretKey); err != nil {
+			slog.Error("🚫 error signing group state", "group", group.Address.ID, "error", err)
+		}
+	}
+	return events
+}
+
+func (cg *ChatGroups) deleteEvents(ctx context.Context, filter nostr.Filter) {
+	// collect first, deleting while iterating a query isn't safe on every backend
+	var toDelete []*nostr.Event
+	err := forEachEvent(ctx, cg.tenant.chat.db, filter, func(evt *nostr.Event) {
+		toDelete = append(toDelete, evt)
+	})
+	if err != nil {
+		slog.Error("🚫 error querying group events", "error", err)
+		return
+	}
+
+	for _, evt := range toDelete {
+		if err := cg.tenant.chat.db.DeleteEvent(ctx, evt); err != nil {
+			slog.Error("🚫 error deleting group event", "id", evt.ID, "error", err)
+		}
+	}
+	slog.Debug("🗑️ deleted group events", "count", len(toDelete))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+func TestChatGroupsRejectEvent(t *testing.T) {
+	owner, friend, admin, moderator, stranger := testPubkey(), testPubkey(), testPubkey(), testPubkey(), testPubkey()
+	tenant := newTestTenant(t, owner, testWoT{friend: true})
+	cg := &ChatGroups{
+		tenant: tenant,
+		groups: map[string]*nip29.Group{
+			"g": {Members: map[string][]*nip29.Role{admin: {chatGroupRoles[0]}, moderator: {chatGroupRoles[1]}, owner: nil}},
+		},
+		invites: map[string]map[string]bool{"g": {"secret": true}},
+	}
+
+	join := func(pubkey string, code string) *nostr.Event {
+		event := &nostr.Event{PubKey: pubkey, Kind: nostr.KindSimpleGroupJoinRequest, Tags: nostr.Tags{{"h", "g"}}}
+		if code != "" {
+			event.Tags = append(event.Tags, nostr.Tag{"code", code})
+		}
+		return event
+	}
+	putUser := func(pubkey string, roles ...string) *nostr.Event {
+		return &nostr.Event{PubKey: pubkey, Kind: nostr.KindSimpleGroupPutUser, Tags: nostr.Tags{{"h", "g"}, append(nostr.Tag{"p", stranger}, roles...)}}
+	}
+
+	changeUser := func(kind int, author string, member string, roles ...string) *nostr.Event {
+		return &nostr.Event{PubKey: author, Kind: kind, Tags: nostr.Tags{{"h", "g"}, append(nostr.Tag{"p", member}, roles...)}}
+	}
+
+	tests := []struct {
+		name   string
+		event  *nostr.Event
+		reject bool
+	}{
+		{"wot member joins", join(friend, ""), false},
+		{"stranger joins", join(stranger, ""), true},
+		{"stranger joins with an invite", join(stranger, "secret"), false},
+		{"stranger joins with an unknown code", join(stranger, "guess"), true},
+		{"wot member joins with an unknown code", join(friend, "guess"), true},
+		{"moderator adds a member", putUser(moderator), false},
+		{"moderator grants moderator", putUser(moderator, "moderator"), false},
+		{"moderator grants admin", putUser(moderator, "admin"), true},
+		{"moderator makes themself admin", &nostr.Event{PubKey: moderator, Kind: nostr.KindSimpleGroupPutUser, Tags: nostr.Tags{{"h", "g"}, {"p", moderator, "admin"}}}, true},
+		{"owner grants admin", putUser(owner, "admin"), false},
+		{"member without a role adds a member", putUser(friend), true},
+		{"moderator removes a member", changeUser(nostr.KindSimpleGroupRemoveUser, moderator, stranger), false},
+		{"moderator removes another moderator", changeUser(nostr.KindSimpleGroupRemoveUser, moderator, moderator), false},
+		{"moderator removes an admin", changeUser(nostr.KindSimpleGroupRemoveUser, moderator, admin), true},
+		{"moderator removes the owner", changeUser(nostr.KindSimpleGroupRemoveUser, moderator, owner), true},
+		{"admin removes the owner", changeUser(nostr.KindSimpleGroupRemoveUser, admin, owner), true},
+		{"moderator demotes an admin", changeUser(nostr.KindSimpleGroupPutUser, moderator, admin, "moderator"), true},
+		{"admin removes a moderator", changeUser(nostr.KindSimpleGroupRemoveUser, admin, moderator), false},
+		{"owner removes an admin", changeUser(nostr.KindSimpleGroupRemoveUser, owner, admin), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reject, msg := cg.rejectEvent(context.Background(), tt.event); reject != tt.reject {
+				t.Errorf("rejectEvent() = %v %q, want %v", reject, msg, tt.reject)
+			}
+		})
+	}
+}
+
+func TestChatGroupsLoad(t *testing.T) {
+	ctx := context.Background()
+	tenant := newTestTenant(t, testPubkey(), nil)
+	tenant.chat.db = newTestDB(t)
+	moderator := testPubkey()
+
+	// more invites than a query returns at once
+	now := nostr.Now()
+	for i := range queryPageSize + 5 {
+		invite := &nostr.Event{PubKey: moderator, Kind: nostr.KindSimpleGroupCreateInvite, CreatedAt: now - nostr.Timestamp(i), Tags: nostr.Tags{{"h", "g"}, {"code", strconv.Itoa(i)}}}
+		invite.ID = invite.GetID()
+		if err := tenant.chat.db.SaveEvent(ctx, invite); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cg := &ChatGroups{tenant: tenant, groups: make(map[string]*nip29.Group), invites: make(map[string]map[string]bool)}
+	if err := cg.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !cg.isInvite("g", "0") || !cg.isInvite("g", strconv.Itoa(queryPageSize+4)) {
+		t.Error("the invites weren't all loaded")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+// publicHealthTTL is how long the relay port reuses a health check, anyone can ask for it.
+const publicHealthTTL = time.Second
+
+// shuttingDown makes /readyz fail as soon as a shutdown starts, so load balancers stop sending new clients.
+var shuttingDown atomic.Bool
+
+type healthReport struct {
+	Status  string         `json:"status"`
+	Tenants []tenantHealth `json:"tenants,omitempty"`
+}
+
+type tenantHealth struct {
+	Host                   string            `json:"host,omitempty"`
+	Databases              map[string]string `json:"databases"`
+	WotReady               bool              `json:"wot_ready"`
+	SeedRelaysReachable    int               `json:"seed_relays_reachable"`
+	SeedRelays             int               `json:"seed_relays"`
+	InboxSubscriptionAlive bool              `json:"inbox_subscription_alive"`
+	LastBackup             *time.Time        `json:"last_backup"`
+	ReplicationLag         map[string]int64  `json:"replication_lag_seconds,omitempty"`
+}
+
+// checkHealth reports the state of every subsystem. healthy is false when a database doesn't answer, ready
+// is also false while a WoT is building or HAVEN is shutting down.
+func checkHealth(ctx context.Context) (report healthReport, healthy bool, ready bool) {
+	healthy = true
+	ready = !shuttingDown.Load()
+
+	for _, t := range tenants {
+		cfg := t.config()
+		th := tenantHealth{
+			Host:                   t.Host,
+			Databases:              make(map[string]string),
+			WotReady:               t.wotReady.Load(),
+			SeedRelays:             len(cfg.ImportSeedRelays),
+			InboxSubscriptionAlive: t.inboxSubscriptionAlive.Load(),
+		}
+
+		for _, entry := range t.getDBs() {
+			name := entry.name[:len(entry.name)-len(".jsonl")]
+			if err := pingDB(ctx, entry.db); err != nil {
+				th.Databases[name] = "error: " + err.Error()
+				healthy = false
+			} else {
+				th.Databases[name] = "ok"
+			}
+			if replica.Load() {
+				if th.ReplicationLag == nil {
+					th.ReplicationLag = make(map[string]int64)
+				}
+				th.ReplicationLag[name] = int64(t.replicationLag(name).Seconds())
+			}
+		}
+
+		for _, url := range cfg.ImportSeedRelays {
+			if relay, ok := pool.Relays.Load(nostr.NormalizeURL(url)); ok && relay.IsConnected() {
+				th.SeedRelaysReachable++
+			}
+		}
+
+		if last := t.lastBackup.Load(); last != 0 {
+			lastBackup := time.Unix(last, 0).UTC()
+			th.LastBackup = &lastBackup
+		}
+
+		if !th.WotReady {
+			ready = false
+		}
+		report.Tenants = append(report.Tenants, th)
+	}
+
+	ready = ready && healthy
+	return report, healthy, ready
+}
+
+// pingDB runs a trivial query to make sure a database is open and answering.
+func pingDB(ctx context.Context, db DBBackend) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	events, err := db.QueryEvents(ctx, nostr.Filter{Limit: 1})
+	if err != nil {
+		return err
+	}
+	for range events {
+	}
+	return ctx.Err()
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	report, healthy, _ := checkHealth(r.Context())
+	writeHealth(w, report, healthy)
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	report, _, ready := checkHealth(r.Context())
+	writeHealth(w, report, ready)
+}
+
+// publicHealth is the last health check of the relay port.
+var publicHealth struct {
+	sync.Mutex
+	checked time.Time
+	healthy bool
+	ready   bool
+}
+
+// publicHealthHandler serves /healthz, or /readyz when ready is set, on the relay port with the status alone: the
+// report names every tenant, it stays on ADMIN_ADDRESS.
+func publicHealthHandler(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		publicHealth.Lock()
+		if time.Since(publicHealth.checked) > publicHealthTTL {
+			_, publicHealth.healthy, publicHealth.ready = checkHealth(r.Context())
+			publicHealth.checked = time.Now()
+		}
+		ok := publicHealth.healthy
+		if ready {
+			ok = publicHealth.ready && !shuttingDown.Load()
+		}
+		publicHealth.Unlock()
+
+		writeHealth(w, healthReport{}, ok)
+	}
+}
+
+func writeHealth(w http.ResponseWriter, report healthReport, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	report.Status = "ok"
+	if !ok {
+		report.Status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
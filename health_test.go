@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublicHealthHandler(t *testing.T) {
+	saved := tenants
+	defer func() { tenants = saved }()
+	tenants = []*Tenant{{Host: "a.example.com"}}
+	tenants[0].cfg.Store(&Config{})
+	publicHealth.checked = time.Time{}
+
+	tests := []struct {
+		name  string
+		ready bool
+		want  int
+	}{
+		{"healthz", false, http.StatusOK},
+		{"readyz while the WoT builds", true, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			publicHealthHandler(tt.ready)(w, httptest.NewRequest("GET", "/", nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if strings.Contains(w.Body.String(), "a.example.com") {
+				t.Errorf("the relay port reports the tenants: %s", w.Body)
+			}
+		})
+	}
+}
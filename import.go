@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -11,16 +12,14 @@ import (
 
 	"github.com/fiatjaf/eventstore"
 	"github.com/nbd-wtf/go-nostr"
-
-	"github.com/bitvora/haven/wot"
 )
 
 const layout = "2006-01-02"
 
-func ensureImportRelays() {
+func (t *Tenant) ensureImportRelays() {
 	nErrors := 0
 	log.Println("🧪 Testing import relays")
-	for _, relay := range config.ImportSeedRelays {
+	for _, relay := range t.config().ImportSeedRelays {
 		if _, err := pool.EnsureRelay(relay); err != nil {
 			nErrors++
 			slog.Error("🚫 Error connecting to relay", "relay", relay, "error", err)
@@ -30,7 +29,7 @@ func ensureImportRelays() {
 	}
 	if nErrors == 0 {
 		slog.Info("✅ All relays connected successfully")
-	} else if nErrors == len(config.ImportSeedRelays) {
+	} else if nErrors == len(t.config().ImportSeedRelays) {
 		slog.Error("🚫 Unable to connect to any import relays, check your connectivity and relays_import.json file")
 		os.Exit(1)
 	} else {
@@ -45,23 +44,29 @@ func runImport(ctx context.Context) {
 		_, _ = fmt.Fprintf(os.Stderr, "Usage of import:\n")
 		importCmd.PrintDefaults()
 	}
+	tenant := importCmd.String("tenant", "", "Tenant host (defaults to the first tenant)")
 	err := importCmd.Parse(os.Args[2:])
 	if err != nil {
 		log.Fatal("🚫 failed to parse import command:", err)
 		return
 	}
 
+	t := tenantByName(*tenant)
 	log.Println("📦 importing notes")
-	importOwnerNotes(ctx)
-	importTaggedNotes(ctx)
+	t.importOwnerNotes(ctx)
+	t.importTaggedNotes(ctx)
 }
 
-func importOwnerNotes(ctx context.Context) {
+func (t *Tenant) importOwnerNotes(ctx context.Context) {
 	ownerImportedNotes := 0
 	nFailedImportNotes := 0
-	wdb := eventstore.RelayWrapper{Store: outboxDB}
+	if t.outbox == nil {
+		log.Println("ℹ️ no relay has the outbox role, skipping the owner notes import")
+		return
+	}
+	wdb := eventstore.RelayWrapper{Store: t.outbox.store()}
 
-	startTime, err := time.Parse(layout, config.ImportStartDate)
+	startTime, err := time.Parse(layout, t.config().ImportStartDate)
 	if err != nil {
 		fmt.Println("Error parsing start date:", err)
 		return
@@ -73,25 +78,30 @@ func importOwnerNotes(ctx context.Context) {
 		endTimestamp := nostr.Timestamp(endTime.Unix())
 
 		filter := nostr.Filter{
-			Authors: []string{config.OwnerNpubKey},
+			Authors: []string{t.config().OwnerNpubKey},
 			Since:   &startTimestamp,
 			Until:   &endTimestamp,
 		}
 
 		done := make(chan int, 1)
-		timeout := time.Duration(config.ImportOwnerNotesFetchTimeoutSeconds) * time.Second
+		timeout := time.Duration(t.config().ImportOwnerNotesFetchTimeoutSeconds) * time.Second
 		ctx, cancel := context.WithTimeout(ctx, timeout)
 
 		go func() {
 			defer cancel()
 			batchImportedNotes := 0
 
-			events := pool.FetchMany(ctx, config.ImportSeedRelays, filter)
+			events := pool.FetchMany(ctx, t.config().ImportSeedRelays, filter)
 			for ev := range events {
 				if ctx.Err() != nil {
 					break // Stop the loop on timeout
 				}
-				if err := wdb.Publish(ctx, *ev.Event); err != nil {
+				if rejected, _ := t.rejectPulled(ctx, t.outbox, ev.Event); rejected {
+					continue
+				}
+				if err := wdb.Publish(ctx, *ev.Event); errors.Is(err, errEventDeleted) {
+					continue
+				} else if err != nil {
 					log.Println("🚫  error importing note", ev.ID, ":", err)
 					nFailedImportNotes++
 				}
@@ -128,43 +138,51 @@ func importOwnerNotes(ctx context.Context) {
 	}
 }
 
-func importTaggedNotes(ctx context.Context) {
+func (t *Tenant) importTaggedNotes(ctx context.Context) {
 	taggedImportedNotes := 0
+	if t.inbox == nil {
+		log.Println("ℹ️ no relay has the inbox role, skipping the tagged notes import")
+		return
+	}
 	done := make(chan struct{}, 1)
-	timeout := time.Duration(config.ImportTaggedNotesFetchTimeoutSeconds) * time.Second
+	timeout := time.Duration(t.config().ImportTaggedNotesFetchTimeoutSeconds) * time.Second
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	wdbInbox := eventstore.RelayWrapper{Store: inboxDB}
-	wdbChat := eventstore.RelayWrapper{Store: chatDB}
 	filter := nostr.Filter{
 		Tags: nostr.TagMap{
-			"p": {config.OwnerNpubKey},
+			"p": {t.config().OwnerNpubKey},
 		},
 	}
 
 	log.Println("📦 importing inbox notes, please wait up to", timeout)
 
 	go func() {
-		events := pool.FetchMany(ctx, config.ImportSeedRelays, filter)
+		events := pool.FetchMany(ctx, t.config().ImportSeedRelays, filter)
 		for ev := range events {
 			if ctx.Err() != nil {
 				break // Stop the loop on timeout
 			}
 
-			if !wot.GetInstance().Has(ctx, ev.Event.PubKey) && ev.Kind != nostr.KindGiftWrap {
+			if !t.wot.Has(ctx, ev.Event.PubKey) && ev.Kind != nostr.KindGiftWrap {
 				continue
 			}
 			for tag := range ev.Tags.FindAll("p") {
 				if len(tag) < 2 {
 					continue
 				}
-				if tag[1] == config.OwnerNpubKey {
-					dbToWrite := wdbInbox
-					if ev.Kind == nostr.KindGiftWrap {
-						dbToWrite = wdbChat
+				if tag[1] == t.config().OwnerNpubKey {
+					r, ok := t.taggedNoteRelay(ev.Kind)
+					if !ok {
+						break
 					}
-					if err := dbToWrite.Publish(ctx, *ev.Event); err != nil {
+					if rejected, _ := t.rejectPulled(ctx, r, ev.Event); rejected {
+						break
+					}
+					dbToWrite := eventstore.RelayWrapper{Store: r.store()}
+					if err := dbToWrite.Publish(ctx, *ev.Event); errors.Is(err, errEventDeleted) {
+						break
+					} else if err != nil {
 						log.Println("🚫 error importing tagged note", ev.ID, ":", err)
 					}
 					taggedImportedNotes++
@@ -184,32 +202,57 @@ func importTaggedNotes(ctx context.Context) {
 	log.Println("✅ tagged import complete")
 }
 
-func subscribeInboxAndChat(ctx context.Context) {
-	wdbInbox := eventstore.RelayWrapper{Store: inboxDB}
-	wdbChat := eventstore.RelayWrapper{Store: chatDB}
+func (t *Tenant) subscribeInboxAndChat(ctx context.Context) {
+	if t.inbox == nil {
+		log.Println("ℹ️ no relay has the inbox role, not subscribing to the inbox")
+		return
+	}
+	t.inboxSubscriptionAlive.Store(true)
+	defer t.inboxSubscriptionAlive.Store(false)
+
+	// a reload that changes the seed relays cancels the subscription to start a new one with them
+	for {
+		subCtx, cancel := context.WithCancel(ctx)
+		t.resubscribeInbox.Store(&cancel)
+		t.subscribeInbox(subCtx)
+		ended := subCtx.Err() == nil
+		cancel()
+		if ended || ctx.Err() != nil {
+			return
+		}
+		log.Println("🔄 seed relays changed, resubscribing to inbox")
+	}
+}
+
+func (t *Tenant) subscribeInbox(ctx context.Context) {
 	startTime := nostr.Timestamp(time.Now().Add(-time.Minute * 5).Unix())
 	filter := nostr.Filter{
 		Tags: nostr.TagMap{
-			"p": {config.OwnerNpubKey},
+			"p": {t.config().OwnerNpubKey},
 		},
 		Since: &startTime,
 	}
 
 	log.Println("📢 subscribing to inbox")
 
-	for ev := range pool.SubscribeMany(ctx, config.ImportSeedRelays, filter) {
-		if !wot.GetInstance().Has(ctx, ev.Event.PubKey) && ev.Event.Kind != nostr.KindGiftWrap {
+	for ev := range pool.SubscribeMany(ctx, t.config().ImportSeedRelays, filter) {
+		if !t.wot.Has(ctx, ev.Event.PubKey) && ev.Event.Kind != nostr.KindGiftWrap {
 			continue
 		}
 		for tag := range ev.Event.Tags.FindAll("p") {
 			if len(tag) < 2 {
 				continue
 			}
-			if tag[1] == config.OwnerNpubKey {
-				dbToPublish := wdbInbox
-				if ev.Event.Kind == nostr.KindGiftWrap {
-					dbToPublish = wdbChat
+			if tag[1] == t.config().OwnerNpubKey {
+				r, ok := t.taggedNoteRelay(ev.Event.Kind)
+				if !ok {
+					break
 				}
+				if rejected, msg := t.rejectPulled(ctx, r, ev.Event); rejected {
+					slog.Debug("ℹ️ skipping rejected event", "id", ev.Event.ID, "reason", msg)
+					break
+				}
+				dbToPublish, relayName := eventstore.RelayWrapper{Store: r.store()}, r.spec.Name
 
 				slog.Debug("ℹ️ importing event", "kind", ev.Kind, "id", ev.Event.ID, "relay", ev.Relay.URL)
 
@@ -218,10 +261,14 @@ func subscribeInboxAndChat(ctx context.Context) {
 					break // Avoid re-importing duplicates
 				}
 
-				if err := dbToPublish.Publish(ctx, *ev.Event); err != nil {
+				if err := dbToPublish.Publish(ctx, *ev.Event); errors.Is(err, errEventDeleted) {
+					slog.Debug("ℹ️ skipping deleted event", "id", ev.Event.ID)
+					break
+				} else if err != nil {
 					log.Println("🚫 error importing tagged note", ev.Event.ID, ":", "from relay", ev.Relay.URL, ":", err)
 					break
 				}
+				inboxEventsImported.WithLabelValues(t.Host, relayName).Inc()
 
 				switch ev.Event.Kind {
 				case nostr.KindTextNote:
@@ -246,6 +293,29 @@ func subscribeInboxAndChat(ctx context.Context) {
 	}
 }
 
+// taggedNoteRelay picks where a note tagging the owner is imported: gift wraps go to the chat relay and
+// everything else to the inbox. Gift wraps are dropped when no relay has the chat role.
+func (t *Tenant) taggedNoteRelay(kind int) (*TenantRelay, bool) {
+	if kind == nostr.KindGiftWrap {
+		return t.chat, t.chat != nil
+	}
+	return t.inbox, true
+}
+
+// rejectPulled runs the checks of a relay on an event pulled from the import seed relays: its bans, and the checks
+// on the content of the events clients publish. The rate limits and the write policies only apply to clients.
+func (t *Tenant) rejectPulled(ctx context.Context, r *TenantRelay, event *nostr.Event) (bool, string) {
+	if rejected, msg := r.management.rejectEvent(ctx, event); rejected {
+		return true, msg
+	}
+	for _, reject := range t.eventChecks(r) {
+		if rejected, msg := reject(ctx, event); rejected {
+			return true, msg
+		}
+	}
+	return false, ""
+}
+
 func isDuplicate(ctx context.Context, db eventstore.RelayWrapper, event *nostr.Event) bool {
 	filter := nostr.Filter{
 		IDs:   []string{event.ID},
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRejectPulled(t *testing.T) {
+	owner, banned := testPubkey(), testPubkey()
+	tenant := newTestTenant(t, owner, testWoT{})
+	inbox := newTestStoredRelay(t, tenant, RelaySpec{Name: "inbox", Role: roleInbox, DeniedKinds: KindList{{Min: 4, Max: 4}}})
+	inbox.limiters.Store(newRelayLimiters(RelayLimits{MaxContentLength: 10, CreatedAtUpperLimit: 900}))
+	if err := inbox.management.banPubkey(banned, "spam"); err != nil {
+		t.Fatal(err)
+	}
+
+	past := nostr.Now() - 60
+	tests := []struct {
+		name     string
+		event    *nostr.Event
+		rejected bool
+	}{
+		{"note", &nostr.Event{PubKey: owner, Kind: nostr.KindTextNote}, false},
+		{"banned author", &nostr.Event{PubKey: banned, Kind: nostr.KindTextNote}, true},
+		{"denied kind", &nostr.Event{PubKey: owner, Kind: nostr.KindEncryptedDirectMessage}, true},
+		{"long content", &nostr.Event{PubKey: owner, Kind: nostr.KindTextNote, Content: "more than ten characters"}, true},
+		{"from the future", &nostr.Event{PubKey: owner, Kind: nostr.KindTextNote, CreatedAt: nostr.Now() + 3600}, true},
+		{"expired", &nostr.Event{PubKey: owner, Kind: nostr.KindTextNote, Tags: expiringEvent("", past).Tags}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rejected, msg := tenant.rejectPulled(context.Background(), inbox, tt.event); rejected != tt.rejected {
+				t.Errorf("rejectPulled() = %v %q, want %v", rejected, msg, tt.rejected)
+			}
+		})
+	}
+}
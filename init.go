@@ -4,10 +4,11 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"log"
 	"log/slog"
 	"net/http"
+	"path/filepath"
 	"text/template"
-	"time"
 
 	"github.com/fiatjaf/eventstore/badger"
 	"github.com/fiatjaf/eventstore/lmdb"
@@ -15,36 +16,14 @@ import (
 	"github.com/fiatjaf/khatru/blossom"
 	"github.com/fiatjaf/khatru/policies"
 	"github.com/nbd-wtf/go-nostr"
-
-	"github.com/bitvora/haven/wot"
-)
-
-var (
-	privateRelay = khatru.NewRelay()
-	privateDB    = newDBBackend("db/private")
-)
-
-var (
-	chatRelay = khatru.NewRelay()
-	chatDB    = newDBBackend("db/chat")
-)
-
-var (
-	outboxRelay = khatru.NewRelay()
-	outboxDB    = newDBBackend("db/outbox")
-)
-
-var (
-	inboxRelay = khatru.NewRelay()
-	inboxDB    = newDBBackend("db/inbox")
+	"github.com/nbd-wtf/go-nostr/nip45/hyperloglog"
 )
 
-var blossomDB = newDBBackend("db/blossom")
-
 type DBBackend interface {
 	Init() error
 	Close()
 	CountEvents(ctx context.Context, filter nostr.Filter) (int64, error)
+	CountEventsHLL(ctx context.Context, filter nostr.Filter, offset int) (int64, *hyperloglog.HyperLogLog, error)
 	DeleteEvent(ctx context.Context, evt *nostr.Event) error
 	QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)
 	SaveEvent(ctx context.Context, evt *nostr.Event) error
@@ -72,204 +51,146 @@ func newLMDBBackend(path string) *lmdb.LMDBBackend {
 	}
 }
 
-func initRelays(ctx context.Context) {
-	if err := privateDB.Init(); err != nil {
-		panic(err)
+func (t *Tenant) initRelays(ctx context.Context) {
+	for _, spec := range t.loadRelaySpecs() {
+		r := t.initRelay(ctx, spec)
+		t.relays = append(t.relays, r)
+
+		switch spec.Role {
+		case roleChat:
+			t.chat = r
+		case roleInbox:
+			t.inbox = r
+		case roleOutbox:
+			t.outbox = r
+		}
 	}
 
-	if err := chatDB.Init(); err != nil {
-		panic(err)
+	// groups are loaded once the chat relay is fully set up, they republish their state through it
+	if t.chat != nil {
+		t.initChatGroups(ctx)
+		t.chat.relay.OnEventSaved = append(t.chat.relay.OnEventSaved, func(ctx context.Context, event *nostr.Event) {
+			if t.chatGroups != nil && isGroupKind(event.Kind) {
+				t.chatGroups.applyEvent(ctx, event)
+			}
+		})
 	}
 
-	if err := outboxDB.Init(); err != nil {
-		panic(err)
+	// the documents aren't served yet, they can be edited in place
+	for _, r := range t.relays {
+		t.describeRelay(r, r.relay.Info, r.spec)
 	}
 
-	if err := inboxDB.Init(); err != nil {
-		panic(err)
+	if config.ReplicationSecret != "" {
+		t.initReplicationRelays()
 	}
-
-	if err := blossomDB.Init(); err != nil {
-		panic(err)
+	if config.ReplicationPrimaryURL != "" {
+		t.instrumentReplication()
 	}
+}
 
-	initRelayLimits()
-
-	privateRelay.Info.Name = config.PrivateRelayName
-	privateRelay.Info.PubKey = nPubToPubkey(config.PrivateRelayNpub)
-	privateRelay.Info.Description = config.PrivateRelayDescription
-	privateRelay.Info.Icon = config.PrivateRelayIcon
-	privateRelay.Info.Version = config.RelayVersion
-	privateRelay.Info.Software = config.RelaySoftware
-	privateRelay.ServiceURL = "https://" + config.RelayURL + "/private"
-
-	if !privateRelayLimits.AllowEmptyFilters {
-		privateRelay.RejectFilter = append(privateRelay.RejectFilter, policies.NoEmptyFilters)
+func (t *Tenant) initRelay(ctx context.Context, spec RelaySpec) *TenantRelay {
+	dbPath := spec.DBPath
+	if dbPath == "" {
+		dbPath = filepath.Join(t.dbPath, spec.Name)
 	}
 
-	if !privateRelayLimits.AllowComplexFilters {
-		privateRelay.RejectFilter = append(privateRelay.RejectFilter, policies.NoComplexFilters)
+	r := &TenantRelay{
+		spec:    spec,
+		relay:   khatru.NewRelay(),
+		db:      newDBBackend(dbPath),
+		clients: newClientTracker(),
 	}
+	connections.track(r.relay)
 
-	privateRelay.RejectEvent = append(privateRelay.RejectEvent,
-		policies.RejectEventsWithBase64Media,
-		policies.EventIPRateLimiter(
-			privateRelayLimits.EventIPLimiterTokensPerInterval,
-			time.Minute*time.Duration(privateRelayLimits.EventIPLimiterInterval),
-			privateRelayLimits.EventIPLimiterMaxTokens,
-		),
-	)
-
-	privateRelay.RejectConnection = append(privateRelay.RejectConnection,
-		policies.ConnectionRateLimiter(
-			privateRelayLimits.ConnectionRateLimiterTokensPerInterval,
-			time.Minute*time.Duration(privateRelayLimits.ConnectionRateLimiterInterval),
-			privateRelayLimits.ConnectionRateLimiterMaxTokens,
-		),
-	)
-
-	privateRelay.OnConnect = append(privateRelay.OnConnect, func(ctx context.Context) {
-		khatru.RequestAuth(ctx)
-	})
-
-	privateRelay.StoreEvent = append(privateRelay.StoreEvent, privateDB.SaveEvent)
-	privateRelay.QueryEvents = append(privateRelay.QueryEvents, privateDB.QueryEvents)
-	privateRelay.DeleteEvent = append(privateRelay.DeleteEvent, privateDB.DeleteEvent)
-	privateRelay.CountEvents = append(privateRelay.CountEvents, privateDB.CountEvents)
-	privateRelay.ReplaceEvent = append(privateRelay.ReplaceEvent, privateDB.ReplaceEvent)
-
-	privateRelay.RejectFilter = append(privateRelay.RejectFilter, func(ctx context.Context, filter nostr.Filter) (bool, string) {
-		authenticatedUser := khatru.GetAuthed(ctx)
-		if authenticatedUser == config.OwnerNpubKey {
-			return false, ""
-		}
-
-		return true, "auth-required: this query requires you to be authenticated"
-	})
-
-	privateRelay.RejectEvent = append(privateRelay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
-		authenticatedUser := khatru.GetAuthed(ctx)
-
-		if authenticatedUser == config.OwnerNpubKey {
-			return false, ""
-		}
-
-		return true, "auth-required: publishing this event requires authentication"
-	})
-
-	mux := privateRelay.Router()
-
-	mux.HandleFunc("GET /private", func(w http.ResponseWriter, r *http.Request) {
-		tmpl := template.Must(template.ParseFiles("templates/index.html"))
-		data := struct {
-			RelayName        string
-			RelayPubkey      string
-			RelayDescription string
-			RelayURL         string
-		}{
-			RelayName:        config.PrivateRelayName,
-			RelayPubkey:      nPubToPubkey(config.PrivateRelayNpub),
-			RelayDescription: config.PrivateRelayDescription,
-			RelayURL:         "wss://" + config.RelayURL + "/private",
-		}
-		err := tmpl.Execute(w, data)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-	})
-
-	chatRelay.Info.Name = config.ChatRelayName
-	chatRelay.Info.PubKey = nPubToPubkey(config.ChatRelayNpub)
-	chatRelay.Info.Description = config.ChatRelayDescription
-	chatRelay.Info.Icon = config.ChatRelayIcon
-	chatRelay.Info.Version = config.RelayVersion
-	chatRelay.Info.Software = config.RelaySoftware
-	chatRelay.ServiceURL = "https://" + config.RelayURL + "/chat"
-
-	if !chatRelayLimits.AllowEmptyFilters {
-		chatRelay.RejectFilter = append(chatRelay.RejectFilter, policies.NoEmptyFilters)
+	if err := r.db.Init(); err != nil {
+		panic(err)
 	}
 
-	if !chatRelayLimits.AllowComplexFilters {
-		chatRelay.RejectFilter = append(chatRelay.RejectFilter, policies.NoComplexFilters)
+	prettyPrintLimits(spec.Name+" relay limits", spec.Limits)
+
+	relay := r.relay
+	relay.Info.Name = spec.Info.Name
+	relay.Info.PubKey = nPubToPubkey(spec.Info.Npub)
+	relay.Info.Description = spec.Info.Description
+	relay.Info.Icon = spec.Info.Icon
+	relay.Info.Version = t.config().RelayVersion
+	relay.Info.Software = t.config().RelaySoftware
+	relay.ServiceURL = r.serviceURL(t.config().RelayURL)
+	// NIP-77 sessions go through the same filter policies and queries as REQs, so they only see what the
+	// client could read
+	relay.Negentropy = true
+
+	if spec.Search {
+		r.search = t.openSearchIndex(spec.Name, r.db)
+	}
+	r.management = t.loadRelayManagement(spec.Name)
+	r.management.setup(relay, r.indexed())
+	relay.ManagementAPI.RejectAPICall = append(relay.ManagementAPI.RejectAPICall, rejectReplicaAPICall)
+	r.tombstones = t.loadTombstones(ctx, spec.Name, r.db)
+
+	r.ipRules.Store(newIPRules(spec))
+	r.limiters.Store(newRelayLimiters(spec.Limits))
+	relay.OverwriteFilter = append(relay.OverwriteFilter, r.overwriteFilterCaps)
+	relay.RejectFilter = append(relay.RejectFilter, r.rejectFilterCaps, r.rejectFilterLimits, r.rejectSearchFilter)
+	relay.RejectCountFilter = append(relay.RejectCountFilter, rejectSearchCount)
+	relay.RejectEvent = append(relay.RejectEvent, rejectReplicaWrite)
+	relay.RejectEvent = append(relay.RejectEvent, t.eventChecks(r)...)
+	relay.RejectEvent = append(relay.RejectEvent, t.rejectEventRate(r))
+	relay.RejectConnection = append(relay.RejectConnection, r.rejectConnectionCount, r.rejectConnectionRate)
+	relay.OnConnect = append(relay.OnConnect, r.trackConnect)
+	relay.OnDisconnect = append(relay.OnDisconnect, r.trackDisconnect)
+
+	if spec.AuthRequired {
+		relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+			khatru.RequestAuth(ctx)
+		})
 	}
 
-	chatRelay.RejectEvent = append(chatRelay.RejectEvent,
-		policies.RejectEventsWithBase64Media,
-		policies.EventIPRateLimiter(
-			chatRelayLimits.EventIPLimiterTokensPerInterval,
-			time.Minute*time.Duration(chatRelayLimits.EventIPLimiterInterval),
-			chatRelayLimits.EventIPLimiterMaxTokens,
-		),
-	)
-
-	chatRelay.RejectConnection = append(chatRelay.RejectConnection,
-		policies.ConnectionRateLimiter(
-			chatRelayLimits.ConnectionRateLimiterTokensPerInterval,
-			time.Minute*time.Duration(chatRelayLimits.ConnectionRateLimiterInterval),
-			chatRelayLimits.ConnectionRateLimiterMaxTokens,
-		),
-	)
-
-	chatRelay.OnConnect = append(chatRelay.OnConnect, func(ctx context.Context) {
-		khatru.RequestAuth(ctx)
-	})
-
-	chatRelay.StoreEvent = append(chatRelay.StoreEvent, chatDB.SaveEvent)
-	chatRelay.QueryEvents = append(chatRelay.QueryEvents, chatDB.QueryEvents)
-	chatRelay.DeleteEvent = append(chatRelay.DeleteEvent, chatDB.DeleteEvent)
-	chatRelay.CountEvents = append(chatRelay.CountEvents, chatDB.CountEvents)
-	chatRelay.ReplaceEvent = append(chatRelay.ReplaceEvent, chatDB.ReplaceEvent)
-
-	chatRelay.RejectFilter = append(chatRelay.RejectFilter, func(ctx context.Context, filter nostr.Filter) (bool, string) {
-		authenticatedUser := khatru.GetAuthed(ctx)
-
-		if !wot.GetInstance().Has(ctx, authenticatedUser) {
-			return true, "you must be in the web of trust to chat with the relay owner"
-		}
-
-		return false, ""
-	})
-
-	allowedKinds := map[int]struct{}{
-		// Regular kinds
-		nostr.KindSimpleGroupChatMessage: struct{}{},
-		nostr.KindSimpleGroupThreadedReply: struct{}{},
-		nostr.KindSimpleGroupThread: struct{}{},
-		nostr.KindSimpleGroupReply: struct{}{},
-		nostr.KindChannelMessage: struct{}{},
-		nostr.KindChannelHideMessage: struct{}{},
-
-		nostr.KindGiftWrap: struct{}{},
-
-		nostr.KindSimpleGroupPutUser: struct{}{},
-		nostr.KindSimpleGroupRemoveUser: struct{}{},
-		nostr.KindSimpleGroupEditMetadata: struct{}{},
-		nostr.KindSimpleGroupDeleteEvent: struct{}{},
-		nostr.KindSimpleGroupCreateGroup: struct{}{},
-		nostr.KindSimpleGroupDeleteGroup: struct{}{},
-		nostr.KindSimpleGroupCreateInvite: struct{}{},
-		nostr.KindSimpleGroupJoinRequest: struct{}{},
-		nostr.KindSimpleGroupLeaveRequest: struct{}{},
-
-		// Addressable kinds
-		nostr.KindSimpleGroupMetadata: struct{}{},
-		nostr.KindSimpleGroupAdmins: struct{}{},
-		nostr.KindSimpleGroupMembers: struct{}{},
-		nostr.KindSimpleGroupRoles: struct{}{},
+	relay.StoreEvent = append(relay.StoreEvent, r.store().SaveEvent)
+	if spec.Blastr {
+		relay.StoreEvent = append(relay.StoreEvent, func(ctx context.Context, event *nostr.Event) error {
+			// the connection context is canceled when the client disconnects, blasts must outlive it
+			blastCtx := context.WithoutCancel(ctx)
+			background.Go(func() { t.blast(blastCtx, event) })
+			return nil
+		})
+	}
+	if spec.Read == readChat {
+		relay.QueryEvents = append(relay.QueryEvents, withoutExpired(t.queryChatEvents))
+		relay.RejectCountFilter = append(relay.RejectCountFilter, t.rejectChatCountFilter)
+		relay.PreventBroadcast = append(relay.PreventBroadcast, t.preventChatBroadcast)
+	} else {
+		relay.QueryEvents = append(relay.QueryEvents, withoutExpired(r.store().QueryEvents))
+	}
+	relay.DeleteEvent = append(relay.DeleteEvent, keepDeletions(r.store().DeleteEvent))
+	relay.CountEvents = append(relay.CountEvents, countEvents(r.db))
+	relay.CountEventsHLL = append(relay.CountEventsHLL, countEventsHLL(r.db))
+	relay.ReplaceEvent = append(relay.ReplaceEvent, r.store().ReplaceEvent)
+
+	if reject := t.readPolicy(r); reject != nil {
+		relay.OverwriteFilter = append(relay.OverwriteFilter, rejectLimitZero(reject))
+		relay.RejectFilter = append(relay.RejectFilter, reject)
+		relay.RejectCountFilter = append(relay.RejectCountFilter, reject)
 	}
 
-	chatRelay.RejectEvent = append(chatRelay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
-		if _, has := allowedKinds[event.Kind]; has {
-			return false, ""
+	for _, policy := range spec.Write {
+		relay.RejectEvent = append(relay.RejectEvent, t.exceptVanish(r, t.writePolicy(r, policy)))
+	}
+	relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, event *nostr.Event) {
+		if event.Kind == kindRequestToVanish {
+			// the connection context is canceled when the client disconnects, the deletions must outlive it
+			vanishCtx := context.WithoutCancel(ctx)
+			background.Go(func() { t.vanish(vanishCtx, event) })
 		}
-
-		return true, "only chat related events are allowed"
 	})
 
-	mux = chatRelay.Router()
-
-	mux.HandleFunc("GET /chat", func(w http.ResponseWriter, r *http.Request) {
+	route := "GET " + spec.Path
+	if spec.Path == "/" {
+		route = "GET /{$}"
+	}
+	relay.Router().HandleFunc(route, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
 		tmpl := template.Must(template.ParseFiles("templates/index.html"))
 		data := struct {
 			RelayName        string
@@ -277,10 +198,10 @@ func initRelays(ctx context.Context) {
 			RelayDescription string
 			RelayURL         string
 		}{
-			RelayName:        config.ChatRelayName,
-			RelayPubkey:      nPubToPubkey(config.ChatRelayNpub),
-			RelayDescription: config.ChatRelayDescription,
-			RelayURL:         "wss://" + config.RelayURL + "/chat",
+			RelayName:        relay.Info.Name,
+			RelayPubkey:      relay.Info.PubKey,
+			RelayDescription: relay.Info.Description,
+			RelayURL:         r.wsURL(t.config().RelayURL),
 		}
 		err := tmpl.Execute(w, data)
 		if err != nil {
@@ -288,82 +209,43 @@ func initRelays(ctx context.Context) {
 		}
 	})
 
-	outboxRelay.Info.Name = config.OutboxRelayName
-	outboxRelay.Info.PubKey = nPubToPubkey(config.OutboxRelayNpub)
-	outboxRelay.Info.Description = config.OutboxRelayDescription
-	outboxRelay.Info.Icon = config.OutboxRelayIcon
-	outboxRelay.Info.Version = config.RelayVersion
-	outboxRelay.Info.Software = config.RelaySoftware
-	outboxRelay.ServiceURL = "https://" + config.RelayURL
+	t.instrumentRelay(r)
 
-	if !outboxRelayLimits.AllowEmptyFilters {
-		outboxRelay.RejectFilter = append(outboxRelay.RejectFilter, policies.NoEmptyFilters)
+	if spec.Blossom {
+		t.initBlossom(ctx, r)
 	}
 
-	if !outboxRelayLimits.AllowComplexFilters {
-		outboxRelay.RejectFilter = append(outboxRelay.RejectFilter, policies.NoComplexFilters)
-	}
+	return r
+}
 
-	outboxRelay.RejectEvent = append(outboxRelay.RejectEvent,
+// eventChecks are the checks of a relay on the events it stores, whoever sends them: the events pulled from the
+// import seed relays go through them too.
+func (t *Tenant) eventChecks(r *TenantRelay) []func(ctx context.Context, event *nostr.Event) (bool, string) {
+	return []func(ctx context.Context, event *nostr.Event) (bool, string){
 		policies.RejectEventsWithBase64Media,
-		policies.EventIPRateLimiter(
-			outboxRelayLimits.EventIPLimiterTokensPerInterval,
-			time.Minute*time.Duration(outboxRelayLimits.EventIPLimiterInterval),
-			outboxRelayLimits.EventIPLimiterMaxTokens,
-		),
-	)
-
-	outboxRelay.RejectConnection = append(outboxRelay.RejectConnection,
-		policies.ConnectionRateLimiter(
-			outboxRelayLimits.ConnectionRateLimiterTokensPerInterval,
-			time.Minute*time.Duration(outboxRelayLimits.ConnectionRateLimiterInterval),
-			outboxRelayLimits.ConnectionRateLimiterMaxTokens,
-		),
-	)
-
-	outboxRelay.StoreEvent = append(outboxRelay.StoreEvent, outboxDB.SaveEvent, func(ctx context.Context, event *nostr.Event) error {
-		go blast(ctx, event)
-		return nil
-	})
-	outboxRelay.QueryEvents = append(outboxRelay.QueryEvents, outboxDB.QueryEvents)
-	outboxRelay.DeleteEvent = append(outboxRelay.DeleteEvent, outboxDB.DeleteEvent)
-	outboxRelay.CountEvents = append(outboxRelay.CountEvents, outboxDB.CountEvents)
-	outboxRelay.ReplaceEvent = append(outboxRelay.ReplaceEvent, outboxDB.ReplaceEvent)
-
-	outboxRelay.RejectEvent = append(outboxRelay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
-		if event.PubKey == config.OwnerNpubKey {
-			return false, ""
-		}
-		return true, "only notes signed by the owner of this relay are allowed"
-	})
+		rejectExpired,
+		r.tombstones.rejectEvent,
+		t.rejectVanish(r),
+		r.rejectEventBounds,
+		t.exceptVanish(r, r.rejectKind),
+	}
+}
 
-	mux = outboxRelay.Router()
+func (t *Tenant) initBlossom(ctx context.Context, r *TenantRelay) {
+	if err := fs.MkdirAll(t.config().BlossomPath, 0755); err != nil {
+		log.Fatal("🚫 error creating blossom path:", err)
+	}
 
-	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		tmpl := template.Must(template.ParseFiles("templates/index.html"))
-		data := struct {
-			RelayName        string
-			RelayPubkey      string
-			RelayDescription string
-			RelayURL         string
-		}{
-			RelayName:        config.OutboxRelayName,
-			RelayPubkey:      nPubToPubkey(config.OutboxRelayNpub),
-			RelayDescription: config.OutboxRelayDescription,
-			RelayURL:         "wss://" + config.RelayURL + "/outbox",
-		}
-		err := tmpl.Execute(w, data)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-	})
+	t.blossomDB = newDBBackend(filepath.Join(t.dbPath, "blossom"))
+	if err := t.blossomDB.Init(); err != nil {
+		panic(err)
+	}
 
-	bl := blossom.New(outboxRelay, "https://"+config.RelayURL)
-	bl.Store = blossom.EventStoreBlobIndexWrapper{Store: blossomDB, ServiceURL: bl.ServiceURL}
+	bl := blossom.New(r.relay, r.serviceURL(t.config().RelayURL))
+	bl.Store = blossom.EventStoreBlobIndexWrapper{Store: t.blossomDB, ServiceURL: bl.ServiceURL}
 	bl.StoreBlob = append(bl.StoreBlob, func(ctx context.Context, sha256 string, ext string, body []byte) error {
 		slog.Debug("storing blob", "sha256", sha256, "ext", ext)
-		file, err := fs.Create(config.BlossomPath + sha256)
+		file, err := fs.Create(t.config().BlossomPath + sha256)
 		if err != nil {
 			return err
 		}
@@ -374,95 +256,27 @@ func initRelays(ctx context.Context) {
 	})
 	bl.LoadBlob = append(bl.LoadBlob, func(ctx context.Context, sha256 string, ext string) (io.ReadSeeker, error) {
 		slog.Debug("loading blob", "sha256", sha256, "ext", ext)
-		return fs.Open(config.BlossomPath + sha256)
+		return fs.Open(t.config().BlossomPath + sha256)
 	})
 	bl.DeleteBlob = append(bl.DeleteBlob, func(ctx context.Context, sha256 string, ext string) error {
 		slog.Debug("deleting blob", "sha256", sha256, "ext", ext)
-		return fs.Remove(config.BlossomPath + sha256)
+		return fs.Remove(t.config().BlossomPath + sha256)
 	})
 	bl.RejectUpload = append(bl.RejectUpload, func(ctx context.Context, event *nostr.Event, size int, ext string) (bool, string, int) {
-		if event.PubKey == config.OwnerNpubKey {
+		if replica.Load() {
+			return true, errReplicaReadOnly.Error(), 403
+		}
+		if event.PubKey == t.config().OwnerNpubKey {
 			return false, ext, size
 		}
 
 		return true, "only notes signed by the owner of this relay are allowed", 403
 	})
-	migrateBlossomMetadata(ctx, bl)
-
-	inboxRelay.Info.Name = config.InboxRelayName
-	inboxRelay.Info.PubKey = nPubToPubkey(config.InboxRelayNpub)
-	inboxRelay.Info.Description = config.InboxRelayDescription
-	inboxRelay.Info.Icon = config.InboxRelayIcon
-	inboxRelay.Info.Version = config.RelayVersion
-	inboxRelay.Info.Software = config.RelaySoftware
-	inboxRelay.ServiceURL = "https://" + config.RelayURL + "/inbox"
-
-	if !inboxRelayLimits.AllowEmptyFilters {
-		inboxRelay.RejectFilter = append(inboxRelay.RejectFilter, policies.NoEmptyFilters)
-	}
-
-	if !inboxRelayLimits.AllowComplexFilters {
-		inboxRelay.RejectFilter = append(inboxRelay.RejectFilter, policies.NoComplexFilters)
-	}
-
-	inboxRelay.RejectEvent = append(inboxRelay.RejectEvent,
-		policies.RejectEventsWithBase64Media,
-		policies.EventIPRateLimiter(
-			inboxRelayLimits.EventIPLimiterTokensPerInterval,
-			time.Minute*time.Duration(inboxRelayLimits.EventIPLimiterInterval),
-			inboxRelayLimits.EventIPLimiterMaxTokens,
-		),
-	)
-
-	inboxRelay.RejectConnection = append(inboxRelay.RejectConnection,
-		policies.ConnectionRateLimiter(
-			inboxRelayLimits.ConnectionRateLimiterTokensPerInterval,
-			time.Minute*time.Duration(inboxRelayLimits.ConnectionRateLimiterInterval),
-			inboxRelayLimits.ConnectionRateLimiterMaxTokens,
-		),
-	)
-
-	inboxRelay.StoreEvent = append(inboxRelay.StoreEvent, inboxDB.SaveEvent)
-	inboxRelay.QueryEvents = append(inboxRelay.QueryEvents, inboxDB.QueryEvents)
-	inboxRelay.DeleteEvent = append(inboxRelay.DeleteEvent, inboxDB.DeleteEvent)
-	inboxRelay.CountEvents = append(inboxRelay.CountEvents, inboxDB.CountEvents)
-	inboxRelay.ReplaceEvent = append(inboxRelay.ReplaceEvent, inboxDB.ReplaceEvent)
-
-	inboxRelay.RejectEvent = append(inboxRelay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
-		if !wot.GetInstance().Has(ctx, event.PubKey) {
-			return true, "you must be in the web of trust to post to this relay"
-		}
-
-		if event.Kind == nostr.KindEncryptedDirectMessage {
-			return true, "only gift wrapped DMs are supported"
-		}
-
-		if event.Tags.FindWithValue("p", inboxRelay.Info.PubKey) != nil {
-			return false, ""
+	bl.RejectDelete = append(bl.RejectDelete, func(ctx context.Context, event *nostr.Event, sha256 string, ext string) (bool, string, int) {
+		if replica.Load() {
+			return true, errReplicaReadOnly.Error(), 403
 		}
-
-		return true, "you can only post notes if you've tagged the owner of this relay"
+		return false, "", 0
 	})
-
-	mux = inboxRelay.Router()
-
-	mux.HandleFunc("GET /inbox", func(w http.ResponseWriter, r *http.Request) {
-		tmpl := template.Must(template.ParseFiles("templates/index.html"))
-		data := struct {
-			RelayName        string
-			RelayPubkey      string
-			RelayDescription string
-			RelayURL         string
-		}{
-			RelayName:        config.InboxRelayName,
-			RelayPubkey:      nPubToPubkey(config.InboxRelayNpub),
-			RelayDescription: config.InboxRelayDescription,
-			RelayURL:         "wss://" + config.RelayURL + "/inbox",
-		}
-		err := tmpl.Execute(w, data)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-	})
-
+	t.migrateBlossomMetadata(ctx, bl, r.db)
 }
@@ -27,7 +27,7 @@ func (z *zipWriter) close() {
 	}
 }
 
-func exportToZip(ctx context.Context, zipFileName string) error {
+func (t *Tenant) exportToZip(ctx context.Context, zipFileName string) error {
 	slog.Info("🛫 starting export", "file", zipFileName)
 	f, err := os.Create(zipFileName)
 	if err != nil {
@@ -38,7 +38,7 @@ func exportToZip(ctx context.Context, zipFileName string) error {
 	z := &zipWriter{f: f, w: zw}
 	defer z.close()
 
-	for _, entry := range getDBs() {
+	for _, entry := range t.getDBs() {
 		slog.Info("📦 exporting db to file", "file", entry.name)
 
 		header := &zip.FileHeader{
@@ -61,9 +61,9 @@ func exportToZip(ctx context.Context, zipFileName string) error {
 	return nil
 }
 
-func exportToJSONL(ctx context.Context, relayName, jsonlFileName string) error {
+func (t *Tenant) exportToJSONL(ctx context.Context, relayName, jsonlFileName string) error {
 	slog.Info("🛫 starting export", "relay", relayName, "file", jsonlFileName)
-	db, ok := getDBByName(relayName)
+	db, ok := t.getDBByName(relayName)
 	if !ok {
 		return fmt.Errorf("unknown relay: %s", relayName)
 	}
@@ -86,7 +86,7 @@ func exportToJSONL(ctx context.Context, relayName, jsonlFileName string) error {
 	return nil
 }
 
-func importFromZip(ctx context.Context, zipFileName string) error {
+func (t *Tenant) importFromZip(ctx context.Context, zipFileName string) error {
 	slog.Info("🛬 starting import", "file", zipFileName)
 
 	zipFile, err := zip.OpenReader(zipFileName)
@@ -99,7 +99,7 @@ func importFromZip(ctx context.Context, zipFileName string) error {
 		}
 	}()
 
-	dbs := getDBMap()
+	dbs := t.getDBMap()
 
 	for _, file := range zipFile.File {
 		db, ok := dbs[file.Name]
@@ -136,9 +136,9 @@ func importEntry(ctx context.Context, db DBBackend, file *zip.File) error {
 	return nil
 }
 
-func importFromJSONL(ctx context.Context, relayName, jsonlFileName string) error {
+func (t *Tenant) importFromJSONL(ctx context.Context, relayName, jsonlFileName string) error {
 	slog.Info("🛬 starting import", "relay", relayName, "file", jsonlFileName)
-	db, ok := getDBByName(relayName)
+	db, ok := t.getDBByName(relayName)
 	if !ok {
 		return fmt.Errorf("unknown relay: %s", relayName)
 	}
@@ -166,30 +166,31 @@ type dbEntry struct {
 	db   DBBackend
 }
 
-func getDBs() []dbEntry {
-	return []dbEntry{
-		{"private.jsonl", privateDB},
-		{"chat.jsonl", chatDB},
-		{"outbox.jsonl", outboxDB},
-		{"inbox.jsonl", inboxDB},
-		{"blossom.jsonl", blossomDB},
+func (t *Tenant) getDBs() []dbEntry {
+	entries := make([]dbEntry, 0, len(t.relays)+1)
+	for _, r := range t.relays {
+		entries = append(entries, dbEntry{r.spec.Name + ".jsonl", r.store()})
 	}
+	if t.blossomDB != nil {
+		entries = append(entries, dbEntry{"blossom.jsonl", t.blossomDB})
+	}
+	return entries
 }
 
-func getDBMap() map[string]DBBackend {
+func (t *Tenant) getDBMap() map[string]DBBackend {
 	m := make(map[string]DBBackend)
-	for _, entry := range getDBs() {
+	for _, entry := range t.getDBs() {
 		m[entry.name] = entry.db
 	}
 	return m
 }
 
-func getDBByName(relay string) (DBBackend, bool) {
+func (t *Tenant) getDBByName(relay string) (DBBackend, bool) {
 	name := relay
 	if len(name) < 6 || name[len(name)-6:] != ".jsonl" {
 		name += ".jsonl"
 	}
-	db, ok := getDBMap()[name]
+	db, ok := t.getDBMap()[name]
 	return db, ok
 }
 
@@ -212,12 +213,20 @@ func importDB(ctx context.Context, db DBBackend, r io.Reader) error {
 		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
 			return err
 		}
+		if isExpired(&event, nostr.Now()) {
+			slog.Debug("⏭️ skipping expired event", "id", event.ID)
+			continue
+		}
 
 		if err := db.SaveEvent(ctx, &event); err != nil {
 			if errors.Is(err, eventstore.ErrDupEvent) {
 				slog.Debug("⏭️ skipping duplicate event", "id", event.ID)
 				continue
 			}
+			if errors.Is(err, errEventDeleted) {
+				slog.Debug("⏭️ skipping deleted event", "id", event.ID)
+				continue
+			}
 			return err
 		}
 		count++
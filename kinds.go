@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// KindRange is an inclusive range of event kinds, a single kind is a range of its own.
+type KindRange struct {
+	Min int
+	Max int
+}
+
+// KindList is the allowed_kinds or denied_kinds of a relay. In JSON and in the environment each item is a kind,
+// a "min-max" range or the name of one of the kindSets.
+type KindList []KindRange
+
+// kindSets are the NIP-01 kind classes, plus the kinds the default chat relay accepts.
+var kindSets = map[string]KindList{
+	"regular":     {{1, 2}, {4, 44}, {1000, 9999}},
+	"replaceable": {{0, 0}, {3, 3}, {10000, 19999}},
+	"ephemeral":   {{20000, 29999}},
+	"addressable": {{30000, 39999}},
+	"chat":        chatKindList(),
+}
+
+func chatKindList() KindList {
+	kinds := make([]int, 0, len(chatAllowedKinds))
+	for kind := range chatAllowedKinds {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+
+	list := make(KindList, len(kinds))
+	for i, kind := range kinds {
+		list[i] = KindRange{kind, kind}
+	}
+	return list
+}
+
+func (k KindList) contains(kind int) bool {
+	for _, r := range k {
+		if kind >= r.Min && kind <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+func parseKindList(items []string) (KindList, error) {
+	var list KindList
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if set, ok := kindSets[item]; ok {
+			list = append(list, set...)
+			continue
+		}
+
+		low, high, isRange := strings.Cut(item, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(low))
+		if err != nil || from < 0 {
+			return nil, fmt.Errorf("invalid kind %q", item)
+		}
+		to := from
+		if isRange {
+			to, err = strconv.Atoi(strings.TrimSpace(high))
+			if err != nil || to < from {
+				return nil, fmt.Errorf("invalid kind range %q", item)
+			}
+		}
+		list = append(list, KindRange{from, to})
+	}
+	return list, nil
+}
+
+func (k *KindList) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	items := make([]string, len(raw))
+	for i, item := range raw {
+		var name string
+		if err := json.Unmarshal(item, &name); err == nil {
+			items[i] = name
+		} else {
+			items[i] = string(item)
+		}
+	}
+
+	list, err := parseKindList(items)
+	if err != nil {
+		return err
+	}
+	*k = list
+	return nil
+}
+
+func (k KindList) MarshalJSON() ([]byte, error) {
+	items := make([]any, len(k))
+	for i, r := range k {
+		if r.Min == r.Max {
+			items[i] = r.Min
+		} else {
+			items[i] = fmt.Sprintf("%d-%d", r.Min, r.Max)
+		}
+	}
+	return json.Marshal(items)
+}
+
+// getKindList reads a comma-separated KindList.
+func (l *configLoader) getKindList(key string, defaultValue string) KindList {
+	list, err := parseKindList(l.getEnvList(key, defaultValue))
+	if err != nil {
+		l.problem("%s: %w", key, err)
+		return nil
+	}
+	return list
+}
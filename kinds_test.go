@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseKindList(t *testing.T) {
+	tests := []struct {
+		items   []string
+		want    KindList
+		invalid bool
+	}{
+		{[]string{"1", " 7 "}, KindList{{1, 1}, {7, 7}}, false},
+		{[]string{"30000-39999"}, KindList{{30000, 39999}}, false},
+		{[]string{"ephemeral", "4"}, KindList{{20000, 29999}, {4, 4}}, false},
+		{[]string{"one"}, nil, true},
+		{[]string{"-1"}, nil, true},
+		{[]string{"10-5"}, nil, true},
+		{[]string{"10-"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseKindList(tt.items)
+		if (err != nil) != tt.invalid {
+			t.Errorf("parseKindList(%q) error = %v, want invalid %v", tt.items, err, tt.invalid)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseKindList(%q) = %v, want %v", tt.items, got, tt.want)
+		}
+	}
+}
+
+func TestKindListJSON(t *testing.T) {
+	var list KindList
+	if err := json.Unmarshal([]byte(`[1, "5-7", "addressable"]`), &list); err != nil {
+		t.Fatal(err)
+	}
+	if want := (KindList{{1, 1}, {5, 7}, {30000, 39999}}); !slices.Equal(list, want) {
+		t.Errorf("unmarshaled %v, want %v", list, want)
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `[1,"5-7","30000-39999"]` {
+		t.Errorf("marshaled %s", data)
+	}
+
+	if err := json.Unmarshal([]byte(`["everything"]`), &list); err == nil {
+		t.Error("an unknown kind set was accepted")
+	}
+}
+
+func TestRejectKind(t *testing.T) {
+	r := &TenantRelay{spec: RelaySpec{AllowedKinds: kindSets["regular"], DeniedKinds: KindList{{4, 4}}}}
+	for kind, want := range map[int]bool{1: false, 1111: false, 4: true, 0: true, 30023: true} {
+		if rejected, _ := r.rejectKind(context.Background(), &nostr.Event{Kind: kind}); rejected != want {
+			t.Errorf("kind %d rejected %v, want %v", kind, rejected, want)
+		}
+	}
+}
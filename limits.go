@@ -1,110 +1,420 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
-)
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
 
-var (
-	privateRelayLimits PrivateRelayLimits
-	chatRelayLimits    ChatRelayLimits
-	inboxRelayLimits   InboxRelayLimits
-	outboxRelayLimits  OutboxRelayLimits
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/policies"
+	"github.com/nbd-wtf/go-nostr"
 )
 
-type PrivateRelayLimits struct {
-	EventIPLimiterTokensPerInterval        int
-	EventIPLimiterInterval                 int
-	EventIPLimiterMaxTokens                int
-	AllowEmptyFilters                      bool
-	AllowComplexFilters                    bool
-	ConnectionRateLimiterTokensPerInterval int
-	ConnectionRateLimiterInterval          int
-	ConnectionRateLimiterMaxTokens         int
-}
-
-type ChatRelayLimits struct {
-	EventIPLimiterTokensPerInterval        int
-	EventIPLimiterInterval                 int
-	EventIPLimiterMaxTokens                int
-	AllowEmptyFilters                      bool
-	AllowComplexFilters                    bool
-	ConnectionRateLimiterTokensPerInterval int
-	ConnectionRateLimiterInterval          int
-	ConnectionRateLimiterMaxTokens         int
-}
-
-type InboxRelayLimits struct {
-	EventIPLimiterTokensPerInterval        int
-	EventIPLimiterInterval                 int
-	EventIPLimiterMaxTokens                int
-	AllowEmptyFilters                      bool
-	AllowComplexFilters                    bool
-	ConnectionRateLimiterTokensPerInterval int
-	ConnectionRateLimiterInterval          int
-	ConnectionRateLimiterMaxTokens         int
-}
-
-type OutboxRelayLimits struct {
-	EventIPLimiterTokensPerInterval        int
-	EventIPLimiterInterval                 int
-	EventIPLimiterMaxTokens                int
-	AllowEmptyFilters                      bool
-	AllowComplexFilters                    bool
-	ConnectionRateLimiterTokensPerInterval int
-	ConnectionRateLimiterInterval          int
-	ConnectionRateLimiterMaxTokens         int
-}
-
-func initRelayLimits() {
-	privateRelayLimits = PrivateRelayLimits{
-		EventIPLimiterTokensPerInterval:        getEnvInt("PRIVATE_RELAY_EVENT_IP_LIMITER_TOKENS_PER_INTERVAL", 50),
-		EventIPLimiterInterval:                 getEnvInt("PRIVATE_RELAY_EVENT_IP_LIMITER_INTERVAL", 1),
-		EventIPLimiterMaxTokens:                getEnvInt("PRIVATE_RELAY_EVENT_IP_LIMITER_MAX_TOKENS", 100),
-		AllowEmptyFilters:                      getEnvBool("PRIVATE_RELAY_ALLOW_EMPTY_FILTERS", true),
-		AllowComplexFilters:                    getEnvBool("PRIVATE_RELAY_ALLOW_COMPLEX_FILTERS", true),
-		ConnectionRateLimiterTokensPerInterval: getEnvInt("PRIVATE_RELAY_CONNECTION_RATE_LIMITER_TOKENS_PER_INTERVAL", 3),
-		ConnectionRateLimiterInterval:          getEnvInt("PRIVATE_RELAY_CONNECTION_RATE_LIMITER_INTERVAL", 5),
-		ConnectionRateLimiterMaxTokens:         getEnvInt("PRIVATE_RELAY_CONNECTION_RATE_LIMITER_MAX_TOKENS", 9),
-	}
-
-	chatRelayLimits = ChatRelayLimits{
-		EventIPLimiterTokensPerInterval:        getEnvInt("CHAT_RELAY_EVENT_IP_LIMITER_TOKENS_PER_INTERVAL", 50),
-		EventIPLimiterInterval:                 getEnvInt("CHAT_RELAY_EVENT_IP_LIMITER_INTERVAL", 1),
-		EventIPLimiterMaxTokens:                getEnvInt("CHAT_RELAY_EVENT_IP_LIMITER_MAX_TOKENS", 100),
-		AllowEmptyFilters:                      getEnvBool("CHAT_RELAY_ALLOW_EMPTY_FILTERS", false),
-		AllowComplexFilters:                    getEnvBool("CHAT_RELAY_ALLOW_COMPLEX_FILTERS", false),
-		ConnectionRateLimiterTokensPerInterval: getEnvInt("CHAT_RELAY_CONNECTION_RATE_LIMITER_TOKENS_PER_INTERVAL", 3),
-		ConnectionRateLimiterInterval:          getEnvInt("CHAT_RELAY_CONNECTION_RATE_LIMITER_INTERVAL", 3),
-		ConnectionRateLimiterMaxTokens:         getEnvInt("CHAT_RELAY_CONNECTION_RATE_LIMITER_MAX_TOKENS", 9),
-	}
-
-	inboxRelayLimits = InboxRelayLimits{
-		EventIPLimiterTokensPerInterval:        getEnvInt("INBOX_RELAY_EVENT_IP_LIMITER_TOKENS_PER_INTERVAL", 10),
-		EventIPLimiterInterval:                 getEnvInt("INBOX_RELAY_EVENT_IP_LIMITER_INTERVAL", 1),
-		EventIPLimiterMaxTokens:                getEnvInt("INBOX_RELAY_EVENT_IP_LIMITER_MAX_TOKENS", 20),
-		AllowEmptyFilters:                      getEnvBool("INBOX_RELAY_ALLOW_EMPTY_FILTERS", false),
-		AllowComplexFilters:                    getEnvBool("INBOX_RELAY_ALLOW_COMPLEX_FILTERS", false),
-		ConnectionRateLimiterTokensPerInterval: getEnvInt("INBOX_RELAY_CONNECTION_RATE_LIMITER_TOKENS_PER_INTERVAL", 3),
-		ConnectionRateLimiterInterval:          getEnvInt("INBOX_RELAY_CONNECTION_RATE_LIMITER_INTERVAL", 1),
-		ConnectionRateLimiterMaxTokens:         getEnvInt("INBOX_RELAY_CONNECTION_RATE_LIMITER_MAX_TOKENS", 9),
-	}
-
-	outboxRelayLimits = OutboxRelayLimits{
-		EventIPLimiterTokensPerInterval:        getEnvInt("OUTBOX_RELAY_EVENT_IP_LIMITER_TOKENS_PER_INTERVAL", 10),
-		EventIPLimiterInterval:                 getEnvInt("OUTBOX_RELAY_EVENT_IP_LIMITER_INTERVAL", 60),
-		EventIPLimiterMaxTokens:                getEnvInt("OUTBOX_RELAY_EVENT_IP_LIMITER_MAX_TOKENS", 100),
-		AllowEmptyFilters:                      getEnvBool("OUTBOX_RELAY_ALLOW_EMPTY_FILTERS", false),
-		AllowComplexFilters:                    getEnvBool("OUTBOX_RELAY_ALLOW_COMPLEX_FILTERS", false),
-		ConnectionRateLimiterTokensPerInterval: getEnvInt("OUTBOX_RELAY_CONNECTION_RATE_LIMITER_TOKENS_PER_INTERVAL", 3),
-		ConnectionRateLimiterInterval:          getEnvInt("OUTBOX_RELAY_CONNECTION_RATE_LIMITER_INTERVAL", 1),
-		ConnectionRateLimiterMaxTokens:         getEnvInt("OUTBOX_RELAY_CONNECTION_RATE_LIMITER_MAX_TOKENS", 9),
-	}
-
-	prettyPrintLimits("Private relay limits", privateRelayLimits)
-	prettyPrintLimits("Chat relay limits", chatRelayLimits)
-	prettyPrintLimits("Inbox relay limits", inboxRelayLimits)
-	prettyPrintLimits("Outbox relay limits", outboxRelayLimits)
+type RelayLimits struct {
+	EventIPLimiterTokensPerInterval        int  `json:"event_ip_limiter_tokens_per_interval"`
+	EventIPLimiterInterval                 int  `json:"event_ip_limiter_interval"`
+	EventIPLimiterMaxTokens                int  `json:"event_ip_limiter_max_tokens"`
+	EventPubkeyLimiterTokensPerInterval    int  `json:"event_pubkey_limiter_tokens_per_interval"`
+	EventPubkeyLimiterInterval             int  `json:"event_pubkey_limiter_interval"`
+	EventPubkeyLimiterMaxTokens            int  `json:"event_pubkey_limiter_max_tokens"`
+	OwnerEventLimiterTokensPerInterval     int  `json:"owner_event_limiter_tokens_per_interval"`
+	OwnerEventLimiterInterval              int  `json:"owner_event_limiter_interval"`
+	OwnerEventLimiterMaxTokens             int  `json:"owner_event_limiter_max_tokens"`
+	AllowEmptyFilters                      bool `json:"allow_empty_filters"`
+	AllowComplexFilters                    bool `json:"allow_complex_filters"`
+	ConnectionRateLimiterTokensPerInterval int  `json:"connection_rate_limiter_tokens_per_interval"`
+	ConnectionRateLimiterInterval          int  `json:"connection_rate_limiter_interval"`
+	ConnectionRateLimiterMaxTokens         int  `json:"connection_rate_limiter_max_tokens"`
+	MaxEventSize                           int  `json:"max_event_size"`
+	MaxEventTags                           int  `json:"max_event_tags"`
+	MaxContentLength                       int  `json:"max_content_length"`
+	CreatedAtLowerLimit                    int  `json:"created_at_lower_limit"`
+	CreatedAtUpperLimit                    int  `json:"created_at_upper_limit"`
+	MaxSubscriptions                       int  `json:"max_subscriptions"`
+	MaxFilters                             int  `json:"max_filters"`
+	DefaultLimit                           int  `json:"default_limit"`
+	MaxLimit                               int  `json:"max_limit"`
+	MaxNegentropyLimit                     int  `json:"max_negentropy_limit"`
+	MaxConnectionsPerIP                    int  `json:"max_connections_per_ip"`
+	MaxConnectionsPerPubkey                int  `json:"max_connections_per_pubkey"`
+}
+
+// defaultRelayLimits are used for the limits a relay in RELAYS_FILE doesn't set.
+var defaultRelayLimits = RelayLimits{
+	EventIPLimiterTokensPerInterval:        50,
+	EventIPLimiterInterval:                 1,
+	EventIPLimiterMaxTokens:                100,
+	EventPubkeyLimiterTokensPerInterval:    50,
+	EventPubkeyLimiterInterval:             1,
+	EventPubkeyLimiterMaxTokens:            100,
+	OwnerEventLimiterTokensPerInterval:     0,
+	OwnerEventLimiterInterval:              1,
+	OwnerEventLimiterMaxTokens:             0,
+	AllowEmptyFilters:                      false,
+	AllowComplexFilters:                    false,
+	ConnectionRateLimiterTokensPerInterval: 3,
+	ConnectionRateLimiterInterval:          1,
+	ConnectionRateLimiterMaxTokens:         9,
+	MaxEventSize:                           0,
+	MaxEventTags:                           0,
+	MaxContentLength:                       0,
+	CreatedAtLowerLimit:                    0,
+	CreatedAtUpperLimit:                    900,
+	MaxSubscriptions:                       50,
+	MaxFilters:                             10,
+	DefaultLimit:                           0,
+	MaxLimit:                               0,
+	MaxNegentropyLimit:                     100000,
+	MaxConnectionsPerIP:                    20,
+	MaxConnectionsPerPubkey:                10,
+}
+
+// relayLimits reads the limits of one of the default relays from the <PREFIX>_RELAY_* variables.
+func (l *configLoader) relayLimits(prefix string, defaults RelayLimits) RelayLimits {
+	return RelayLimits{
+		EventIPLimiterTokensPerInterval:        l.getEnvInt(prefix+"_RELAY_EVENT_IP_LIMITER_TOKENS_PER_INTERVAL", defaults.EventIPLimiterTokensPerInterval),
+		EventIPLimiterInterval:                 l.getEnvInterval(prefix+"_RELAY_EVENT_IP_LIMITER_INTERVAL", defaults.EventIPLimiterInterval),
+		EventIPLimiterMaxTokens:                l.getEnvInt(prefix+"_RELAY_EVENT_IP_LIMITER_MAX_TOKENS", defaults.EventIPLimiterMaxTokens),
+		EventPubkeyLimiterTokensPerInterval:    l.getEnvInt(prefix+"_RELAY_EVENT_PUBKEY_LIMITER_TOKENS_PER_INTERVAL", defaults.EventPubkeyLimiterTokensPerInterval),
+		EventPubkeyLimiterInterval:             l.getEnvInterval(prefix+"_RELAY_EVENT_PUBKEY_LIMITER_INTERVAL", defaults.EventPubkeyLimiterInterval),
+		EventPubkeyLimiterMaxTokens:            l.getEnvInt(prefix+"_RELAY_EVENT_PUBKEY_LIMITER_MAX_TOKENS", defaults.EventPubkeyLimiterMaxTokens),
+		OwnerEventLimiterTokensPerInterval:     l.getEnvInt(prefix+"_RELAY_OWNER_EVENT_LIMITER_TOKENS_PER_INTERVAL", defaults.OwnerEventLimiterTokensPerInterval),
+		OwnerEventLimiterInterval:              l.getEnvInterval(prefix+"_RELAY_OWNER_EVENT_LIMITER_INTERVAL", defaults.OwnerEventLimiterInterval),
+		OwnerEventLimiterMaxTokens:             l.getEnvInt(prefix+"_RELAY_OWNER_EVENT_LIMITER_MAX_TOKENS", defaults.OwnerEventLimiterMaxTokens),
+		AllowEmptyFilters:                      l.getEnvBool(prefix+"_RELAY_ALLOW_EMPTY_FILTERS", defaults.AllowEmptyFilters),
+		AllowComplexFilters:                    l.getEnvBool(prefix+"_RELAY_ALLOW_COMPLEX_FILTERS", defaults.AllowComplexFilters),
+		ConnectionRateLimiterTokensPerInterval: l.getEnvInt(prefix+"_RELAY_CONNECTION_RATE_LIMITER_TOKENS_PER_INTERVAL", defaults.ConnectionRateLimiterTokensPerInterval),
+		ConnectionRateLimiterInterval:          l.getEnvInterval(prefix+"_RELAY_CONNECTION_RATE_LIMITER_INTERVAL", defaults.ConnectionRateLimiterInterval),
+		ConnectionRateLimiterMaxTokens:         l.getEnvInt(prefix+"_RELAY_CONNECTION_RATE_LIMITER_MAX_TOKENS", defaults.ConnectionRateLimiterMaxTokens),
+		MaxEventSize:                           l.getEnvInt(prefix+"_RELAY_MAX_EVENT_SIZE", defaults.MaxEventSize),
+		MaxEventTags:                           l.getEnvInt(prefix+"_RELAY_MAX_EVENT_TAGS", defaults.MaxEventTags),
+		MaxContentLength:                       l.getEnvInt(prefix+"_RELAY_MAX_CONTENT_LENGTH", defaults.MaxContentLength),
+		CreatedAtLowerLimit:                    l.getEnvInt(prefix+"_RELAY_CREATED_AT_LOWER_LIMIT", defaults.CreatedAtLowerLimit),
+		CreatedAtUpperLimit:                    l.getEnvInt(prefix+"_RELAY_CREATED_AT_UPPER_LIMIT", defaults.CreatedAtUpperLimit),
+		MaxSubscriptions:                       l.getEnvInt(prefix+"_RELAY_MAX_SUBSCRIPTIONS", defaults.MaxSubscriptions),
+		MaxFilters:                             l.getEnvInt(prefix+"_RELAY_MAX_FILTERS", defaults.MaxFilters),
+		DefaultLimit:                           l.getEnvInt(prefix+"_RELAY_DEFAULT_LIMIT", defaults.DefaultLimit),
+		MaxLimit:                               l.getEnvInt(prefix+"_RELAY_MAX_LIMIT", defaults.MaxLimit),
+		MaxNegentropyLimit:                     l.getEnvInt(prefix+"_RELAY_MAX_NEGENTROPY_LIMIT", defaults.MaxNegentropyLimit),
+		MaxConnectionsPerIP:                    l.getEnvInt(prefix+"_RELAY_MAX_CONNECTIONS_PER_IP", defaults.MaxConnectionsPerIP),
+		MaxConnectionsPerPubkey:                l.getEnvInt(prefix+"_RELAY_MAX_CONNECTIONS_PER_PUBKEY", defaults.MaxConnectionsPerPubkey),
+	}
+}
+
+// getEnvInterval reads the interval of a rate limiter in minutes, it must be positive.
+func (l *configLoader) getEnvInterval(key string, defaultValue int) int {
+	interval := l.getEnvInt(key, defaultValue)
+	if interval <= 0 {
+		l.problem("%s must be positive", key)
+	}
+	return interval
+}
+
+// intervalProblems names the rate limiter intervals that aren't positive.
+func (limits RelayLimits) intervalProblems() []string {
+	var problems []string
+	for name, interval := range map[string]int{
+		"event_ip_limiter_interval":        limits.EventIPLimiterInterval,
+		"event_pubkey_limiter_interval":    limits.EventPubkeyLimiterInterval,
+		"owner_event_limiter_interval":     limits.OwnerEventLimiterInterval,
+		"connection_rate_limiter_interval": limits.ConnectionRateLimiterInterval,
+	} {
+		if interval <= 0 {
+			problems = append(problems, name)
+		}
+	}
+	slices.Sort(problems)
+	return problems
+}
+
+func (l *configLoader) privateRelayLimits() RelayLimits {
+	return l.relayLimits("PRIVATE", RelayLimits{
+		EventIPLimiterTokensPerInterval:        50,
+		EventIPLimiterInterval:                 1,
+		EventIPLimiterMaxTokens:                100,
+		EventPubkeyLimiterTokensPerInterval:    50,
+		EventPubkeyLimiterInterval:             1,
+		EventPubkeyLimiterMaxTokens:            100,
+		OwnerEventLimiterTokensPerInterval:     0,
+		OwnerEventLimiterInterval:              1,
+		OwnerEventLimiterMaxTokens:             0,
+		AllowEmptyFilters:                      true,
+		AllowComplexFilters:                    true,
+		ConnectionRateLimiterTokensPerInterval: 3,
+		ConnectionRateLimiterInterval:          5,
+		ConnectionRateLimiterMaxTokens:         9,
+		MaxEventSize:                           0,
+		MaxEventTags:                           0,
+		MaxContentLength:                       0,
+		CreatedAtLowerLimit:                    0,
+		CreatedAtUpperLimit:                    900,
+		MaxSubscriptions:                       50,
+		MaxFilters:                             10,
+		DefaultLimit:                           0,
+		MaxLimit:                               0,
+		MaxNegentropyLimit:                     100000,
+		MaxConnectionsPerIP:                    20,
+		MaxConnectionsPerPubkey:                10,
+	})
+}
+
+func (l *configLoader) chatRelayLimits() RelayLimits {
+	return l.relayLimits("CHAT", RelayLimits{
+		EventIPLimiterTokensPerInterval:        50,
+		EventIPLimiterInterval:                 1,
+		EventIPLimiterMaxTokens:                100,
+		EventPubkeyLimiterTokensPerInterval:    50,
+		EventPubkeyLimiterInterval:             1,
+		EventPubkeyLimiterMaxTokens:            100,
+		OwnerEventLimiterTokensPerInterval:     0,
+		OwnerEventLimiterInterval:              1,
+		OwnerEventLimiterMaxTokens:             0,
+		AllowEmptyFilters:                      false,
+		AllowComplexFilters:                    false,
+		ConnectionRateLimiterTokensPerInterval: 3,
+		ConnectionRateLimiterInterval:          3,
+		ConnectionRateLimiterMaxTokens:         9,
+		MaxEventSize:                           262144,
+		MaxEventTags:                           2000,
+		MaxContentLength:                       131072,
+		CreatedAtLowerLimit:                    0,
+		CreatedAtUpperLimit:                    900,
+		MaxSubscriptions:                       50,
+		MaxFilters:                             10,
+		DefaultLimit:                           0,
+		MaxLimit:                               0,
+		MaxNegentropyLimit:                     100000,
+		MaxConnectionsPerIP:                    20,
+		MaxConnectionsPerPubkey:                10,
+	})
+}
+
+func (l *configLoader) inboxRelayLimits() RelayLimits {
+	return l.relayLimits("INBOX", RelayLimits{
+		EventIPLimiterTokensPerInterval:        10,
+		EventIPLimiterInterval:                 1,
+		EventIPLimiterMaxTokens:                20,
+		EventPubkeyLimiterTokensPerInterval:    10,
+		EventPubkeyLimiterInterval:             1,
+		EventPubkeyLimiterMaxTokens:            20,
+		OwnerEventLimiterTokensPerInterval:     0,
+		OwnerEventLimiterInterval:              1,
+		OwnerEventLimiterMaxTokens:             0,
+		AllowEmptyFilters:                      false,
+		AllowComplexFilters:                    false,
+		ConnectionRateLimiterTokensPerInterval: 3,
+		ConnectionRateLimiterInterval:          1,
+		ConnectionRateLimiterMaxTokens:         9,
+		MaxEventSize:                           131072,
+		MaxEventTags:                           2000,
+		MaxContentLength:                       65536,
+		CreatedAtLowerLimit:                    0,
+		CreatedAtUpperLimit:                    900,
+		MaxSubscriptions:                       50,
+		MaxFilters:                             10,
+		DefaultLimit:                           0,
+		MaxLimit:                               0,
+		MaxNegentropyLimit:                     100000,
+		MaxConnectionsPerIP:                    20,
+		MaxConnectionsPerPubkey:                10,
+	})
+}
+
+func (l *configLoader) outboxRelayLimits() RelayLimits {
+	return l.relayLimits("OUTBOX", RelayLimits{
+		EventIPLimiterTokensPerInterval:        10,
+		EventIPLimiterInterval:                 60,
+		EventIPLimiterMaxTokens:                100,
+		EventPubkeyLimiterTokensPerInterval:    10,
+		EventPubkeyLimiterInterval:             60,
+		EventPubkeyLimiterMaxTokens:            100,
+		OwnerEventLimiterTokensPerInterval:     0,
+		OwnerEventLimiterInterval:              1,
+		OwnerEventLimiterMaxTokens:             0,
+		AllowEmptyFilters:                      false,
+		AllowComplexFilters:                    false,
+		ConnectionRateLimiterTokensPerInterval: 3,
+		ConnectionRateLimiterInterval:          1,
+		ConnectionRateLimiterMaxTokens:         9,
+		MaxEventSize:                           0,
+		MaxEventTags:                           0,
+		MaxContentLength:                       0,
+		CreatedAtLowerLimit:                    0,
+		CreatedAtUpperLimit:                    900,
+		MaxSubscriptions:                       50,
+		MaxFilters:                             10,
+		DefaultLimit:                           0,
+		MaxLimit:                               0,
+		MaxNegentropyLimit:                     100000,
+		MaxConnectionsPerIP:                    20,
+		MaxConnectionsPerPubkey:                10,
+	})
+}
+
+// relayLimiters enforce the limits of a relay. A reload replaces the limits and keeps the rate limiters, their
+// buckets are refilled at the new rates from then on.
+type relayLimiters struct {
+	limits      RelayLimits
+	event       *rateLimiter
+	pubkeyEvent *rateLimiter
+	ownerEvent  *rateLimiter
+	connection  *rateLimiter
+}
+
+func newRelayLimiters(limits RelayLimits) *relayLimiters {
+	return &relayLimiters{
+		limits:      limits,
+		event:       newRateLimiter(),
+		pubkeyEvent: newRateLimiter(),
+		ownerEvent:  newRateLimiter(),
+		connection:  newRateLimiter(),
+	}
+}
+
+// withLimits returns the limiters with new limits and the same buckets.
+func (l *relayLimiters) withLimits(limits RelayLimits) *relayLimiters {
+	next := *l
+	next.limits = limits
+	return &next
+}
+
+const rateLimitedMessage = "rate-limited: slow down, please"
+
+// rateLimiter is a token bucket per key, like the rate limiters of khatru. The buckets are refilled when their key
+// is charged rather than by a goroutine of their own, so the rates can change and nothing is left running.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+// tokenBucket counts the tokens used by a key since it was last refilled.
+type tokenBucket struct {
+	used       int
+	refilledAt time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket), pruned: time.Now()}
+}
+
+// limited charges a token to key and reports whether it had none left. The interval is in minutes.
+func (l *rateLimiter) limited(key string, tokensPerInterval int, interval int, maxTokens int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	every := time.Minute * time.Duration(interval)
+	// the full buckets are forgotten once per interval
+	if now.Sub(l.pruned) >= every {
+		for k, bucket := range l.buckets {
+			if bucket.refill(now, tokensPerInterval, every) == 0 {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{refilledAt: now}
+		l.buckets[key] = bucket
+	}
+	if bucket.refill(now, tokensPerInterval, every) >= maxTokens {
+		return true
+	}
+	bucket.used++
+	return false
+}
+
+// refill gives back the tokens of the intervals elapsed since the last refill, and returns the tokens still used.
+func (b *tokenBucket) refill(now time.Time, tokensPerInterval int, every time.Duration) int {
+	intervals := int(now.Sub(b.refilledAt) / every)
+	if intervals > 0 {
+		b.used = max(0, b.used-intervals*tokensPerInterval)
+		b.refilledAt = b.refilledAt.Add(time.Duration(intervals) * every)
+	}
+	return b.used
+}
+
+func (r *TenantRelay) rejectFilterLimits(ctx context.Context, filter nostr.Filter) (bool, string) {
+	limits := r.limiters.Load().limits
+	if !limits.AllowEmptyFilters {
+		if reject, msg := policies.NoEmptyFilters(ctx, filter); reject {
+			return reject, msg
+		}
+	}
+	if !limits.AllowComplexFilters {
+		return policies.NoComplexFilters(ctx, filter)
+	}
+	return false, ""
+}
+
+// rejectEventRate picks the bucket of an event by who sent it, as authenticated with NIP-42: the owner has a quota
+// of their own, the Web of Trust and the pubkeys allowed through the management API get a bucket per pubkey, so a
+// noisy member doesn't exhaust the bucket of everyone behind the same IP, and everyone else shares the IP buckets.
+// Unauthenticated events always go to the IP buckets, whoever signed them: anyone can replay the events of a member.
+func (t *Tenant) rejectEventRate(r *TenantRelay) func(ctx context.Context, event *nostr.Event) (bool, string) {
+	return func(ctx context.Context, event *nostr.Event) (bool, string) {
+		limiters := r.limiters.Load()
+		limits := limiters.limits
+		sender := khatru.GetAuthed(ctx)
+
+		switch {
+		case sender == "":
+		case sender == t.config().OwnerNpubKey:
+			// an owner quota of 0 tokens per interval is disabled
+			if limits.OwnerEventLimiterTokensPerInterval <= 0 {
+				return false, ""
+			}
+			return limiters.ownerEvent.limited(sender, limits.OwnerEventLimiterTokensPerInterval, limits.OwnerEventLimiterInterval, limits.OwnerEventLimiterMaxTokens), rateLimitedMessage
+		case limits.EventPubkeyLimiterTokensPerInterval > 0 && (t.isOwnerOrAllowed(r, sender) || t.wot.Has(ctx, sender)):
+			return limiters.pubkeyEvent.limited(sender, limits.EventPubkeyLimiterTokensPerInterval, limits.EventPubkeyLimiterInterval, limits.EventPubkeyLimiterMaxTokens), rateLimitedMessage
+		}
+
+		ip := khatru.GetIP(ctx)
+		if ip == "" {
+			return false, ""
+		}
+		return limiters.event.limited(ip, limits.EventIPLimiterTokensPerInterval, limits.EventIPLimiterInterval, limits.EventIPLimiterMaxTokens), rateLimitedMessage
+	}
+}
+
+// rejectEventBounds refuses events too large for the relay or too far from the current time, a limit of 0 is
+// disabled.
+func (r *TenantRelay) rejectEventBounds(_ context.Context, event *nostr.Event) (bool, string) {
+	limits := r.limiters.Load().limits
+
+	if limits.MaxEventSize > 0 && len(event.String()) > limits.MaxEventSize {
+		return true, fmt.Sprintf("invalid: event is larger than %d bytes", limits.MaxEventSize)
+	}
+	if limits.MaxEventTags > 0 && len(event.Tags) > limits.MaxEventTags {
+		return true, fmt.Sprintf("invalid: event has more than %d tags", limits.MaxEventTags)
+	}
+	if limits.MaxContentLength > 0 && utf8.RuneCountInString(event.Content) > limits.MaxContentLength {
+		return true, fmt.Sprintf("invalid: content is longer than %d characters", limits.MaxContentLength)
+	}
+
+	now := nostr.Now()
+	if limits.CreatedAtLowerLimit > 0 && event.CreatedAt < now-nostr.Timestamp(limits.CreatedAtLowerLimit) {
+		return true, fmt.Sprintf("invalid: created_at is more than %d seconds in the past", limits.CreatedAtLowerLimit)
+	}
+	if limits.CreatedAtUpperLimit > 0 && event.CreatedAt > now+nostr.Timestamp(limits.CreatedAtUpperLimit) {
+		return true, fmt.Sprintf("invalid: created_at is more than %d seconds in the future", limits.CreatedAtUpperLimit)
+	}
+	return false, ""
+}
+
+func (r *TenantRelay) rejectConnectionRate(req *http.Request) bool {
+	limiters := r.limiters.Load()
+	limits := limiters.limits
+	return limiters.connection.limited(khatru.GetIPFromRequest(req), limits.ConnectionRateLimiterTokensPerInterval, limits.ConnectionRateLimiterInterval, limits.ConnectionRateLimiterMaxTokens)
 }
 
 func prettyPrintLimits(label string, value any) {
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRejectEventRate(t *testing.T) {
+	owner, friend, other := testPubkey(), testPubkey(), testPubkey()
+	tenant := newTestTenant(t, owner, testWoT{friend: true, other: true})
+	r := tenant.newTestRelay(RelaySpec{Name: "inbox"})
+	r.limiters.Store(newRelayLimiters(RelayLimits{
+		EventIPLimiterTokensPerInterval:     1,
+		EventIPLimiterInterval:              60,
+		EventIPLimiterMaxTokens:             1,
+		EventPubkeyLimiterTokensPerInterval: 1,
+		EventPubkeyLimiterInterval:          60,
+		EventPubkeyLimiterMaxTokens:         2,
+	}))
+	reject := tenant.rejectEventRate(r)
+
+	send := func(ctx context.Context, pubkey string) bool {
+		rejected, _ := reject(ctx, &nostr.Event{PubKey: pubkey})
+		return rejected
+	}
+	fromIP := func(ip string) context.Context {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		return context.WithValue(context.Background(), 0, &khatru.WebSocket{Request: req})
+	}
+
+	// unauthenticated events share the bucket of their IP, even signed by WoT members
+	for i, want := range []bool{false, true} {
+		if got := send(fromIP("203.0.113.7"), friend); got != want {
+			t.Errorf("unauthenticated event %d of a WoT member: rejected %v, want %v", i, got, want)
+		}
+	}
+	if !send(fromIP("203.0.113.7"), other) {
+		t.Error("the events of another WoT member escape the bucket of their IP")
+	}
+	if send(fromIP("198.51.100.1"), friend) {
+		t.Error("replayed events of a WoT member drained the bucket of another IP")
+	}
+
+	// authenticated members use the bucket of their authenticated pubkey, whoever signed the event
+	for i, want := range []bool{false, false, true} {
+		if got := send(authedContext(friend), other); got != want {
+			t.Errorf("event %d of an authenticated WoT member: rejected %v, want %v", i, got, want)
+		}
+	}
+	if send(authedContext(other), other) {
+		t.Error("another WoT member shares the bucket of the first one")
+	}
+
+	// the authenticated owner isn't limited by default
+	for range 5 {
+		if send(authedContext(owner), owner) {
+			t.Fatal("the authenticated owner is rate limited")
+		}
+	}
+}
+
+func TestRejectEventBounds(t *testing.T) {
+	r := &TenantRelay{}
+	r.limiters.Store(newRelayLimiters(RelayLimits{
+		MaxEventSize:        1000,
+		MaxEventTags:        2,
+		MaxContentLength:    5,
+		CreatedAtLowerLimit: 60,
+		CreatedAtUpperLimit: 60,
+	}))
+
+	now := nostr.Now()
+	tests := []struct {
+		name   string
+		event  *nostr.Event
+		reject bool
+	}{
+		{"within bounds", &nostr.Event{Content: "héllo", CreatedAt: now}, false},
+		{"too large", &nostr.Event{Tags: nostr.Tags{{"alt", strings.Repeat("a", 1000)}}, CreatedAt: now}, true},
+		{"too many tags", &nostr.Event{Tags: nostr.Tags{{"t", "a"}, {"t", "b"}, {"t", "c"}}, CreatedAt: now}, true},
+		{"content too long", &nostr.Event{Content: "hello!", CreatedAt: now}, true},
+		{"too old", &nostr.Event{CreatedAt: now - 120}, true},
+		{"too far in the future", &nostr.Event{CreatedAt: now + 120}, true},
+	}
+	for _, tt := range tests {
+		if rejected, msg := r.rejectEventBounds(context.Background(), tt.event); rejected != tt.reject {
+			t.Errorf("%s: rejected %v (%s), want %v", tt.name, rejected, msg, tt.reject)
+		}
+	}
+
+	// a limit of 0 is disabled
+	r.limiters.Store(newRelayLimiters(RelayLimits{}))
+	if rejected, _ := r.rejectEventBounds(context.Background(), &nostr.Event{Content: "hello!", CreatedAt: now - 120}); rejected {
+		t.Error("an event was rejected without limits")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter()
+	for i, want := range []bool{false, false, true} {
+		if got := l.limited("a", 1, 1, 2); got != want {
+			t.Errorf("event %d: limited %v, want %v", i, got, want)
+		}
+	}
+	if l.limited("b", 1, 1, 2) {
+		t.Error("another key shares the bucket of the first one")
+	}
+
+	// a token is given back per interval, at the current rate
+	l.buckets["a"].refilledAt = l.buckets["a"].refilledAt.Add(-time.Minute)
+	if l.limited("a", 1, 1, 2) || !l.limited("a", 1, 1, 2) {
+		t.Error("the bucket wasn't refilled after an interval")
+	}
+	l.buckets["a"].refilledAt = l.buckets["a"].refilledAt.Add(-time.Minute)
+	if l.limited("a", 2, 1, 2) || l.limited("a", 2, 1, 2) {
+		t.Error("the bucket wasn't refilled at the new rate")
+	}
+
+	// the buckets refilled entirely are forgotten
+	l.pruned = l.pruned.Add(-time.Minute)
+	l.buckets["b"].refilledAt = l.buckets["b"].refilledAt.Add(-time.Minute)
+	l.limited("a", 1, 1, 2)
+	if _, ok := l.buckets["b"]; ok {
+		t.Error("a full bucket wasn't forgotten")
+	}
+}
+
+func TestRelayLimitersWithLimits(t *testing.T) {
+	limiters := newRelayLimiters(RelayLimits{ConnectionRateLimiterInterval: 1, ConnectionRateLimiterMaxTokens: 1})
+	limiters.connection.limited("203.0.113.7", 0, 1, 1)
+
+	reloaded := limiters.withLimits(RelayLimits{ConnectionRateLimiterInterval: 1, ConnectionRateLimiterMaxTokens: 2})
+	if reloaded.connection != limiters.connection || reloaded.limits.ConnectionRateLimiterMaxTokens != 2 {
+		t.Error("a reload didn't keep the buckets with the new limits")
+	}
+}
+
+func TestLimiterIntervals(t *testing.T) {
+	l := newConfigLoader(exampleEnv(t, map[string]string{"INBOX_RELAY_CONNECTION_RATE_LIMITER_INTERVAL": "0"}))
+	cfg := l.load()
+	_, err := readRelaySpecs(&cfg, l)
+	if err == nil || !strings.Contains(err.Error(), "INBOX_RELAY_CONNECTION_RATE_LIMITER_INTERVAL must be positive") {
+		t.Errorf("readRelaySpecs() error = %v, want one about the interval of 0", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "limits.connection_rate_limiter_interval") {
+		t.Errorf("readRelaySpecs() error = %v, the variable is reported twice", err)
+	}
+}
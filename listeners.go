@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// certCheckInterval is how often the TLS certificate files are checked for a renewal.
+const certCheckInterval = 10 * time.Second
+
+// startRelayServer serves the relays on the TCP port, over TLS when a certificate is set, and on the Unix
+// socket. A single server handles every listener so they are shut down together.
+func startRelayServer() *http.Server {
+	// TRUSTED_PROXIES was checked with the rest of the configuration
+	trustedProxies, _ := parseIPList(config.TrustedProxies)
+	server := &http.Server{Handler: realIPHandler(trustedProxies, http.DefaultServeMux)}
+
+	if config.RelayPort != 0 {
+		addr := net.JoinHostPort(config.RelayBindAddress, strconv.Itoa(config.RelayPort))
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal("🚫 error starting server:", err)
+		}
+
+		if config.TLSCertFile != "" {
+			ln = listenTLS(ln)
+			log.Printf("🔒 listening at %s with TLS", addr)
+		} else {
+			log.Printf("🔗 listening at %s", addr)
+		}
+		serve(server, ln)
+	}
+
+	if config.RelayUnixSocket != "" {
+		ln, err := listenUnix(config.RelayUnixSocket)
+		if err != nil {
+			log.Fatal("🚫 error starting server:", err)
+		}
+		log.Printf("🔗 listening at unix:%s", config.RelayUnixSocket)
+		serve(server, ln)
+	}
+
+	return server
+}
+
+// listenTLS serves the certificate in TLS_CERT_FILE and TLS_KEY_FILE on ln.
+func listenTLS(ln net.Listener) net.Listener {
+	certs, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		log.Fatal("🚫 error loading TLS certificate:", err)
+	}
+	return tls.NewListener(ln, &tls.Config{
+		GetCertificate: certs.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		// websockets need HTTP/1.1
+		NextProtos: []string{"http/1.1"},
+	})
+}
+
+func serve(server *http.Server, ln net.Listener) {
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("🚫 error starting server:", err)
+		}
+	}()
+}
+
+// listenUnix replaces the socket left behind by a previous run, but never a regular file.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// the reverse proxy usually runs as another user, this gives it the same access as a local TCP port
+	if err := os.Chmod(path, 0666); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// startAdminServer serves /metrics, /healthz, /readyz and /reload on ADMIN_ADDRESS, a loopback address
+// apart from the relays.
+func startAdminServer() *http.Server {
+	if config.AdminAddress == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /healthz", healthzHandler)
+	mux.HandleFunc("GET /readyz", readyzHandler)
+	mux.HandleFunc("POST /reload", reloadHandler)
+	server := &http.Server{Addr: config.AdminAddress, Handler: mux}
+
+	go func() {
+		log.Printf("🛠️ serving admin routes at %s", config.AdminAddress)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("🚫 error starting admin server:", err)
+		}
+	}()
+	return server
+}
+
+// startReplicationServer serves the databases and blobs of every tenant to the replicas on REPLICATION_ADDRESS,
+// apart from the relays, over TLS when a certificate is set.
+func startReplicationServer() *http.Server {
+	if config.ReplicationAddress == "" {
+		return nil
+	}
+
+	// REPLICATION_ALLOWED_IPS was checked with the rest of the configuration
+	replicationAllowedIPs, _ = parseIPList(config.ReplicationAllowedIPs)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+replicationPath+"/blobs/{sha256}", replicationBlobHandler)
+	mux.HandleFunc("GET "+replicationPath+"/lists/{relay}", replicationListsHandler)
+	mux.HandleFunc("GET "+replicationPath+"/{db}", replicationHandler)
+	server := &http.Server{Handler: mux}
+
+	ln, err := net.Listen("tcp", config.ReplicationAddress)
+	if err != nil {
+		log.Fatal("🚫 error starting replication server:", err)
+	}
+	if config.TLSCertFile != "" {
+		ln = listenTLS(ln)
+		log.Printf("🪞 serving replication at %s with TLS", config.ReplicationAddress)
+	} else {
+		log.Printf("🪞 serving replication at %s", config.ReplicationAddress)
+	}
+	serve(server, ln)
+	return server
+}
+
+// certReloader serves the certificate in TLS_CERT_FILE and TLS_KEY_FILE and loads it again when the files
+// change, so renewed certificates are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) > certCheckInterval {
+		if err := c.reloadIfChanged(); err != nil {
+			log.Println("🚫 error reloading TLS certificate, keeping the current one:", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// reloadIfChanged must be called with the lock held, or before the reloader is shared.
+func (c *certReloader) reloadIfChanged() error {
+	c.checked = time.Now()
+
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return nil
+	}
+
+	// while a renewal is half written the pair doesn't match, it is retried on the next check
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if c.cert != nil {
+		log.Println("🔐 TLS certificate reloaded")
+	}
+	c.cert = &cert
+	c.certMod = certInfo.ModTime()
+	c.keyMod = keyInfo.ModTime()
+	return nil
+}
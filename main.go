@@ -9,8 +9,9 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/fiatjaf/khatru"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/spf13/afero"
 
@@ -19,11 +20,24 @@ import (
 
 var (
 	pool   *nostr.SimplePool
-	config = loadConfig()
+	config Config
 	fs     afero.Fs
 )
 
 func main() {
+	// these commands work without a valid configuration
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "help", "-h", "--help":
+			printUsage()
+			return
+		case "config":
+			runConfig()
+			return
+		}
+	}
+
+	config = loadConfig()
 	defer log.Println("🔌 HAVEN is shutting down")
 
 	nostr.InfoLogger = log.New(io.Discard, "", 0)
@@ -37,93 +51,122 @@ func main() {
 	defer cancel()
 
 	fs = afero.NewOsFs()
-	if err := fs.MkdirAll(config.BlossomPath, 0755); err != nil {
-		log.Fatal("🚫 error creating blossom path:", err)
+
+	// the replica running on the same databases holds their locks
+	if len(os.Args) > 1 && os.Args[1] == "promote" {
+		runPromote()
+		return
 	}
+	initReplicationRole()
 
 	pool = nostr.NewSimplePool(mainCtx, nostr.WithPenaltyBox())
 
-	ensureImportRelays()
-
-	wotModel := wot.NewSimpleInMemory(
-		pool,
-		config.OwnerNpubKey,
-		config.ImportSeedRelays,
-		config.WotDepth,
-		config.WotMinimumFollowers,
-		config.WotFetchTimeoutSeconds,
-	)
-	wot.Initialize(mainCtx, wotModel)
-
-	initRelays(mainCtx)
+	tenants = loadTenants()
+	for _, t := range tenants {
+		t.ensureImportRelays()
+
+		t.wot = wot.NewSimpleInMemory(
+			pool,
+			t.config().OwnerNpubKey,
+			t.config().ImportSeedRelays,
+			t.config().WotDepth,
+			t.config().WotMinimumFollowers,
+			t.config().WotFetchTimeoutSeconds,
+		)
+		t.instrumentWoT()
+
+		t.initRelays(mainCtx)
+	}
 
 	if len(os.Args) > 1 {
+		command := true
 		switch os.Args[1] {
 		case "backup":
 			runBackup(mainCtx)
-			return
 		case "restore":
 			runRestore(mainCtx)
-			return
 		case "import":
+			for _, t := range tenants {
+				t.initWoT(mainCtx)
+			}
 			runImport(mainCtx)
-			return
-		case "help":
-			fmt.Println("usage: haven [backup|restore|import|help]")
-			fmt.Println("  backup  - backup the database")
-			fmt.Println("  restore - restore the database")
-			fmt.Println("  import  - import notes from seed relays")
-			fmt.Println("  help    - show this help message")
-			return
+		case "reindex":
+			runReindex(mainCtx)
+		default:
+			command = false
 		}
-
-		if os.Args[1] == "-h" || os.Args[1] == "--help" {
-			fmt.Println("usage: haven [backup|restore|import|help]")
-			fmt.Println("  backup  - backup the database")
-			fmt.Println("  restore - restore the database")
-			fmt.Println("  import  - import notes from seed relays")
-			fmt.Println("  help    - show this help message")
+		if command {
+			// the search indexes persist their writes in the background, they are flushed when closed
+			for _, t := range tenants {
+				t.closeDBs()
+			}
 			return
 		}
 	}
 
 	flag.Parse()
 
-	go func() {
-		go subscribeInboxAndChat(mainCtx)
-		go startPeriodicCloudBackups(mainCtx)
-		go wot.PeriodicRefresh(mainCtx, config.WotRefreshInterval)
-	}()
+	// The pool stays up on mainCtx until the end so pending blasts can still publish
+	signalCtx, stop := signal.NotifyContext(mainCtx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The WoT is built while the relays already serve, /readyz fails and WoT members are told to retry until
+	// it is done
+	for _, t := range tenants {
+		go func() {
+			t.initWoT(signalCtx)
+			t.startPulling(signalCtx)
+			wot.PeriodicRefreshModel(signalCtx, t.wot, t.config().WotRefreshInterval)
+		}()
+	}
+	background.Go(func() { startPeriodicCloudBackups(signalCtx) })
+	background.Go(func() { startExpirationSweeper(signalCtx) })
+	background.Go(func() { startReplication(signalCtx) })
+	go watchReloadSignal(signalCtx)
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("templates/static"))))
+	http.HandleFunc("GET /healthz", publicHealthHandler(false))
+	http.HandleFunc("GET /readyz", publicHealthHandler(true))
 	http.HandleFunc("/", dynamicRelayHandler)
 
-	addr := fmt.Sprintf("%s:%d", config.RelayBindAddress, config.RelayPort)
+	server := startRelayServer()
+	replicationServer := startReplicationServer()
+	adminServer := startAdminServer()
 
-	log.Printf("🔗 listening at %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatal("🚫 error starting server:", err)
-	}
+	<-signalCtx.Done()
+	shutdown(server, replicationServer, adminServer)
+}
+
+func printUsage() {
+	fmt.Println("usage: haven [backup|restore|import|reindex|promote|config|help]")
+	fmt.Println("  backup          - backup the database")
+	fmt.Println("  restore         - restore the database")
+	fmt.Println("  import          - import notes from seed relays")
+	fmt.Println("  reindex         - rebuild the search indexes from the databases")
+	fmt.Println("  promote         - turn a replica into a primary")
+	fmt.Println("  config validate - report every problem of the configuration")
+	fmt.Println("  config print    - print the effective configuration, secrets redacted")
+	fmt.Println("  help            - show this help message")
 }
 
 func dynamicRelayHandler(w http.ResponseWriter, r *http.Request) {
-	var relay *khatru.Relay
-	relayType := r.URL.Path
-
-	switch relayType {
-	case "/private":
-		relay = privateRelay
-	case "/chat":
-		relay = chatRelay
-	case "/inbox":
-		relay = inboxRelay
-	case "":
-		relay = outboxRelay
-	default:
-		relay = outboxRelay
+	t := tenantForHost(r.Host)
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	relay := t.relayForPath(r.URL.Path)
+	if relay == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !relay.allowsIP(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
 	}
 
-	relay.ServeHTTP(w, r)
+	relay.relay.ServeHTTP(w, r)
 }
 
 func getLogLevelFromConfig() slog.Level {
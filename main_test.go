@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/badger"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestMain(m *testing.M) {
+	fs = afero.NewMemMapFs()
+	os.Exit(m.Run())
+}
+
+// testWoT is a fixed web of trust.
+type testWoT map[string]bool
+
+func (w testWoT) Has(_ context.Context, pubkey string) bool {
+	return w[pubkey]
+}
+
+// newTestTenant returns a tenant owned by owner with the given WoT, and a chat relay without groups.
+func newTestTenant(t *testing.T, owner string, wot testWoT) *Tenant {
+	t.Helper()
+
+	tenant := &Tenant{dbPath: t.TempDir(), wot: wot}
+	tenant.cfg.Store(&Config{OwnerNpubKey: owner})
+	tenant.wotReady.Store(true)
+	tenant.chat = tenant.newTestRelay(RelaySpec{Name: "chat", Role: roleChat, Read: readChat})
+	return tenant
+}
+
+func (t *Tenant) newTestRelay(spec RelaySpec) *TenantRelay {
+	r := &TenantRelay{spec: spec, relay: khatru.NewRelay()}
+	r.management = t.loadRelayManagement(spec.Name)
+	t.relays = append(t.relays, r)
+	return r
+}
+
+// newTestStoredRelay adds a relay with its own database and tombstones to tenant.
+func newTestStoredRelay(t *testing.T, tenant *Tenant, spec RelaySpec) *TenantRelay {
+	t.Helper()
+
+	r := tenant.newTestRelay(spec)
+	r.db = newTestDB(t)
+	r.tombstones = tenant.loadTombstones(context.Background(), spec.Name, r.db)
+	return r
+}
+
+// authedContext is the context of a connection authenticated as pubkey. khatru keeps the connection under
+// the untyped constant 0.
+func authedContext(pubkey string) context.Context {
+	return context.WithValue(context.Background(), 0, &khatru.WebSocket{AuthedPublicKey: pubkey})
+}
+
+func testPubkey() string {
+	pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	return pubkey
+}
+
+// newTestDB opens an empty database removed with the test.
+func newTestDB(t *testing.T) DBBackend {
+	t.Helper()
+
+	db := &badger.BadgerBackend{Path: t.TempDir()}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
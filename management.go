@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+	"github.com/spf13/afero"
+)
+
+// RelayManagement holds the ban and allow lists managed through the NIP-86 API of a relay. They are
+// persisted as JSON so they survive restarts.
+type RelayManagement struct {
+	mu    sync.RWMutex
+	dir   string
+	path  string
+	owner string
+
+	BannedPubkeys  map[string]string `json:"banned_pubkeys"`
+	AllowedPubkeys map[string]string `json:"allowed_pubkeys"`
+	BannedEvents   map[string]string `json:"banned_events"`
+	RelayName      string            `json:"relay_name,omitempty"`
+}
+
+func (t *Tenant) loadRelayManagement(name string) *RelayManagement {
+	dir := filepath.Join(t.dbPath, "management")
+	m := &RelayManagement{
+		dir:            dir,
+		path:           filepath.Join(dir, name+".json"),
+		owner:          t.config().OwnerNpubKey,
+		BannedPubkeys:  make(map[string]string),
+		AllowedPubkeys: make(map[string]string),
+		BannedEvents:   make(map[string]string),
+	}
+
+	data, err := afero.ReadFile(fs, m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m
+	} else if err != nil {
+		log.Fatalf("🚫 error reading %s: %s", m.path, err)
+	}
+
+	if err := json.Unmarshal(data, m); err != nil {
+		log.Fatalf("🚫 error parsing %s: %s", m.path, err)
+	}
+	return m
+}
+
+// save must be called with the write lock held.
+func (m *RelayManagement) save() error {
+	if err := fs.MkdirAll(m.dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, data)
+}
+
+func (m *RelayManagement) isPubkeyBanned(pubkey string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, banned := m.BannedPubkeys[pubkey]
+	return banned
+}
+
+func (m *RelayManagement) isPubkeyAllowed(pubkey string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, allowed := m.AllowedPubkeys[pubkey]
+	return allowed
+}
+
+func (m *RelayManagement) isEventBanned(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, banned := m.BannedEvents[id]
+	return banned
+}
+
+// rejectEvent is the first policy of every relay, it refuses banned pubkeys and events.
+func (m *RelayManagement) rejectEvent(_ context.Context, event *nostr.Event) (bool, string) {
+	if m.isPubkeyBanned(event.PubKey) {
+		return true, "blocked: you are banned from this relay"
+	}
+	if m.isEventBanned(event.ID) {
+		return true, "blocked: this event has been banned from this relay"
+	}
+	return false, ""
+}
+
+func (m *RelayManagement) banPubkey(pubkey string, reason string) error {
+	if !nostr.IsValid32ByteHex(pubkey) {
+		return fmt.Errorf("invalid pubkey %q, it must be 32 bytes of lowercase hex", pubkey)
+	}
+	if pubkey == m.owner {
+		return fmt.Errorf("the relay owner can't be banned")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.AllowedPubkeys, pubkey)
+	m.BannedPubkeys[pubkey] = reason
+	return m.save()
+}
+
+func (m *RelayManagement) allowPubkey(pubkey string, reason string) error {
+	if !nostr.IsValid32ByteHex(pubkey) {
+		return fmt.Errorf("invalid pubkey %q, it must be 32 bytes of lowercase hex", pubkey)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.BannedPubkeys, pubkey)
+	m.AllowedPubkeys[pubkey] = reason
+	return m.save()
+}
+
+func (m *RelayManagement) banEvent(id string, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.BannedEvents[id] = reason
+	return m.save()
+}
+
+func (m *RelayManagement) setRelayName(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.RelayName = name
+	return m.save()
+}
+
+func (m *RelayManagement) relayName() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.RelayName
+}
+
+// replace takes over the lists of the primary on a replica, and reports whether they changed.
+func (m *RelayManagement) replace(from *RelayManagement) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if maps.Equal(m.BannedPubkeys, from.BannedPubkeys) && maps.Equal(m.AllowedPubkeys, from.AllowedPubkeys) &&
+		maps.Equal(m.BannedEvents, from.BannedEvents) && m.RelayName == from.RelayName {
+		return false, nil
+	}
+	m.BannedPubkeys, m.AllowedPubkeys, m.BannedEvents = from.BannedPubkeys, from.AllowedPubkeys, from.BannedEvents
+	m.RelayName = from.RelayName
+	if m.BannedPubkeys == nil {
+		m.BannedPubkeys = make(map[string]string)
+	}
+	if m.AllowedPubkeys == nil {
+		m.AllowedPubkeys = make(map[string]string)
+	}
+	if m.BannedEvents == nil {
+		m.BannedEvents = make(map[string]string)
+	}
+	return true, m.save()
+}
+
+func (m *RelayManagement) listBanned() []nip86.PubKeyReason {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return pubkeyReasons(m.BannedPubkeys)
+}
+
+func (m *RelayManagement) listAllowed() []nip86.PubKeyReason {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return pubkeyReasons(m.AllowedPubkeys)
+}
+
+// pubkeyReasons must be called with the lock held, replace swaps the lists.
+func pubkeyReasons(list map[string]string) []nip86.PubKeyReason {
+	result := make([]nip86.PubKeyReason, 0, len(list))
+	for pubkey, reason := range list {
+		result = append(result, nip86.PubKeyReason{PubKey: pubkey, Reason: reason})
+	}
+	return result
+}
+
+// setup exposes the NIP-86 management API of a relay to the owner, authenticated with NIP-98.
+func (m *RelayManagement) setup(relay *khatru.Relay, db DBBackend) {
+	if m.RelayName != "" {
+		relay.Info.Name = m.RelayName
+	}
+
+	relay.RejectEvent = append([]func(context.Context, *nostr.Event) (bool, string){m.rejectEvent}, relay.RejectEvent...)
+
+	relay.ManagementAPI.RejectAPICall = append(relay.ManagementAPI.RejectAPICall, func(ctx context.Context, mp nip86.MethodParams) (bool, string) {
+		if khatru.GetAuthed(ctx) != m.owner {
+			return true, "unauthorized: only the relay owner can manage this relay"
+		}
+		slog.Info("🛠️ management API call", "relay", relay.Info.Name, "method", mp.MethodName())
+		return false, ""
+	})
+
+	relay.ManagementAPI.BanPubKey = func(ctx context.Context, pubkey string, reason string) error {
+		return m.banPubkey(pubkey, reason)
+	}
+	relay.ManagementAPI.AllowPubKey = func(ctx context.Context, pubkey string, reason string) error {
+		return m.allowPubkey(pubkey, reason)
+	}
+	relay.ManagementAPI.ListBannedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
+		return m.listBanned(), nil
+	}
+	relay.ManagementAPI.ListAllowedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
+		return m.listAllowed(), nil
+	}
+	relay.ManagementAPI.BanEvent = func(ctx context.Context, id string, reason string) error {
+		if err := m.banEvent(id, reason); err != nil {
+			return err
+		}
+
+		events, err := db.QueryEvents(ctx, nostr.Filter{IDs: []string{id}})
+		if err != nil {
+			return err
+		}
+		var toDelete []*nostr.Event
+		for evt := range events {
+			toDelete = append(toDelete, evt)
+		}
+		for _, evt := range toDelete {
+			if err := db.DeleteEvent(ctx, evt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	relay.ManagementAPI.ListBannedEvents = func(ctx context.Context) ([]nip86.IDReason, error) {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		result := make([]nip86.IDReason, 0, len(m.BannedEvents))
+		for id, reason := range m.BannedEvents {
+			result = append(result, nip86.IDReason{ID: id, Reason: reason})
+		}
+		return result, nil
+	}
+	relay.ManagementAPI.ChangeRelayName = func(ctx context.Context, name string) error {
+		if err := m.setRelayName(name); err != nil {
+			return err
+		}
+		setRelayInfoName(relay, name)
+		return nil
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestManagementPubkeyLists(t *testing.T) {
+	owner, banned, allowed := testPubkey(), testPubkey(), testPubkey()
+	tenant := newTestTenant(t, owner, testWoT{})
+	m := tenant.loadRelayManagement("private")
+
+	for _, pubkey := range []string{"npub1", strings.ToUpper(banned), banned[:62]} {
+		if err := m.banPubkey(pubkey, "spam"); err == nil {
+			t.Errorf("banPubkey(%q) succeeded", pubkey)
+		}
+		if err := m.allowPubkey(pubkey, ""); err == nil {
+			t.Errorf("allowPubkey(%q) succeeded", pubkey)
+		}
+	}
+	if err := m.banPubkey(owner, "spam"); err == nil {
+		t.Error("the owner was banned")
+	}
+
+	if err := m.banPubkey(banned, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.allowPubkey(allowed, "friend"); err != nil {
+		t.Fatal(err)
+	}
+	if list := m.listBanned(); len(list) != 1 || list[0].PubKey != banned || list[0].Reason != "spam" {
+		t.Errorf("listBanned() = %v, want %s banned for spam", list, banned)
+	}
+	if list := m.listAllowed(); len(list) != 1 || list[0].PubKey != allowed {
+		t.Errorf("listAllowed() = %v, want %s", list, allowed)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+
+	"github.com/bitvora/haven/wot"
+)
+
+// Every metric has a tenant label, it is empty when HAVEN runs a single tenant.
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	eventsAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "haven_events_accepted_total",
+		Help: "Events accepted by a relay.",
+	}, []string{"tenant", "relay"})
+
+	eventsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "haven_events_rejected_total",
+		Help: "Events rejected by a relay, by reason.",
+	}, []string{"tenant", "relay", "reason"})
+
+	openConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haven_connections",
+		Help: "Open websocket connections to a relay.",
+	}, []string{"tenant", "relay"})
+
+	blasts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "haven_blasts_total",
+		Help: "Events blasted to other relays, by target relay and result.",
+	}, []string{"tenant", "target", "result"})
+
+	lastBackupTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haven_backup_last_timestamp_seconds",
+		Help: "Time the last periodic backup finished.",
+	}, []string{"tenant"})
+
+	lastBackupSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haven_backup_last_success",
+		Help: "1 if the last periodic backup succeeded, 0 otherwise.",
+	}, []string{"tenant"})
+
+	lastBackupDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haven_backup_last_duration_seconds",
+		Help: "Duration of the last periodic backup.",
+	}, []string{"tenant"})
+
+	inboxEventsImported = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "haven_inbox_events_imported_total",
+		Help: "Events pulled from the import seed relays, by the relay they were stored in.",
+	}, []string{"tenant", "relay"})
+
+	expiredEventsDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "haven_expired_events_deleted_total",
+		Help: "Events deleted by the expiration sweeper, by relay.",
+	}, []string{"tenant", "relay"})
+
+	replicatedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "haven_replication_events_total",
+		Help: "Events a replica fetched from or deleted to match its primary, by database.",
+	}, []string{"tenant", "db", "op"})
+
+	replicatedBlobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "haven_replication_blobs_fetched_total",
+		Help: "Blobs a replica downloaded from its primary.",
+	}, []string{"tenant"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		eventsAccepted,
+		eventsRejected,
+		openConnections,
+		blasts,
+		lastBackupTimestamp,
+		lastBackupSuccess,
+		lastBackupDuration,
+		inboxEventsImported,
+		expiredEventsDeleted,
+		replicatedEvents,
+		replicatedBlobs,
+	)
+}
+
+// instrumentRelay counts the accepted and rejected events and the connections and subscriptions of a
+// relay. It must be called once every RejectEvent policy is in place.
+func (t *Tenant) instrumentRelay(r *TenantRelay) {
+	relay := r.relay
+	name := r.spec.Name
+
+	for i, reject := range relay.RejectEvent {
+		relay.RejectEvent[i] = func(ctx context.Context, event *nostr.Event) (bool, string) {
+			rejected, msg := reject(ctx, event)
+			if rejected {
+				eventsRejected.WithLabelValues(t.Host, name, rejectReason(msg)).Inc()
+			}
+			return rejected, msg
+		}
+	}
+
+	accepted := eventsAccepted.WithLabelValues(t.Host, name)
+	relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, event *nostr.Event) {
+		accepted.Inc()
+	})
+	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, func(ctx context.Context, event *nostr.Event) {
+		accepted.Inc()
+	})
+
+	connected := openConnections.WithLabelValues(t.Host, name)
+	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+		connected.Inc()
+	})
+	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+		connected.Dec()
+	})
+
+	metricsRegistry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "haven_subscription_filters",
+		Help:        "Filters of the open subscriptions of a relay.",
+		ConstLabels: prometheus.Labels{"tenant": t.Host, "relay": name},
+	}, func() float64 {
+		return float64(len(relay.GetListeningFilters()))
+	}))
+}
+
+// instrumentWoT exposes the size of the WoT of a tenant and how long its last refresh took.
+func (t *Tenant) instrumentWoT() {
+	stats, ok := t.wot.(wot.Stats)
+	if !ok {
+		return
+	}
+
+	labels := prometheus.Labels{"tenant": t.Host}
+	metricsRegistry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "haven_wot_size",
+			Help:        "Pubkeys in the Web of Trust.",
+			ConstLabels: labels,
+		}, func() float64 {
+			return float64(stats.Size())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "haven_wot_last_refresh_duration_seconds",
+			Help:        "Duration of the last Web of Trust refresh.",
+			ConstLabels: labels,
+		}, func() float64 {
+			return stats.LastRefreshDuration().Seconds()
+		}),
+	)
+}
+
+func observeBackup(t *Tenant, start time.Time, err error) {
+	lastBackupTimestamp.WithLabelValues(t.Host).SetToCurrentTime()
+	lastBackupDuration.WithLabelValues(t.Host).Set(time.Since(start).Seconds())
+	if err != nil {
+		lastBackupSuccess.WithLabelValues(t.Host).Set(0)
+	} else {
+		lastBackupSuccess.WithLabelValues(t.Host).Set(1)
+	}
+}
+
+// rejectReason keeps the NIP-01 machine-readable prefix of a reject message, so reasons that include
+// kinds or IDs don't create a label value per event. Messages without a prefix are kept whole.
+func rejectReason(msg string) string {
+	if prefix, _, found := strings.Cut(msg, ": "); found && !strings.Contains(prefix, " ") {
+		return prefix
+	}
+	return msg
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/fiatjaf/eventstore/badger"
+	"github.com/fiatjaf/eventstore/lmdb"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// baseSupportedNIPs are implemented by every relay: khatru handles deletions, expiration, auth, counts,
+// negentropy syncs and protected events, HAVEN adds requests to vanish and the management API.
+var baseSupportedNIPs = []int{1, 9, 11, 40, 42, 45, 62, 70, 77, 86}
+
+// describeRelay fills the supported_nips and limitation of a NIP-11 document from the spec of a relay, so
+// clients can discover its actual policies. doc must not be shared yet.
+func (t *Tenant) describeRelay(r *TenantRelay, doc *nip11.RelayInformationDocument, spec RelaySpec) {
+	nips := slices.Clone(baseSupportedNIPs)
+	if spec.Role == roleChat {
+		// gift wrapped DMs
+		nips = append(nips, 17, 59)
+		if t.chatGroups != nil {
+			nips = append(nips, 29)
+		}
+	}
+	if spec.Search {
+		nips = append(nips, 50)
+	}
+	slices.Sort(nips)
+	doc.SupportedNIPs = make([]any, len(nips))
+	for i, nip := range nips {
+		doc.SupportedNIPs[i] = nip
+	}
+
+	maxMessageLength := int(r.relay.MaxMessageSize)
+	if spec.Limits.MaxEventSize > 0 {
+		maxMessageLength = min(maxMessageLength, spec.Limits.MaxEventSize+len(`["EVENT",]`))
+	}
+	maxLimit := r.maxLimit(spec.Limits)
+	defaultLimit := dbMaxLimit(r.db) / 4
+	if spec.Limits.DefaultLimit > 0 {
+		defaultLimit = spec.Limits.DefaultLimit
+	}
+	doc.Limitation = &nip11.RelayLimitationDocument{
+		MaxMessageLength:    maxMessageLength,
+		MaxSubscriptions:    spec.Limits.MaxSubscriptions,
+		MaxLimit:            maxLimit,
+		DefaultLimit:        min(defaultLimit, maxLimit),
+		MaxEventTags:        spec.Limits.MaxEventTags,
+		MaxContentLength:    spec.Limits.MaxContentLength,
+		CreatedAtLowerLimit: int64(spec.Limits.CreatedAtLowerLimit),
+		CreatedAtUpperLimit: int64(spec.Limits.CreatedAtUpperLimit),
+		AuthRequired:        spec.AuthRequired,
+		RestrictedWrites:    len(spec.Write) > 0 || len(spec.AllowedKinds) > 0 || len(spec.DeniedKinds) > 0,
+	}
+}
+
+// dbMaxLimit is the largest limit the backend honors once it is initialized, a larger limit or none at all
+// gets a quarter of it.
+func dbMaxLimit(db DBBackend) int {
+	switch db := db.(type) {
+	case *lmdb.LMDBBackend:
+		return db.MaxLimit
+	case *badger.BadgerBackend:
+		return db.MaxLimit
+	}
+	return 0
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// RelaySpec declares one relay served by a tenant. Without RELAYS_FILE the tenant serves the four
+// default relays (private, chat, outbox and inbox) configured by .env. See docs/relays.md.
+type RelaySpec struct {
+	Name         string        `json:"name"`
+	Role         string        `json:"role,omitempty"`
+	Path         string        `json:"path"`
+	DBPath       string        `json:"db_path,omitempty"`
+	Info         RelayInfoSpec `json:"info"`
+	AuthRequired bool          `json:"auth_required"`
+	Write        []string      `json:"write"`
+	AllowedKinds KindList      `json:"allowed_kinds,omitempty"`
+	DeniedKinds  KindList      `json:"denied_kinds,omitempty"`
+	IPAllow      []string      `json:"ip_allow,omitempty"`
+	IPDeny       []string      `json:"ip_deny,omitempty"`
+	Read         string        `json:"read"`
+	Limits       RelayLimits   `json:"limits"`
+	Blastr       bool          `json:"blastr"`
+	Blossom      bool          `json:"blossom"`
+	Search       bool          `json:"search"`
+}
+
+type RelayInfoSpec struct {
+	Name        string `json:"name"`
+	Npub        string `json:"npub"`
+	Description string `json:"description"`
+	Icon        string `json:"icon"`
+}
+
+// TenantRelay is a relay built from a RelaySpec.
+type TenantRelay struct {
+	spec       RelaySpec
+	relay      *khatru.Relay
+	db         DBBackend
+	management *RelayManagement
+	tombstones *Tombstones
+	search     *SearchIndex
+	limiters   atomic.Pointer[relayLimiters]
+	ipRules    atomic.Pointer[ipRules]
+	clients    *clientTracker
+}
+
+// store is the database of the relay for every write, it keeps deleted events out and the search index up
+// to date.
+func (r *TenantRelay) store() tombstoneStore {
+	return tombstoneStore{DBBackend: r.indexed(), tombstones: r.tombstones}
+}
+
+// indexed is the database of the relay with its search index, if it has one.
+func (r *TenantRelay) indexed() DBBackend {
+	if r.search == nil {
+		return r.db
+	}
+	return searchStore{DBBackend: r.db, index: r.search}
+}
+
+// Roles tie a relay to the features that need to find it: imports write tagged notes to the inbox, gift
+// wraps to the chat relay (which also hosts the groups) and owner notes to the outbox.
+const (
+	roleChat   = "chat"
+	roleInbox  = "inbox"
+	roleOutbox = "outbox"
+)
+
+const (
+	writeOwner       = "owner"
+	writeAuthedOwner = "authed-owner"
+	writeWoT         = "wot"
+	writeTaggedOwner = "tagged-owner"
+	writeNoNIP04     = "no-nip04"
+	writeChat        = "chat"
+)
+
+const (
+	readPublic      = "public"
+	readAuthed      = "authed"
+	readAuthedOwner = "authed-owner"
+	readWoT         = "wot"
+	readChat        = "chat"
+)
+
+var (
+	relayRoles    = []string{roleChat, roleInbox, roleOutbox}
+	writePolicies = []string{writeOwner, writeAuthedOwner, writeWoT, writeTaggedOwner, writeNoNIP04, writeChat}
+	readPolicies  = []string{readPublic, readAuthed, readAuthedOwner, readWoT, readChat}
+)
+
+// loadRelaySpecs reads the relays file of the tenant, or returns the default relays.
+func (t *Tenant) loadRelaySpecs() []RelaySpec {
+	specs, err := readRelaySpecs(t.config(), newConfigLoader(t.env))
+	if err != nil {
+		log.Fatalf("🚫 %s", err)
+	}
+	return specs
+}
+
+// readRelaySpecs reads and validates the relays file of a configuration, or returns the default relays.
+// The default relays read their limits with l.
+func readRelaySpecs(cfg *Config, l *configLoader) ([]RelaySpec, error) {
+	if cfg.RelaysFile == "" {
+		n := len(l.problems)
+		specs := defaultRelaySpecs(cfg, l)
+		// the problems of the variables are reported once, not again for the relays they configure
+		err := l.errSince(n)
+		if err == nil {
+			err = validateRelaySpecs(specs)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay configuration:\n%w", err)
+		}
+		return specs, nil
+	}
+
+	file, err := os.ReadFile(cfg.RelaysFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read relays file: %w", err)
+	}
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(file, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse relays file: %w", err)
+	}
+
+	specs := make([]RelaySpec, 0, len(raw))
+	for _, r := range raw {
+		// limits not set in the file keep their defaults
+		spec := RelaySpec{Read: readPublic, Limits: defaultRelayLimits}
+		if err := json.Unmarshal(r, &spec); err != nil {
+			return nil, fmt.Errorf("failed to parse relays file: %w", err)
+		}
+		specs = append(specs, spec)
+	}
+
+	if err := validateRelaySpecs(specs); err != nil {
+		return nil, fmt.Errorf("invalid relays file %s:\n%w", cfg.RelaysFile, err)
+	}
+	return specs, nil
+}
+
+func defaultRelaySpecs(cfg *Config, l *configLoader) []RelaySpec {
+	return []RelaySpec{
+		{
+			Name: "private",
+			Path: "/private",
+			Info: RelayInfoSpec{
+				Name:        cfg.PrivateRelayName,
+				Npub:        cfg.PrivateRelayNpub,
+				Description: cfg.PrivateRelayDescription,
+				Icon:        cfg.PrivateRelayIcon,
+			},
+			AuthRequired: true,
+			Write:        []string{writeAuthedOwner},
+			Read:         readAuthedOwner,
+			AllowedKinds: l.getKindList("PRIVATE_RELAY_ALLOWED_KINDS", ""),
+			DeniedKinds:  l.getKindList("PRIVATE_RELAY_DENIED_KINDS", ""),
+			IPAllow:      l.getEnvList("PRIVATE_RELAY_IP_ALLOW", ""),
+			IPDeny:       l.getEnvList("PRIVATE_RELAY_IP_DENY", ""),
+			Limits:       l.privateRelayLimits(),
+			Search:       true,
+		},
+		{
+			Name: "chat",
+			Role: roleChat,
+			Path: "/chat",
+			Info: RelayInfoSpec{
+				Name:        cfg.ChatRelayName,
+				Npub:        cfg.ChatRelayNpub,
+				Description: cfg.ChatRelayDescription,
+				Icon:        cfg.ChatRelayIcon,
+			},
+			AuthRequired: true,
+			Write:        []string{writeChat},
+			AllowedKinds: l.getKindList("CHAT_RELAY_ALLOWED_KINDS", "chat"),
+			DeniedKinds:  l.getKindList("CHAT_RELAY_DENIED_KINDS", ""),
+			Read:         readChat,
+			IPAllow:      l.getEnvList("CHAT_RELAY_IP_ALLOW", ""),
+			IPDeny:       l.getEnvList("CHAT_RELAY_IP_DENY", ""),
+			Limits:       l.chatRelayLimits(),
+		},
+		{
+			Name: "outbox",
+			Role: roleOutbox,
+			Path: "/",
+			Info: RelayInfoSpec{
+				Name:        cfg.OutboxRelayName,
+				Npub:        cfg.OutboxRelayNpub,
+				Description: cfg.OutboxRelayDescription,
+				Icon:        cfg.OutboxRelayIcon,
+			},
+			Write:        []string{writeOwner},
+			Read:         readPublic,
+			AllowedKinds: l.getKindList("OUTBOX_RELAY_ALLOWED_KINDS", ""),
+			DeniedKinds:  l.getKindList("OUTBOX_RELAY_DENIED_KINDS", ""),
+			IPAllow:      l.getEnvList("OUTBOX_RELAY_IP_ALLOW", ""),
+			IPDeny:       l.getEnvList("OUTBOX_RELAY_IP_DENY", ""),
+			Limits:       l.outboxRelayLimits(),
+			Blastr:       true,
+			Blossom:      true,
+			Search:       true,
+		},
+		{
+			Name: "inbox",
+			Role: roleInbox,
+			Path: "/inbox",
+			Info: RelayInfoSpec{
+				Name:        cfg.InboxRelayName,
+				Npub:        cfg.InboxRelayNpub,
+				Description: cfg.InboxRelayDescription,
+				Icon:        cfg.InboxRelayIcon,
+			},
+			Write:        []string{writeWoT, writeNoNIP04, writeTaggedOwner},
+			Read:         readPublic,
+			AllowedKinds: l.getKindList("INBOX_RELAY_ALLOWED_KINDS", ""),
+			DeniedKinds:  l.getKindList("INBOX_RELAY_DENIED_KINDS", ""),
+			IPAllow:      l.getEnvList("INBOX_RELAY_IP_ALLOW", ""),
+			IPDeny:       l.getEnvList("INBOX_RELAY_IP_DENY", ""),
+			Limits:       l.inboxRelayLimits(),
+		},
+	}
+}
+
+// reservedRelayNames are taken by the other databases of a tenant.
+var reservedRelayNames = []string{"blossom", "management", "tombstones", "search"}
+
+// reservedRelayPaths are the health checks served on the relay port.
+var reservedRelayPaths = []string{"/healthz", "/readyz"}
+
+// validateRelaySpecs reports every problem of the specs at once.
+func validateRelaySpecs(specs []RelaySpec) error {
+	if len(specs) == 0 {
+		return fmt.Errorf("no relays defined")
+	}
+
+	var problems []error
+	problem := func(spec RelaySpec, format string, args ...any) {
+		problems = append(problems, fmt.Errorf("relay %s: %s", spec.Name, fmt.Sprintf(format, args...)))
+	}
+
+	names := make(map[string]bool)
+	paths := make(map[string]bool)
+	roles := make(map[string]bool)
+	blossom := false
+
+	for _, spec := range specs {
+		switch {
+		case spec.Name == "":
+			problems = append(problems, fmt.Errorf("every relay must have a name"))
+		case slices.Contains(reservedRelayNames, spec.Name) || strings.ContainsAny(spec.Name, `/\.`):
+			problem(spec, "invalid name")
+		case names[spec.Name]:
+			problem(spec, "duplicated name")
+		}
+		names[spec.Name] = true
+
+		switch {
+		case !strings.HasPrefix(spec.Path, "/"):
+			problem(spec, "path must start with /")
+		case paths[spec.Path]:
+			problem(spec, "path %s is already used", spec.Path)
+		case slices.Contains(reservedRelayPaths, spec.Path):
+			problem(spec, "path %s is reserved", spec.Path)
+		}
+		paths[spec.Path] = true
+
+		if spec.Role != "" {
+			if !slices.Contains(relayRoles, spec.Role) {
+				problem(spec, "unknown role %s", spec.Role)
+			} else if roles[spec.Role] {
+				problem(spec, "role %s is already used", spec.Role)
+			}
+			roles[spec.Role] = true
+		}
+
+		if spec.Info.Npub == "" {
+			problem(spec, "info.npub is required")
+		} else if prefix, _, err := nip19.Decode(spec.Info.Npub); err != nil || prefix != "npub" {
+			problem(spec, "invalid npub %s", spec.Info.Npub)
+		}
+
+		for _, policy := range spec.Write {
+			if !slices.Contains(writePolicies, policy) {
+				problem(spec, "unknown write policy %s", policy)
+			}
+		}
+		if !slices.Contains(readPolicies, spec.Read) {
+			problem(spec, "unknown read policy %s", spec.Read)
+		}
+		if (slices.Contains(spec.Write, writeChat) || spec.Read == readChat) && spec.Role != roleChat {
+			problem(spec, "chat policies require the chat role")
+		}
+
+		if _, err := parseIPList(spec.IPAllow); err != nil {
+			problem(spec, "ip_allow: %s", err)
+		}
+		if _, err := parseIPList(spec.IPDeny); err != nil {
+			problem(spec, "ip_deny: %s", err)
+		}
+
+		for _, name := range spec.Limits.intervalProblems() {
+			problem(spec, "limits.%s must be positive", name)
+		}
+
+		if spec.Search && spec.Role == roleChat {
+			problem(spec, "search is not available on the chat relay")
+		}
+
+		if spec.Blossom {
+			if blossom {
+				problem(spec, "only one relay can serve Blossom")
+			}
+			if spec.Path != "/" {
+				problem(spec, "Blossom must be served by the relay at /")
+			}
+			blossom = true
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+// relayForPath picks the relay serving a URL path, the relay at / serves every path without a relay of its own.
+func (t *Tenant) relayForPath(path string) *TenantRelay {
+	var root *TenantRelay
+	for _, r := range t.relays {
+		if r.spec.Path == path {
+			return r
+		}
+		if r.spec.Path == "/" {
+			root = r
+		}
+	}
+	return root
+}
+
+func (r *TenantRelay) wsURL(relayURL string) string {
+	return "wss://" + relayURL + strings.TrimSuffix(r.spec.Path, "/")
+}
+
+func (r *TenantRelay) serviceURL(relayURL string) string {
+	return "https://" + relayURL + strings.TrimSuffix(r.spec.Path, "/")
+}
+
+// isOwnerOrAllowed reports whether pubkey is the owner or was allowed through the management API. Allowed
+// pubkeys are let through the WoT checks only, the owner policies stay owner-only.
+func (t *Tenant) isOwnerOrAllowed(r *TenantRelay, pubkey string) bool {
+	return pubkey == t.config().OwnerNpubKey || r.management.isPubkeyAllowed(pubkey)
+}
+
+func (t *Tenant) writePolicy(r *TenantRelay, policy string) func(ctx context.Context, event *nostr.Event) (bool, string) {
+	switch policy {
+	case writeOwner:
+		return func(ctx context.Context, event *nostr.Event) (bool, string) {
+			if event.PubKey == t.config().OwnerNpubKey {
+				return false, ""
+			}
+			return true, "only notes signed by the owner of this relay are allowed"
+		}
+	case writeAuthedOwner:
+		return func(ctx context.Context, event *nostr.Event) (bool, string) {
+			if khatru.GetAuthed(ctx) == t.config().OwnerNpubKey {
+				return false, ""
+			}
+			return true, "auth-required: publishing this event requires authentication"
+		}
+	case writeWoT:
+		return func(ctx context.Context, event *nostr.Event) (bool, string) {
+			if t.wot.Has(ctx, event.PubKey) || t.isOwnerOrAllowed(r, event.PubKey) {
+				return false, ""
+			}
+			return true, t.notInWoT("you must be in the web of trust to post to this relay")
+		}
+	case writeTaggedOwner:
+		return func(ctx context.Context, event *nostr.Event) (bool, string) {
+			if event.Tags.FindWithValue("p", r.relay.Info.PubKey) != nil || event.Tags.FindWithValue("p", t.config().OwnerNpubKey) != nil {
+				return false, ""
+			}
+			return true, "you can only post notes if you've tagged the owner of this relay"
+		}
+	case writeNoNIP04:
+		return func(ctx context.Context, event *nostr.Event) (bool, string) {
+			if event.Kind == nostr.KindEncryptedDirectMessage {
+				return true, "only gift wrapped DMs are supported"
+			}
+			return false, ""
+		}
+	case writeChat:
+		return t.rejectChatEvent
+	}
+	return nil
+}
+
+func (t *Tenant) readPolicy(r *TenantRelay) func(ctx context.Context, filter nostr.Filter) (bool, string) {
+	switch r.spec.Read {
+	case readAuthed:
+		return func(ctx context.Context, filter nostr.Filter) (bool, string) {
+			if khatru.GetAuthed(ctx) == "" {
+				return true, "auth-required: this query requires you to be authenticated"
+			}
+			return false, ""
+		}
+	case readAuthedOwner:
+		return func(ctx context.Context, filter nostr.Filter) (bool, string) {
+			if khatru.GetAuthed(ctx) == t.config().OwnerNpubKey {
+				return false, ""
+			}
+			return true, "auth-required: this query requires you to be authenticated"
+		}
+	case readWoT:
+		return func(ctx context.Context, filter nostr.Filter) (bool, string) {
+			authenticatedUser := khatru.GetAuthed(ctx)
+			if authenticatedUser == "" {
+				return true, "auth-required: this query requires you to be authenticated"
+			}
+			if t.wot.Has(ctx, authenticatedUser) || t.isOwnerOrAllowed(r, authenticatedUser) {
+				return false, ""
+			}
+			return true, t.notInWoT("restricted: you must be in the web of trust to read from this relay")
+		}
+	case readChat:
+		return t.rejectChatFilter
+	}
+	return nil
+}
+
+// rejectLimitZero makes a read policy apply to limit:0 REQs too. khatru skips RejectFilter for them and only
+// subscribes them to new events, so a filter the policy refuses gets a limit again to be rejected like any other.
+func rejectLimitZero(reject func(ctx context.Context, filter nostr.Filter) (bool, string)) func(ctx context.Context, filter *nostr.Filter) {
+	return func(ctx context.Context, filter *nostr.Filter) {
+		if !filter.LimitZero {
+			return
+		}
+		if rejected, _ := reject(ctx, *filter); rejected {
+			filter.LimitZero = false
+		}
+	}
+}
+
+// rejectKind enforces the allowed_kinds and denied_kinds of a relay, an empty allow list allows every kind not
+// denied.
+func (r *TenantRelay) rejectKind(_ context.Context, event *nostr.Event) (bool, string) {
+	if r.spec.DeniedKinds.contains(event.Kind) ||
+		len(r.spec.AllowedKinds) != 0 && !r.spec.AllowedKinds.contains(event.Kind) {
+		return true, fmt.Sprintf("blocked: kind %d is not allowed on this relay", event.Kind)
+	}
+	return false, ""
+}
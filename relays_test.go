@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestPoliciesOfAllowedPubkeys(t *testing.T) {
+	owner, friend, allowed, stranger := testPubkey(), testPubkey(), testPubkey(), testPubkey()
+	tenant := newTestTenant(t, owner, testWoT{friend: true})
+	r := tenant.newTestRelay(RelaySpec{Name: "private"})
+	r.management.AllowedPubkeys[allowed] = ""
+
+	for _, tt := range []struct {
+		policy  string
+		allowed []string
+		denied  []string
+	}{
+		{writeOwner, []string{owner}, []string{allowed, friend, stranger}},
+		{writeAuthedOwner, []string{owner}, []string{allowed, friend, stranger}},
+		{writeWoT, []string{owner, allowed, friend}, []string{stranger}},
+	} {
+		write := tenant.writePolicy(r, tt.policy)
+		check := func(pubkey string, want bool) {
+			ctx := authedContext(pubkey)
+			if reject, msg := write(ctx, &nostr.Event{PubKey: pubkey}); reject == want {
+				t.Errorf("write policy %s: rejected %v %q, want %v", tt.policy, reject, msg, !want)
+			}
+		}
+		for _, pubkey := range tt.allowed {
+			check(pubkey, true)
+		}
+		for _, pubkey := range tt.denied {
+			check(pubkey, false)
+		}
+	}
+
+	for _, tt := range []struct {
+		read    string
+		allowed []string
+		denied  []string
+	}{
+		{readAuthedOwner, []string{owner}, []string{allowed, friend, stranger, ""}},
+		{readWoT, []string{owner, allowed, friend}, []string{stranger, ""}},
+		{readAuthed, []string{owner, stranger}, []string{""}},
+	} {
+		r.spec.Read = tt.read
+		read := tenant.readPolicy(r)
+		check := func(pubkey string, want bool) {
+			if reject, msg := read(authedContext(pubkey), nostr.Filter{}); reject == want {
+				t.Errorf("read policy %s for %q: rejected %v %q, want %v", tt.read, pubkey, reject, msg, !want)
+			}
+		}
+		for _, pubkey := range tt.allowed {
+			check(pubkey, true)
+		}
+		for _, pubkey := range tt.denied {
+			check(pubkey, false)
+		}
+	}
+}
+
+func TestWoTPoliciesWhileTheWoTLoads(t *testing.T) {
+	owner, friend := testPubkey(), testPubkey()
+	tenant := newTestTenant(t, owner, testWoT{})
+	tenant.wotReady.Store(false)
+	r := tenant.newTestRelay(RelaySpec{Name: "inbox", Write: []string{writeWoT}, Read: readWoT})
+
+	write := tenant.writePolicy(r, writeWoT)
+	if rejected, msg := write(context.Background(), &nostr.Event{PubKey: friend}); !rejected || !strings.HasPrefix(msg, "error: ") {
+		t.Errorf("write while the WoT loads = %v %q, want a retryable error", rejected, msg)
+	}
+	if rejected, msg := tenant.readPolicy(r)(authedContext(friend), nostr.Filter{}); !rejected || !strings.HasPrefix(msg, "error: ") {
+		t.Errorf("read while the WoT loads = %v %q, want a retryable error", rejected, msg)
+	}
+	if rejected, _ := write(context.Background(), &nostr.Event{PubKey: owner}); rejected {
+		t.Error("the owner is rejected while the WoT loads")
+	}
+
+	tenant.wotReady.Store(true)
+	if _, msg := write(context.Background(), &nostr.Event{PubKey: friend}); strings.HasPrefix(msg, "error: ") {
+		t.Errorf("write outside the built WoT = %q, want a final rejection", msg)
+	}
+}
+
+func TestValidateRelaySpecs(t *testing.T) {
+	npub, _ := nip19.EncodePublicKey(testPubkey())
+	valid := func(name string, path string) RelaySpec {
+		return RelaySpec{Name: name, Path: path, Info: RelayInfoSpec{Npub: npub}, Read: readPublic, Limits: defaultRelayLimits}
+	}
+	if err := validateRelaySpecs([]RelaySpec{valid("outbox", "/"), valid("private", "/private")}); err != nil {
+		t.Fatalf("valid specs: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(spec *RelaySpec)
+		want   string
+	}{
+		{"reserved name", func(s *RelaySpec) { s.Name = "search" }, "invalid name"},
+		{"name with a dot", func(s *RelaySpec) { s.Name = "a.b" }, "invalid name"},
+		{"duplicated name", func(s *RelaySpec) { s.Name = "outbox" }, "duplicated name"},
+		{"relative path", func(s *RelaySpec) { s.Path = "private" }, "path must start with /"},
+		{"duplicated path", func(s *RelaySpec) { s.Path = "/" }, "already used"},
+		{"reserved path", func(s *RelaySpec) { s.Path = "/healthz" }, "reserved"},
+		{"unknown role", func(s *RelaySpec) { s.Role = "archive" }, "unknown role"},
+		{"missing npub", func(s *RelaySpec) { s.Info.Npub = "" }, "info.npub is required"},
+		{"unknown write policy", func(s *RelaySpec) { s.Write = []string{"friends"} }, "unknown write policy"},
+		{"unknown read policy", func(s *RelaySpec) { s.Read = "friends" }, "unknown read policy"},
+		{"chat policy without the role", func(s *RelaySpec) { s.Read = readChat }, "chat policies require the chat role"},
+		{"invalid IP", func(s *RelaySpec) { s.IPDeny = []string{"10.0.0.0/33"} }, "ip_deny"},
+		{"search on the chat relay", func(s *RelaySpec) { s.Role, s.Search = roleChat, true }, "search is not available"},
+		{"limiter interval of 0", func(s *RelaySpec) { s.Limits.ConnectionRateLimiterInterval = 0 }, "limits.connection_rate_limiter_interval must be positive"},
+		{"Blossom away from /", func(s *RelaySpec) { s.Blossom = true }, "Blossom must be served by the relay at /"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := valid("private", "/private")
+			tt.change(&spec)
+			err := validateRelaySpecs([]RelaySpec{valid("outbox", "/"), spec})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("validateRelaySpecs() error = %v, want one about %q", err, tt.want)
+			}
+		})
+	}
+}
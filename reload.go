@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/joho/godotenv"
+
+	"github.com/bitvora/haven/wot"
+)
+
+// reloadMu serializes reloads, a SIGHUP and a POST /reload can arrive together.
+var reloadMu sync.Mutex
+
+// watchReloadSignal reloads the configuration on every SIGHUP until ctx is done.
+func watchReloadSignal(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Println("🔄 SIGHUP received, reloading configuration")
+			if err := reloadConfig(); err != nil {
+				log.Println("🚫", err)
+			}
+		}
+	}
+}
+
+// reloadHandler is the admin equivalent of a SIGHUP.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("🔄 reload requested, reloading configuration")
+	if err := reloadConfig(); err != nil {
+		log.Println("🚫", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	_, _ = w.Write([]byte("configuration reloaded\n"))
+}
+
+// reloadConfig re-reads .env, the tenant env files and the relay list files. Every tenant is validated
+// before any is changed, so a failed reload leaves the running configuration untouched.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	base, err := baseEnv()
+	if err != nil {
+		return fmt.Errorf("config reload failed: %w", err)
+	}
+
+	reloads := make([]*tenantReload, len(tenants))
+	for i, t := range tenants {
+		reloads[i], err = t.prepareReload(base)
+		if err != nil {
+			if t.Host != "" {
+				return fmt.Errorf("config reload failed for tenant %s: %w", t.Host, err)
+			}
+			return fmt.Errorf("config reload failed: %w", err)
+		}
+	}
+
+	for i, t := range tenants {
+		t.applyReload(reloads[i])
+	}
+	log.Println("✅ configuration reloaded")
+	return nil
+}
+
+// tenantReload is a validated configuration waiting to be applied to a tenant.
+type tenantReload struct {
+	env   envSource
+	cfg   *Config
+	specs map[string]RelaySpec
+}
+
+func (t *Tenant) prepareReload(base envSource) (*tenantReload, error) {
+	env := base
+	if t.Host != "" {
+		vars := map[string]string{}
+		if t.envFile != "" {
+			var err error
+			if vars, err = godotenv.Read(t.envFile); err != nil {
+				return nil, fmt.Errorf("can't read %s: %w", t.envFile, err)
+			}
+		}
+		env = tenantEnv(vars, base, t.dbPath)
+	}
+
+	l := newConfigLoader(env)
+	cfg := l.load()
+	if err := l.err(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	current := t.config()
+	if cfg.OwnerNpubKey != current.OwnerNpubKey {
+		return nil, fmt.Errorf("changing OWNER_NPUB requires a restart")
+	}
+	if cfg.RelayURL != current.RelayURL {
+		return nil, fmt.Errorf("changing RELAY_URL requires a restart")
+	}
+
+	specs, err := readRelaySpecs(&cfg, l)
+	if err != nil {
+		return nil, err
+	}
+	if len(specs) != len(t.relays) {
+		return nil, fmt.Errorf("adding or removing relays requires a restart")
+	}
+
+	byName := make(map[string]RelaySpec, len(specs))
+	for _, spec := range specs {
+		byName[spec.Name] = spec
+	}
+	for _, r := range t.relays {
+		spec, ok := byName[r.spec.Name]
+		if !ok {
+			return nil, fmt.Errorf("adding or removing relays requires a restart")
+		}
+		if !reflect.DeepEqual(restartOnlySpec(spec), restartOnlySpec(r.spec)) {
+			return nil, fmt.Errorf("relay %s: only the name, description, icon, limits and IP lists can change without a restart", spec.Name)
+		}
+	}
+
+	return &tenantReload{env: env, cfg: &cfg, specs: byName}, nil
+}
+
+// restartOnlySpec clears the parts of a spec a reload can change.
+func restartOnlySpec(spec RelaySpec) RelaySpec {
+	spec.Info.Name = ""
+	spec.Info.Description = ""
+	spec.Info.Icon = ""
+	spec.Limits = RelayLimits{}
+	spec.IPAllow = nil
+	spec.IPDeny = nil
+	return spec
+}
+
+func (t *Tenant) applyReload(reload *tenantReload) {
+	seedRelaysChanged := !slices.Equal(reload.cfg.ImportSeedRelays, t.config().ImportSeedRelays)
+
+	t.env = reload.env
+	t.cfg.Store(reload.cfg)
+
+	for _, r := range t.relays {
+		spec := reload.specs[r.spec.Name]
+		t.applyInfo(r, spec)
+		if spec.Limits != r.limiters.Load().limits {
+			prettyPrintLimits(spec.Name+" relay limits", spec.Limits)
+			r.limiters.Store(r.limiters.Load().withLimits(spec.Limits))
+		}
+		r.ipRules.Store(newIPRules(spec))
+	}
+
+	if seedRelaysChanged {
+		if setter, ok := t.wot.(wot.SeedRelaysSetter); ok {
+			setter.SetSeedRelays(reload.cfg.ImportSeedRelays)
+		}
+		if cancel := t.resubscribeInbox.Load(); cancel != nil {
+			(*cancel)()
+		}
+	}
+}
+
+// applyInfo replaces the NIP-11 document of a relay rather than editing it, it is read by concurrent
+// requests. A name set through the management API keeps precedence over the configured one.
+func (t *Tenant) applyInfo(r *TenantRelay, spec RelaySpec) {
+	doc := *r.relay.Info
+	doc.Name = spec.Info.Name
+	if name := r.management.relayName(); name != "" {
+		doc.Name = name
+	}
+	doc.Description = spec.Info.Description
+	doc.Icon = spec.Info.Icon
+	t.describeRelay(r, &doc, spec)
+	r.relay.Info = &doc
+}
+
+// setRelayInfoName is used by the management API, it replaces the NIP-11 document like applyInfo.
+func setRelayInfoName(relay *khatru.Relay, name string) {
+	doc := *relay.Info
+	doc.Name = name
+	relay.Info = &doc
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestPrepareReload(t *testing.T) {
+	base := exampleEnv(t, nil)
+	l := newConfigLoader(base)
+	cfg := l.load()
+	specs, err := readRelaySpecs(&cfg, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant := &Tenant{env: base, dbPath: t.TempDir()}
+	tenant.cfg.Store(&cfg)
+	for _, spec := range specs {
+		tenant.relays = append(tenant.relays, &TenantRelay{spec: spec})
+	}
+
+	otherOwner, _ := nip19.EncodePublicKey(testPubkey())
+	tests := []struct {
+		name string
+		env  map[string]string
+		// the error mentions it, empty for a reload that can be applied
+		want string
+	}{
+		{"unchanged", nil, ""},
+		{"relay name", map[string]string{"PRIVATE_RELAY_NAME": "renamed"}, ""},
+		{"limits and IP lists", map[string]string{"PRIVATE_RELAY_EVENT_IP_LIMITER_MAX_TOKENS": "5", "PRIVATE_RELAY_IP_ALLOW": "10.0.0.0/8"}, ""},
+		{"invalid value", map[string]string{"ADMIN_ADDRESS": "0.0.0.0:9100"}, "invalid configuration"},
+		{"invalid relay", map[string]string{"PRIVATE_RELAY_IP_ALLOW": "nowhere"}, "invalid relay configuration"},
+		{"owner", map[string]string{"OWNER_NPUB": otherOwner}, "changing OWNER_NPUB"},
+		{"relay URL", map[string]string{"RELAY_URL": "other.example.com"}, "changing RELAY_URL"},
+		{"kinds", map[string]string{"PRIVATE_RELAY_ALLOWED_KINDS": "1"}, "relay private"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reload, err := tenant.prepareReload(exampleEnv(t, tt.env))
+			switch {
+			case tt.want == "" && err != nil:
+				t.Fatalf("prepareReload() error = %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Fatalf("prepareReload() error = %v, want one about %s", err, tt.want)
+			case tt.want == "" && len(reload.specs) != len(specs):
+				t.Errorf("the reload has %d relays, want %d", len(reload.specs), len(specs))
+			}
+		})
+	}
+}
@@ -0,0 +1,729 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip77"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy/storage/vector"
+	"github.com/nbd-wtf/go-nostr/nip86"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+)
+
+// A replica follows the primary set by REPLICATION_PRIMARY_URL: every REPLICATION_INTERVAL it diffs each of its
+// databases with the primary's using negentropy, fetches the events it is missing, deletes the ones the primary
+// no longer has and downloads the missing blobs. Its relays serve reads but refuse writes until haven promote.
+
+// replica is set while this instance follows a primary.
+var replica atomic.Bool
+
+// replicationStatePath records a promotion, so a promoted replica stays primary across restarts while
+// REPLICATION_PRIMARY_URL still names its former primary.
+var replicationStatePath = filepath.Join("db", "replication.json")
+
+const (
+	// replicationPath is where a primary serves its databases and blobs to the replicas, on REPLICATION_ADDRESS
+	replicationPath = "/replication"
+	// replicationBatchSize is the number of events fetched or deleted at once, below the query limit of the databases
+	replicationBatchSize = 100
+	replicationTimeout   = 10 * time.Minute
+	// replicationOverlap is how far before the previous sync an incremental sync starts, for the clocks of both
+	// instances and the events stored while it ran
+	replicationOverlap = 10 * time.Minute
+	// replicationSyncFile keeps the replicationSync of a tenant in its database directory
+	replicationSyncFile = "replicated.json"
+)
+
+// replicationAllowedIPs are the only addresses the replication server answers when REPLICATION_ALLOWED_IPS is set.
+var replicationAllowedIPs []netip.Prefix
+
+var errReplicaReadOnly = errors.New("blocked: this relay is a read-only replica, write to the primary")
+
+type replicationState struct {
+	PromotedFrom string    `json:"promoted_from"`
+	PromotedAt   time.Time `json:"promoted_at"`
+}
+
+func readReplicationState() (*replicationState, error) {
+	data, err := afero.ReadFile(fs, replicationStatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state replicationState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", replicationStatePath, err)
+	}
+	return &state, nil
+}
+
+// isPromoted reports whether haven promote was run since this instance started following its primary.
+func isPromoted() bool {
+	state, err := readReplicationState()
+	if err != nil {
+		slog.Error("🚫 error reading the replication state", "error", err)
+		return false
+	}
+	return state != nil && state.PromotedFrom == config.ReplicationPrimaryURL
+}
+
+// initReplicationRole makes this instance a replica when it has a primary it wasn't promoted from. A promotion
+// recorded for another primary is forgotten: the instance was pointed to a new primary to follow it.
+func initReplicationRole() {
+	if config.ReplicationPrimaryURL == "" {
+		return
+	}
+
+	state, err := readReplicationState()
+	if err != nil {
+		log.Fatalf("🚫 %s", err)
+	}
+	switch {
+	case state == nil:
+	case state.PromotedFrom == config.ReplicationPrimaryURL:
+		slog.Warn("⚠️ this replica was promoted, remove REPLICATION_PRIMARY_URL from the configuration", "promoted_at", state.PromotedAt)
+		return
+	default:
+		if err := fs.Remove(replicationStatePath); err != nil {
+			log.Fatalf("🚫 error removing %s: %s", replicationStatePath, err)
+		}
+	}
+
+	replica.Store(true)
+	if !strings.HasPrefix(config.ReplicationPrimaryURL, "https://") {
+		slog.Warn("⚠️ the primary is reached without TLS, the replication secret and the events travel in clear text")
+	}
+}
+
+// runPromote implements haven promote. It only records the promotion, a running replica picks it up before
+// its next sync.
+func runPromote() {
+	if config.ReplicationPrimaryURL == "" {
+		log.Fatal("🚫 this instance is not a replica, REPLICATION_PRIMARY_URL is not set")
+	}
+	if isPromoted() {
+		log.Println("ℹ️ this replica was already promoted")
+		return
+	}
+
+	data, err := json.Marshal(replicationState{PromotedFrom: config.ReplicationPrimaryURL, PromotedAt: time.Now().UTC()})
+	if err != nil {
+		log.Fatal("🚫 error encoding the replication state:", err)
+	}
+	if err := fs.MkdirAll(filepath.Dir(replicationStatePath), 0755); err != nil {
+		log.Fatal("🚫 error creating the database directory:", err)
+	}
+	if err := writeFileAtomic(replicationStatePath, data); err != nil {
+		log.Fatal("🚫 error writing the replication state:", err)
+	}
+	log.Println("👑 promoted to primary, a running replica stops following", config.ReplicationPrimaryURL, "within", config.ReplicationInterval)
+	log.Println("ℹ️ remove REPLICATION_PRIMARY_URL from the configuration, and make the former primary a replica of this one before restarting it")
+}
+
+// promote turns a running replica into a primary.
+func promote(ctx context.Context) {
+	replica.Store(false)
+	for _, t := range tenants {
+		// the groups were replicated as events, their state is loaded again from them
+		if t.chatGroups != nil {
+			t.initChatGroups(ctx)
+		}
+		if t.wotReady.Load() {
+			t.startPulling(ctx)
+		}
+	}
+	log.Println("👑 promoted to primary, accepting writes")
+}
+
+// startPulling subscribes a tenant to the seed relays for its inbox and chat relays, once. Replicas get these
+// events from their primary.
+func (t *Tenant) startPulling(ctx context.Context) {
+	if replica.Load() || !t.pulling.CompareAndSwap(false, true) {
+		return
+	}
+	background.Go(func() { t.subscribeInboxAndChat(ctx) })
+}
+
+func rejectReplicaWrite(context.Context, *nostr.Event) (bool, string) {
+	if replica.Load() {
+		return true, errReplicaReadOnly.Error()
+	}
+	return false, ""
+}
+
+// rejectReplicaAPICall refuses the management API of a replica, its lists are copied from the primary's and
+// would be overwritten.
+func rejectReplicaAPICall(context.Context, nip86.MethodParams) (bool, string) {
+	if replica.Load() {
+		return true, errReplicaReadOnly.Error()
+	}
+	return false, ""
+}
+
+// Primary side: the databases of every tenant are served read-only at /replication/{db}?tenant=<host> on
+// REPLICATION_ADDRESS, through khatru relays without any policy but the shared secret and the allowed IPs, the
+// blobs at /replication/blobs/{sha256} and the lists of each relay at /replication/lists/{relay}.
+
+// replicatedLists are the management lists and the tombstones of a relay, kept in files next to its database
+// instead of as events.
+type replicatedLists struct {
+	Management *RelayManagement `json:"management"`
+	Tombstones *Tombstones      `json:"tombstones"`
+}
+
+// initReplicationRelays must be called once every database of the tenant is open.
+func (t *Tenant) initReplicationRelays() {
+	t.replicationRelays = make(map[string]*khatru.Relay)
+	for _, entry := range t.getDBs() {
+		relay := khatru.NewRelay()
+		relay.Negentropy = true
+		relay.QueryEvents = append(relay.QueryEvents, withoutExpired(entry.db.QueryEvents))
+		relay.RejectEvent = append(relay.RejectEvent, func(context.Context, *nostr.Event) (bool, string) {
+			return true, "blocked: replication is read-only"
+		})
+		connections.track(relay)
+		t.replicationRelays[strings.TrimSuffix(entry.name, ".jsonl")] = relay
+	}
+}
+
+func replicationAuthorized(req *http.Request) bool {
+	if len(replicationAllowedIPs) > 0 {
+		if ip, ok := remoteIP(req); !ok || !containsIP(replicationAllowedIPs, ip) {
+			return false
+		}
+	}
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(config.ReplicationSecret)) == 1
+}
+
+func replicationHandler(w http.ResponseWriter, req *http.Request) {
+	if !replicationAuthorized(req) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	t := tenantForHost(req.URL.Query().Get("tenant"))
+	if t == nil {
+		http.NotFound(w, req)
+		return
+	}
+	relay, ok := t.replicationRelays[req.PathValue("db")]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	relay.ServeHTTP(w, req)
+}
+
+func replicationBlobHandler(w http.ResponseWriter, req *http.Request) {
+	if !replicationAuthorized(req) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	t := tenantForHost(req.URL.Query().Get("tenant"))
+	hash := req.PathValue("sha256")
+	if t == nil || !nostr.IsValid32ByteHex(hash) {
+		http.NotFound(w, req)
+		return
+	}
+	file, err := fs.Open(t.config().BlossomPath + hash)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer file.Close()
+	http.ServeContent(w, req, hash, time.Time{}, file)
+}
+
+func replicationListsHandler(w http.ResponseWriter, req *http.Request) {
+	if !replicationAuthorized(req) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	t := tenantForHost(req.URL.Query().Get("tenant"))
+	if t == nil {
+		http.NotFound(w, req)
+		return
+	}
+	i := slices.IndexFunc(t.relays, func(r *TenantRelay) bool { return r.spec.Name == req.PathValue("relay") })
+	if i == -1 {
+		http.NotFound(w, req)
+		return
+	}
+	r := t.relays[i]
+
+	r.management.mu.RLock()
+	r.tombstones.mu.RLock()
+	data, err := json.Marshal(replicatedLists{Management: r.management, Tombstones: r.tombstones})
+	r.tombstones.mu.RUnlock()
+	r.management.mu.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Replica side.
+
+// startReplication follows the primary until the context is canceled or this instance is promoted.
+func startReplication(ctx context.Context) {
+	if !replica.Load() {
+		return
+	}
+
+	log.Println("🪞 replicating from", config.ReplicationPrimaryURL, "every", config.ReplicationInterval)
+	ticker := time.NewTicker(config.ReplicationInterval)
+	defer ticker.Stop()
+
+	for {
+		if isPromoted() {
+			promote(ctx)
+			return
+		}
+		for _, t := range tenants {
+			t.replicate(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// replicationSync is where each database of a replica stands with its primary. It is persisted so a restarted
+// replica goes on with incremental syncs.
+type replicationSync struct {
+	// Primary is the REPLICATION_PRIMARY_URL the databases were synced with, another primary starts over
+	Primary string `json:"primary"`
+	// Synced is when the last sync of each database started, in unix seconds
+	Synced map[string]int64 `json:"synced"`
+	// Reconciled is when the last full reconcile of each database started, in unix seconds
+	Reconciled map[string]int64 `json:"reconciled"`
+}
+
+func (t *Tenant) loadReplicationSync() *replicationSync {
+	path := filepath.Join(t.dbPath, replicationSyncFile)
+	state := &replicationSync{}
+	if data, err := afero.ReadFile(fs, path); err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			slog.Warn("⚠️ error parsing the replication state, syncing every event", "path", path, "error", err)
+			state = &replicationSync{}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("⚠️ error reading the replication state, syncing every event", "path", path, "error", err)
+	}
+
+	if state.Primary != config.ReplicationPrimaryURL || state.Synced == nil || state.Reconciled == nil {
+		state = &replicationSync{Primary: config.ReplicationPrimaryURL, Synced: make(map[string]int64), Reconciled: make(map[string]int64)}
+	}
+	return state
+}
+
+func (t *Tenant) saveReplicationSync() error {
+	data, err := json.Marshal(t.syncState)
+	if err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(t.dbPath, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(t.dbPath, replicationSyncFile), data)
+}
+
+// syncSince is where the next sync of a database starts: shortly before its previous sync, or nil for a full
+// reconcile every REPLICATION_RECONCILE_INTERVAL. Events that reach the primary with an older created_at, and the
+// deletions of older events, are only replicated by the full reconciles.
+func (t *Tenant) syncSince(name string, now time.Time) *nostr.Timestamp {
+	synced, reconciled := t.syncState.Synced[name], t.syncState.Reconciled[name]
+	if synced == 0 || now.Sub(time.Unix(reconciled, 0)) >= config.ReplicationReconcileInterval {
+		return nil
+	}
+	since := nostr.Timestamp(time.Unix(synced, 0).Add(-replicationOverlap).Unix())
+	return &since
+}
+
+// replicate brings the lists, every database and the blobs of a tenant in line with the primary.
+func (t *Tenant) replicate(ctx context.Context) {
+	if t.syncState == nil {
+		t.syncState = t.loadReplicationSync()
+	}
+
+	for _, r := range t.relays {
+		if err := t.replicateLists(ctx, r); err != nil {
+			slog.Error("🚫 error replicating the lists", "tenant", t.Host, "relay", r.spec.Name, "error", err)
+		}
+	}
+
+	var blobsSince *nostr.Timestamp
+	for _, entry := range t.getDBs() {
+		name := strings.TrimSuffix(entry.name, ".jsonl")
+		start := time.Now()
+		since := t.syncSince(name, start)
+
+		fetched, deleted, err := t.replicateDB(ctx, name, entry.db, since)
+		replicatedEvents.WithLabelValues(t.Host, name, "fetched").Add(float64(fetched))
+		replicatedEvents.WithLabelValues(t.Host, name, "deleted").Add(float64(len(deleted)))
+		if err != nil {
+			slog.Error("🚫 error replicating", "tenant", t.Host, "db", name, "error", err)
+			continue
+		}
+		t.replicatedAt[name].Store(start.Unix())
+		t.syncState.Synced[name] = start.Unix()
+		if since == nil {
+			t.syncState.Reconciled[name] = start.Unix()
+			slog.Debug("🪞 reconciled every event", "tenant", t.Host, "db", name)
+		}
+
+		if entry.db == t.blossomDB {
+			blobsSince = since
+			for _, event := range deleted {
+				if tag := event.Tags.Find("x"); tag != nil {
+					if _, err := t.removeOrphanBlob(ctx, tag[1]); err != nil {
+						slog.Warn("⚠️ error removing blob", "sha256", tag[1], "error", err)
+					}
+				}
+			}
+		}
+		if fetched > 0 || len(deleted) > 0 {
+			slog.Info("🪞 replicated", "tenant", t.Host, "db", name, "fetched", fetched, "deleted", len(deleted))
+		}
+	}
+
+	if err := t.saveReplicationSync(); err != nil {
+		slog.Error("🚫 error saving the replication state", "tenant", t.Host, "error", err)
+	}
+
+	if t.blossomDB != nil {
+		fetched, err := t.replicateBlobs(ctx, blobsSince)
+		replicatedBlobs.WithLabelValues(t.Host).Add(float64(fetched))
+		if err != nil {
+			slog.Error("🚫 error replicating blobs", "tenant", t.Host, "error", err)
+		}
+		if fetched > 0 {
+			slog.Info("🪞 replicated blobs", "tenant", t.Host, "fetched", fetched)
+		}
+	}
+}
+
+func (t *Tenant) replicationURL(scheme string, path string) string {
+	u := config.ReplicationPrimaryURL
+	if scheme == "ws" {
+		u = "ws" + strings.TrimPrefix(u, "http")
+	}
+	return u + replicationPath + "/" + path + "?tenant=" + url.QueryEscape(t.Host)
+}
+
+func replicationHeader() http.Header {
+	return http.Header{"Authorization": {"Bearer " + config.ReplicationSecret}}
+}
+
+// replicateDB diffs the events of a database created since the given time, or all of them, with the primary's,
+// fetches the events it is missing and deletes the ones the primary doesn't have. It returns the number of events
+// fetched and the events deleted.
+func (t *Tenant) replicateDB(ctx context.Context, name string, db DBBackend, since *nostr.Timestamp) (int, []*nostr.Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, replicationTimeout)
+	defer cancel()
+
+	// expired events are left out on both sides, each side deletes its own
+	filter := nostr.Filter{Since: since}
+	now := nostr.Now()
+	local := 0
+	vec := vector.New()
+	err := forEachEvent(ctx, db, filter, func(event *nostr.Event) {
+		if !isExpired(event, now) {
+			vec.Insert(event.CreatedAt, event.ID)
+			local++
+		}
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	vec.Seal()
+
+	neg := negentropy.New(vec, 1024*1024)
+	done := make(chan error, 1)
+	finish := func(err error) {
+		select {
+		case done <- err:
+		default:
+		}
+	}
+
+	// the IDs are read while reconciling, negentropy blocks once its buffers are full
+	var haves, haveNots []string
+	var wg sync.WaitGroup
+	collect := func(ids <-chan string, into *[]string) {
+		defer wg.Done()
+		for {
+			select {
+			case id, ok := <-ids:
+				if !ok {
+					return
+				}
+				*into = append(*into, id)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go collect(neg.Haves, &haves)
+	go collect(neg.HaveNots, &haveNots)
+
+	const subscriptionID = "replication"
+	var primary *nostr.Relay
+	primary, err = nostr.RelayConnect(ctx, t.replicationURL("ws", name), nostr.WithRequestHeader(replicationHeader()), nostr.WithCustomHandler(func(data string) {
+		switch env := nip77.ParseNegMessage(data).(type) {
+		case *nip77.ErrorEnvelope:
+			finish(fmt.Errorf("the primary refused to sync: %s", env.Reason))
+		case *nip77.MessageEnvelope:
+			next, err := neg.Reconcile(env.Message)
+			if err != nil {
+				finish(fmt.Errorf("error reconciling: %w", err))
+				return
+			}
+			if next != "" {
+				msg, _ := nip77.MessageEnvelope{SubscriptionID: subscriptionID, Message: next}.MarshalJSON()
+				primary.Write(msg)
+			}
+		}
+	}))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer primary.Close()
+
+	open, _ := nip77.OpenEnvelope{SubscriptionID: subscriptionID, Filter: filter, Message: neg.Start()}.MarshalJSON()
+	if err := <-primary.Write(open); err != nil {
+		return 0, nil, err
+	}
+	go func() {
+		wg.Wait()
+		finish(ctx.Err())
+	}()
+	if err := <-done; err != nil {
+		return 0, nil, err
+	}
+	closeMsg, _ := nip77.CloseEnvelope{SubscriptionID: subscriptionID}.MarshalJSON()
+	primary.Write(closeMsg)
+
+	fetched := 0
+	for ids := range slices.Chunk(haveNots, replicationBatchSize) {
+		events, err := primary.QuerySync(ctx, nostr.Filter{IDs: ids, Limit: len(ids)})
+		if err != nil {
+			return fetched, nil, err
+		}
+		for _, event := range events {
+			if ok, _ := event.CheckSignature(); !ok {
+				slog.Warn("⚠️ invalid event from the primary", "db", name, "id", event.ID)
+				continue
+			}
+			if err := replicateEvent(ctx, db, event); errors.Is(err, errEventDeleted) {
+				continue
+			} else if err != nil {
+				return fetched, nil, err
+			}
+			fetched++
+
+			if event.Kind == kindRequestToVanish && db != t.blossomDB {
+				t.vanish(ctx, event)
+			}
+		}
+	}
+
+	// a primary answering with an empty database is more likely misconfigured than emptied, an incremental sync
+	// only deletes the events of a short window
+	if since == nil && local > 0 && len(haves) == local && len(haveNots) == 0 {
+		slog.Warn("⚠️ the primary has no events, not deleting the local ones", "tenant", t.Host, "db", name)
+		return fetched, nil, nil
+	}
+
+	var deleted []*nostr.Event
+	for ids := range slices.Chunk(haves, replicationBatchSize) {
+		events, err := db.QueryEvents(ctx, nostr.Filter{IDs: ids, Limit: len(ids)})
+		if err != nil {
+			return fetched, nil, err
+		}
+		for event := range events {
+			deleted = append(deleted, event)
+		}
+	}
+	for i, event := range deleted {
+		if err := db.DeleteEvent(ctx, event); err != nil {
+			return fetched, deleted[:i], err
+		}
+	}
+	return fetched, deleted, nil
+}
+
+// replicateLists takes over the management lists and the tombstones of a relay from the primary, so a promoted
+// replica keeps its bans and deleted events stay deleted. They are replicated before the events, which they
+// may refuse.
+func (t *Tenant) replicateLists(ctx context.Context, r *TenantRelay) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.replicationURL("http", "lists/"+r.spec.Name), nil)
+	if err != nil {
+		return err
+	}
+	req.Header = replicationHeader()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the primary answered %s", resp.Status)
+	}
+
+	lists := replicatedLists{Management: &RelayManagement{}, Tombstones: &Tombstones{}}
+	if err := json.NewDecoder(resp.Body).Decode(&lists); err != nil {
+		return fmt.Errorf("error parsing the lists of the primary: %w", err)
+	}
+	if changed, err := r.tombstones.replace(lists.Tombstones); err != nil {
+		return err
+	} else if changed {
+		slog.Info("🪞 replicated the tombstones", "tenant", t.Host, "relay", r.spec.Name)
+	}
+	if changed, err := r.management.replace(lists.Management); err != nil {
+		return err
+	} else if changed {
+		if lists.Management.RelayName != "" {
+			setRelayInfoName(r.relay, lists.Management.RelayName)
+		}
+		slog.Info("🪞 replicated the management lists", "tenant", t.Host, "relay", r.spec.Name)
+	}
+	return nil
+}
+
+// replicateEvent stores an event of the primary as it is, whatever its kind.
+func replicateEvent(ctx context.Context, db DBBackend, event *nostr.Event) error {
+	if nostr.IsReplaceableKind(event.Kind) || nostr.IsAddressableKind(event.Kind) {
+		return db.ReplaceEvent(ctx, event)
+	}
+	if err := db.SaveEvent(ctx, event); err != nil && !errors.Is(err, eventstore.ErrDupEvent) {
+		return err
+	}
+	return nil
+}
+
+// replicateBlobs downloads the blobs indexed in the Blossom database since the given time, or ever, that are
+// missing from BLOSSOM_PATH. It returns the number of blobs downloaded.
+func (t *Tenant) replicateBlobs(ctx context.Context, since *nostr.Timestamp) (int, error) {
+	missing := make(map[string]bool)
+	err := forEachEvent(ctx, t.blossomDB, nostr.Filter{Kinds: []int{24242}, Since: since}, func(event *nostr.Event) {
+		tag := event.Tags.Find("x")
+		if tag == nil || !nostr.IsValid32ByteHex(tag[1]) {
+			return
+		}
+		if _, err := fs.Stat(t.config().BlossomPath + tag[1]); errors.Is(err, os.ErrNotExist) {
+			missing[tag[1]] = true
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	fetched := 0
+	for hash := range missing {
+		if err := t.fetchBlob(ctx, hash); err != nil {
+			slog.Warn("⚠️ error fetching blob from the primary", "sha256", hash, "error", err)
+			continue
+		}
+		fetched++
+	}
+	return fetched, nil
+}
+
+// fetchBlob downloads a blob from the primary, it is only kept if its content matches its hash.
+func (t *Tenant) fetchBlob(ctx context.Context, hash string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.replicationURL("http", "blobs/"+hash), nil)
+	if err != nil {
+		return err
+	}
+	req.Header = replicationHeader()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the primary answered %s", resp.Status)
+	}
+
+	path := t.config().BlossomPath + hash
+	file, err := fs.Create(path + ".part")
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, h), resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != hash {
+		err = fmt.Errorf("the content doesn't match its hash")
+	}
+	if err != nil {
+		_ = fs.Remove(path + ".part")
+		return err
+	}
+	return fs.Rename(path+".part", path)
+}
+
+// instrumentReplication exposes how far behind the primary each database of a replica is: the time since it
+// last matched the primary, or since the replica started until then.
+func (t *Tenant) instrumentReplication() {
+	t.replicatedAt = make(map[string]*atomic.Int64)
+	for _, entry := range t.getDBs() {
+		name := strings.TrimSuffix(entry.name, ".jsonl")
+		at := &atomic.Int64{}
+		at.Store(time.Now().Unix())
+		t.replicatedAt[name] = at
+
+		metricsRegistry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "haven_replication_lag_seconds",
+			Help:        "Time since a database of a replica last matched the primary, 0 on a primary.",
+			ConstLabels: prometheus.Labels{"tenant": t.Host, "db": name},
+		}, func() float64 {
+			return t.replicationLag(name).Seconds()
+		}))
+	}
+}
+
+func (t *Tenant) replicationLag(name string) time.Duration {
+	at, ok := t.replicatedAt[name]
+	if !ok || !replica.Load() {
+		return 0
+	}
+	return time.Since(time.Unix(at.Load(), 0))
+}
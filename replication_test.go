@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+func TestReplicationAuthorized(t *testing.T) {
+	secret := strings.Repeat("s", minReplicationSecretLength)
+	defer func(previous Config, allowed []netip.Prefix) {
+		config, replicationAllowedIPs = previous, allowed
+	}(config, replicationAllowedIPs)
+	config.ReplicationSecret = secret
+
+	request := func(remoteAddr string, token string) bool {
+		req := httptest.NewRequest("GET", replicationPath+"/private", nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return replicationAuthorized(req)
+	}
+
+	if !request("203.0.113.1:1234", secret) {
+		t.Error("the secret is refused without allowed IPs")
+	}
+	if request("203.0.113.1:1234", "") || request("203.0.113.1:1234", secret+"x") {
+		t.Error("a request without the secret is authorized")
+	}
+
+	replicationAllowedIPs, _ = parseIPList([]string{"10.0.0.2"})
+	if request("203.0.113.1:1234", secret) {
+		t.Error("an address outside REPLICATION_ALLOWED_IPS is authorized")
+	}
+	if !request("10.0.0.2:1234", secret) {
+		t.Error("an allowed replica is refused")
+	}
+	if request("10.0.0.2:1234", "") {
+		t.Error("an allowed replica is authorized without the secret")
+	}
+}
+
+func TestReplicateLists(t *testing.T) {
+	secret := strings.Repeat("s", minReplicationSecretLength)
+	defer func(previous Config, previousTenants []*Tenant) {
+		config, tenants = previous, previousTenants
+	}(config, tenants)
+
+	owner, banned, author := testPubkey(), testPubkey(), testPubkey()
+	primary := newTestTenant(t, owner, nil)
+	primaryRelay := primary.newTestRelay(RelaySpec{Name: "outbox"})
+	primaryRelay.tombstones = primary.loadTombstones(context.Background(), "outbox", newTestDB(t))
+	if err := primaryRelay.management.banPubkey(banned, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := primaryRelay.management.setRelayName("renamed"); err != nil {
+		t.Fatal(err)
+	}
+	deletion := &nostr.Event{PubKey: author, Kind: kindRequestToVanish, CreatedAt: 100}
+	if err := primaryRelay.tombstones.record(deletion); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+replicationPath+"/lists/{relay}", replicationListsHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	config.ReplicationSecret, config.ReplicationPrimaryURL, config.TenantsFile = secret, server.URL, ""
+	tenants = []*Tenant{primary}
+
+	replica := newTestTenant(t, owner, nil)
+	replicaRelay := replica.newTestRelay(RelaySpec{Name: "outbox"})
+	replicaRelay.relay.Info = &nip11.RelayInformationDocument{Name: "outbox"}
+	replicaRelay.tombstones = replica.loadTombstones(context.Background(), "outbox", newTestDB(t))
+
+	if err := replica.replicateLists(context.Background(), replicaRelay); err != nil {
+		t.Fatal(err)
+	}
+	if !replicaRelay.management.isPubkeyBanned(banned) {
+		t.Error("the ban wasn't replicated")
+	}
+	if replicaRelay.relay.Info.Name != "renamed" {
+		t.Errorf("relay name = %q, want the one set on the primary", replicaRelay.relay.Info.Name)
+	}
+	if !replicaRelay.tombstones.isDeleted(context.Background(), &nostr.Event{PubKey: author, Kind: nostr.KindTextNote, CreatedAt: 50}) {
+		t.Error("the tombstones weren't replicated")
+	}
+
+	// the replicated lists are persisted, and can be written to once promoted
+	reloaded := replica.loadRelayManagement("outbox")
+	if !reloaded.isPubkeyBanned(banned) {
+		t.Error("the replicated lists weren't saved")
+	}
+	if err := replicaRelay.management.allowPubkey(author, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newReplicationTenant returns a tenant with a single outbox relay and its database.
+func newReplicationTenant(t *testing.T, owner string) (*Tenant, *TenantRelay) {
+	t.Helper()
+
+	tenant := &Tenant{dbPath: t.TempDir(), replicatedAt: map[string]*atomic.Int64{"outbox": {}}}
+	tenant.cfg.Store(&Config{OwnerNpubKey: owner})
+	return tenant, newTestStoredRelay(t, tenant, RelaySpec{Name: "outbox"})
+}
+
+func TestReplicate(t *testing.T) {
+	defer func(previous Config, previousTenants []*Tenant) {
+		config, tenants = previous, previousTenants
+	}(config, tenants)
+
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(sk)
+	note := func(content string, age time.Duration) *nostr.Event {
+		event := &nostr.Event{Kind: nostr.KindTextNote, Content: content, CreatedAt: nostr.Timestamp(time.Now().Add(-age).Unix())}
+		if err := event.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	primary, primaryRelay := newReplicationTenant(t, owner)
+	recent, old := note("recent", time.Hour), note("old", 48*time.Hour)
+	for _, event := range []*nostr.Event{recent, old} {
+		if err := primaryRelay.db.SaveEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	primary.initReplicationRelays()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+replicationPath+"/lists/{relay}", replicationListsHandler)
+	mux.HandleFunc("GET "+replicationPath+"/{db}", replicationHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	config.ReplicationSecret = strings.Repeat("s", minReplicationSecretLength)
+	config.ReplicationPrimaryURL, config.TenantsFile = server.URL, ""
+	config.ReplicationReconcileInterval = time.Hour
+	tenants = []*Tenant{primary}
+
+	replica, replicaRelay := newReplicationTenant(t, owner)
+	has := func(event *nostr.Event) bool {
+		events, err := replicaRelay.db.QueryEvents(ctx, nostr.Filter{IDs: []string{event.ID}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for range events {
+			found = true
+		}
+		return found
+	}
+
+	// the first sync reconciles every event
+	replica.replicate(ctx)
+	if !has(recent) || !has(old) {
+		t.Fatal("the first sync didn't fetch every event")
+	}
+	if replica.syncState.Synced["outbox"] == 0 || replica.syncState.Reconciled["outbox"] == 0 {
+		t.Fatal("the sync wasn't recorded")
+	}
+
+	// the next ones only diff the events since the previous sync
+	latest := note("latest", 0)
+	if err := primaryRelay.db.SaveEvent(ctx, latest); err != nil {
+		t.Fatal(err)
+	}
+	if err := primaryRelay.db.DeleteEvent(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	replica.replicate(ctx)
+	if !has(latest) {
+		t.Error("an incremental sync didn't fetch the new event")
+	}
+	if !has(old) {
+		t.Error("an incremental sync looked at an event older than the previous sync")
+	}
+
+	// a full reconcile catches up with everything else
+	replica.syncState.Reconciled["outbox"] = time.Now().Add(-2 * time.Hour).Unix()
+	replica.replicate(ctx)
+	if has(old) {
+		t.Error("the full reconcile didn't delete the event the primary no longer has")
+	}
+
+	// the sync state survives a restart, unless the replica follows another primary
+	if state := replica.loadReplicationSync(); state.Synced["outbox"] != replica.syncState.Synced["outbox"] {
+		t.Error("the sync state wasn't persisted")
+	}
+	config.ReplicationPrimaryURL = "https://other.example.com"
+	if state := replica.loadReplicationSync(); len(state.Synced) != 0 {
+		t.Error("the sync state of another primary was kept")
+	}
+}
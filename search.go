@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blugelabs/bluge"
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip05"
+)
+
+// Fields of the NIP-50 search index, a document per event or per address for replaceable events.
+const (
+	searchIDField        = "i"
+	searchTextField      = "t"
+	searchKindField      = "k"
+	searchPubkeyField    = "p"
+	searchCreatedAtField = "c"
+	searchLanguageField  = "l"
+)
+
+const (
+	searchDefaultLimit = 100
+	// searchMaxHits is the number of matches read from the index, filters on tags are applied to them
+	searchMaxHits = 1000
+)
+
+// searchableTags hold text a client would look for besides the content, hashtags and URLs included.
+var searchableTags = []string{"title", "summary", "subject", "alt", "description", "name", "t", "r"}
+
+// SearchIndex is the NIP-50 full-text index of a relay. It only holds what is needed to find and rank
+// events, the events themselves are read from the database.
+type SearchIndex struct {
+	mu     sync.RWMutex
+	path   string
+	writer *bluge.Writer
+}
+
+// openSearchIndex opens the search index of a relay, creating it empty the first time.
+func (t *Tenant) openSearchIndex(name string, db DBBackend) *SearchIndex {
+	path := filepath.Join(t.dbPath, "search", name)
+	_, err := os.Stat(path)
+	created := errors.Is(err, os.ErrNotExist)
+
+	index := &SearchIndex{path: path}
+	if err := index.open(); err != nil {
+		log.Fatalf("🚫 error opening the search index of %s: %s", name, err)
+	}
+
+	if created {
+		events, err := db.QueryEvents(context.Background(), nostr.Filter{Limit: 1})
+		if err == nil && <-events != nil {
+			slog.Warn("⚠️ the search index is empty, run haven reindex to make the existing events searchable", "relay", name)
+		}
+	}
+	return index
+}
+
+func (s *SearchIndex) open() error {
+	writer, err := bluge.OpenWriter(bluge.DefaultConfig(s.path))
+	if err != nil {
+		return err
+	}
+	s.writer = writer
+	return nil
+}
+
+func (s *SearchIndex) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writer.Close()
+}
+
+// searchDocID is the document of an event, replaceable and addressable events share the document of their
+// address so only the latest version is found.
+func searchDocID(event *nostr.Event) string {
+	if nostr.IsReplaceableKind(event.Kind) || nostr.IsAddressableKind(event.Kind) {
+		return fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, event.Tags.GetD())
+	}
+	return event.ID
+}
+
+// searchDocument is the document of an event, nil if it has nothing to search.
+func searchDocument(event *nostr.Event) *bluge.Document {
+	text := searchableText(event)
+	if text == "" {
+		return nil
+	}
+
+	doc := bluge.NewDocument(searchDocID(event))
+	doc.AddField(bluge.NewKeywordField(searchIDField, event.ID).StoreValue())
+	doc.AddField(bluge.NewTextField(searchTextField, text))
+	doc.AddField(bluge.NewKeywordField(searchKindField, strconv.Itoa(event.Kind)))
+	doc.AddField(bluge.NewKeywordField(searchPubkeyField, event.PubKey))
+	doc.AddField(bluge.NewNumericField(searchCreatedAtField, float64(event.CreatedAt)))
+	// NIP-32 ISO-639-1 labels, for the language: extension
+	for tag := range event.Tags.FindAll("l") {
+		if len(tag) >= 3 && tag[2] == "ISO-639-1" {
+			doc.AddField(bluge.NewKeywordField(searchLanguageField, strings.ToLower(tag[1])))
+		}
+	}
+	return doc
+}
+
+// searchableText is the text of an event: its content, unless encrypted, and its searchable tags. Profiles
+// are searched by their fields rather than their JSON.
+func searchableText(event *nostr.Event) string {
+	var parts []string
+	switch {
+	case event.Kind == nostr.KindProfileMetadata:
+		var profile map[string]any
+		if json.Unmarshal([]byte(event.Content), &profile) == nil {
+			for _, field := range []string{"name", "display_name", "about", "nip05", "website"} {
+				if value, ok := profile[field].(string); ok && value != "" {
+					parts = append(parts, value)
+				}
+			}
+		}
+	case !isEncrypted(event.Content):
+		parts = append(parts, event.Content)
+	}
+
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && slices.Contains(searchableTags, tag[0]) {
+			parts = append(parts, tag[1])
+		}
+	}
+	return strings.TrimSpace(strings.Join(parts, "\n"))
+}
+
+// isEncrypted reports whether content is a NIP-04 or NIP-44 payload, like DMs, drafts and private list items.
+func isEncrypted(content string) bool {
+	if strings.Contains(content, "?iv=") {
+		return true
+	}
+	if len(content) < 132 || strings.ContainsAny(content, " \n") {
+		return false
+	}
+	payload, err := base64.StdEncoding.DecodeString(content)
+	return err == nil && payload[0] == 2
+}
+
+func (s *SearchIndex) index(event *nostr.Event) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doc := searchDocument(event)
+	if doc == nil {
+		return s.writer.Delete(bluge.Identifier(searchDocID(event)))
+	}
+	return s.writer.Update(doc.ID(), doc)
+}
+
+func (s *SearchIndex) remove(docID string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.writer.Delete(bluge.Identifier(docID))
+}
+
+// rebuild empties the index and indexes every unexpired event of db. It returns the number of events indexed.
+func (s *SearchIndex) rebuild(ctx context.Context, db DBBackend) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writer.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.RemoveAll(s.path); err != nil {
+		return 0, err
+	}
+	if err := s.open(); err != nil {
+		return 0, err
+	}
+
+	now := nostr.Now()
+	indexed := 0
+	// events come newest first, an older version of an address left in the database doesn't replace the latest
+	seen := make(map[string]bool)
+	batch := bluge.NewBatch()
+	pending := 0
+	var batchErr error
+	err := forEachEvent(ctx, db, nostr.Filter{}, func(event *nostr.Event) {
+		docID := searchDocID(event)
+		if batchErr != nil || seen[docID] || isExpired(event, now) {
+			return
+		}
+		seen[docID] = true
+
+		doc := searchDocument(event)
+		if doc == nil {
+			return
+		}
+		batch.Update(doc.ID(), doc)
+		indexed++
+		pending++
+		if pending == queryPageSize {
+			batchErr = s.writer.Batch(batch)
+			batch.Reset()
+			pending = 0
+		}
+	})
+	if err != nil {
+		return indexed, err
+	}
+	if batchErr != nil {
+		return indexed, batchErr
+	}
+	return indexed, s.writer.Batch(batch)
+}
+
+// search returns the IDs of the events matching a search, best matches first. The filter is only applied
+// for the fields the index holds, authors stands for its authors once narrowed by the domain: extension.
+func (s *SearchIndex) search(ctx context.Context, filter nostr.Filter, q searchQuery, authors []string) ([]string, error) {
+	query := bluge.NewBooleanQuery()
+	if q.text != "" {
+		query.AddMust(bluge.NewMatchQuery(q.text).SetField(searchTextField).SetOperator(bluge.MatchQueryOperatorAnd))
+	} else {
+		query.AddMust(bluge.NewMatchAllQuery())
+	}
+	if q.language != "" {
+		query.AddMust(bluge.NewTermQuery(q.language).SetField(searchLanguageField))
+	}
+
+	anyOf := func(field string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		terms := bluge.NewBooleanQuery().SetMinShould(1)
+		for _, value := range values {
+			terms.AddShould(bluge.NewTermQuery(value).SetField(field))
+		}
+		query.AddMust(terms)
+	}
+	kinds := make([]string, len(filter.Kinds))
+	for i, kind := range filter.Kinds {
+		kinds[i] = strconv.Itoa(kind)
+	}
+	anyOf(searchKindField, kinds)
+	anyOf(searchPubkeyField, authors)
+	anyOf(searchIDField, filter.IDs)
+
+	if filter.Since != nil || filter.Until != nil {
+		since, until := bluge.MinNumeric, bluge.MaxNumeric
+		if filter.Since != nil {
+			since = float64(*filter.Since)
+		}
+		if filter.Until != nil {
+			until = float64(*filter.Until)
+		}
+		query.AddMust(bluge.NewNumericRangeInclusiveQuery(since, until, true, true).SetField(searchCreatedAtField))
+	}
+
+	s.mu.RLock()
+	reader, err := s.writer.Reader()
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	matches, err := reader.Search(ctx, bluge.NewTopNSearch(searchMaxHits, query))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	match, err := matches.Next()
+	for err == nil && match != nil {
+		err = match.VisitStoredFields(func(field string, value []byte) bool {
+			if field == searchIDField {
+				ids = append(ids, string(value))
+				return false
+			}
+			return true
+		})
+		if err == nil {
+			match, err = matches.Next()
+		}
+	}
+	return ids, err
+}
+
+// searchQuery is a NIP-50 search string, the words to match and the extensions that mean something here.
+type searchQuery struct {
+	text     string
+	language string
+	domain   string
+}
+
+func parseSearch(search string) searchQuery {
+	var q searchQuery
+	var words []string
+	for _, word := range strings.Fields(search) {
+		key, value, ok := strings.Cut(word, ":")
+		if ok && value != "" {
+			switch strings.ToLower(key) {
+			case "language":
+				q.language = strings.ToLower(value)
+				continue
+			case "domain":
+				q.domain = strings.ToLower(value)
+				continue
+			case "include", "sentiment", "nsfw":
+				// no spam filtering nor classification, every event stored is included
+				continue
+			}
+		}
+		words = append(words, word)
+	}
+	q.text = strings.Join(words, " ")
+	return q
+}
+
+// searchStore is the database of a relay with search: every write is mirrored to the index and the filters
+// with a search are answered from it.
+type searchStore struct {
+	DBBackend
+	index *SearchIndex
+}
+
+func (s searchStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	if err := s.DBBackend.SaveEvent(ctx, event); err != nil {
+		return err
+	}
+	if err := s.index.index(event); err != nil {
+		slog.Warn("⚠️ error indexing event", "id", event.ID, "error", err)
+	}
+	return nil
+}
+
+func (s searchStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	if err := s.DBBackend.ReplaceEvent(ctx, event); err != nil {
+		return err
+	}
+	s.indexAddress(ctx, event)
+	return nil
+}
+
+func (s searchStore) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	if err := s.DBBackend.DeleteEvent(ctx, event); err != nil {
+		return err
+	}
+	if nostr.IsReplaceableKind(event.Kind) || nostr.IsAddressableKind(event.Kind) {
+		s.indexAddress(ctx, event)
+	} else if err := s.index.remove(event.ID); err != nil {
+		slog.Warn("⚠️ error removing event from the search index", "id", event.ID, "error", err)
+	}
+	return nil
+}
+
+// indexAddress indexes the version of an address the database holds after a write, an older version
+// replaces nothing and a deleted address leaves the index.
+func (s searchStore) indexAddress(ctx context.Context, event *nostr.Event) {
+	filter := nostr.Filter{Kinds: []int{event.Kind}, Authors: []string{event.PubKey}, Limit: 1}
+	if nostr.IsAddressableKind(event.Kind) {
+		filter.Tags = nostr.TagMap{"d": []string{event.Tags.GetD()}}
+	}
+
+	events, err := s.DBBackend.QueryEvents(ctx, filter)
+	if err == nil {
+		if latest := <-events; latest != nil {
+			err = s.index.index(latest)
+		} else {
+			err = s.index.remove(searchDocID(event))
+		}
+	}
+	if err != nil {
+		slog.Warn("⚠️ error indexing event", "id", event.ID, "error", err)
+	}
+}
+
+func (s searchStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	if filter.Search == "" {
+		return s.DBBackend.QueryEvents(ctx, filter)
+	}
+
+	q := parseSearch(filter.Search)
+	authors := filter.Authors
+	if q.domain != "" {
+		authors = s.domainAuthors(ctx, q.domain, filter.Authors)
+		if len(authors) == 0 {
+			ch := make(chan *nostr.Event)
+			close(ch)
+			return ch, nil
+		}
+	}
+
+	ids, err := s.index.search(ctx, filter, q, authors)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = searchDefaultLimit
+	}
+	filter.Search = ""
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		sent := 0
+		for _, id := range ids {
+			events, err := s.DBBackend.QueryEvents(ctx, nostr.Filter{IDs: []string{id}})
+			if err != nil {
+				return
+			}
+			// the index may still point to an event deleted in the meantime
+			event := <-events
+			if event == nil || !filter.Matches(event) {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- event:
+			}
+			if sent++; sent == limit {
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// domainAuthors are the pubkeys whose profile on the relay has a NIP-05 identifier at domain that verifies,
+// among authors when set.
+func (s searchStore) domainAuthors(ctx context.Context, domain string, authors []string) []string {
+	var verified []string
+	err := forEachEvent(ctx, s.DBBackend, nostr.Filter{Kinds: []int{nostr.KindProfileMetadata}, Authors: authors}, func(event *nostr.Event) {
+		var profile struct {
+			NIP05 string `json:"nip05"`
+		}
+		if json.Unmarshal([]byte(event.Content), &profile) != nil {
+			return
+		}
+		if _, d, err := nip05.ParseIdentifier(profile.NIP05); err != nil || strings.ToLower(d) != domain {
+			return
+		}
+		if verifyNIP05(ctx, profile.NIP05, event.PubKey) {
+			verified = append(verified, event.PubKey)
+		}
+	})
+	if err != nil {
+		slog.Warn("⚠️ error reading profiles", "domain", domain, "error", err)
+	}
+	return verified
+}
+
+type nip05Verification struct {
+	pubkey    string
+	checkedAt time.Time
+}
+
+const nip05VerificationTTL = time.Hour
+
+var (
+	nip05Mu       sync.Mutex
+	nip05Verified = make(map[string]nip05Verification)
+)
+
+// verifyNIP05 reports whether a NIP-05 identifier points to pubkey, the answer of the domain is cached.
+func verifyNIP05(ctx context.Context, identifier string, pubkey string) bool {
+	identifier = nip05.NormalizeIdentifier(identifier)
+
+	nip05Mu.Lock()
+	v, ok := nip05Verified[identifier]
+	nip05Mu.Unlock()
+
+	if !ok || time.Since(v.checkedAt) > nip05VerificationTTL {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		v = nip05Verification{checkedAt: time.Now()}
+		if pointer, err := nip05.QueryIdentifier(ctx, identifier); err == nil {
+			v.pubkey = pointer.PublicKey
+		}
+
+		nip05Mu.Lock()
+		nip05Verified[identifier] = v
+		nip05Mu.Unlock()
+	}
+	return v.pubkey == pubkey
+}
+
+// rejectSearchFilter refuses searches on a relay without search, rather than answering them as plain filters,
+// and in NIP-77 syncs, which would only reconcile the best matches.
+func (r *TenantRelay) rejectSearchFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	switch {
+	case filter.Search == "":
+		return false, ""
+	case r.search == nil:
+		return true, "unsupported: search is not enabled on this relay"
+	case eventstore.IsNegentropySession(ctx):
+		return true, "unsupported: searches can't be synced"
+	}
+	return false, ""
+}
+
+func rejectSearchCount(_ context.Context, filter nostr.Filter) (bool, string) {
+	if filter.Search != "" {
+		return true, "unsupported: searches can't be counted"
+	}
+	return false, ""
+}
+
+func runReindex(ctx context.Context) {
+	reindexCmd := flag.NewFlagSet("reindex", flag.ExitOnError)
+	tenant := reindexCmd.String("tenant", "", "Tenant host (defaults to the first tenant)")
+	relay := reindexCmd.String("relay", "", "Relay name (defaults to every relay with search)")
+	if err := reindexCmd.Parse(os.Args[2:]); err != nil {
+		log.Fatal("🚫 failed to parse reindex command:", err)
+	}
+
+	t := tenantByName(*tenant)
+	found := false
+	for _, r := range t.relays {
+		if *relay != "" && r.spec.Name != *relay {
+			continue
+		}
+		found = true
+		if r.search == nil {
+			if *relay != "" {
+				log.Fatalf("🚫 search is not enabled on the %s relay", *relay)
+			}
+			continue
+		}
+
+		slog.Info("🔎 rebuilding search index", "relay", r.spec.Name)
+		indexed, err := r.search.rebuild(ctx, r.db)
+		if err != nil {
+			log.Fatalf("🚫 error rebuilding the search index of %s: %s", r.spec.Name, err)
+		}
+		slog.Info("✅ search index rebuilt", "relay", r.spec.Name, "events", indexed)
+	}
+	if !found {
+		log.Fatalf("🚫 unknown relay: %s", *relay)
+	}
+}
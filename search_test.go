@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseSearch(t *testing.T) {
+	tests := []struct {
+		search string
+		want   searchQuery
+	}{
+		{"bitcoin  lightning", searchQuery{text: "bitcoin lightning"}},
+		{"nostr language:EN domain:Example.com", searchQuery{text: "nostr", language: "en", domain: "example.com"}},
+		{"include:spam nsfw:false relay", searchQuery{text: "relay"}},
+		{"time: 12:30", searchQuery{text: "time: 12:30"}},
+	}
+	for _, tt := range tests {
+		if got := parseSearch(tt.search); got != tt.want {
+			t.Errorf("parseSearch(%q) = %+v, want %+v", tt.search, got, tt.want)
+		}
+	}
+}
+
+func TestSearchableText(t *testing.T) {
+	encrypted := "Ag" + strings.Repeat("A", 130)
+	tests := []struct {
+		name  string
+		event *nostr.Event
+		want  string
+	}{
+		{"note with hashtags", &nostr.Event{Kind: nostr.KindTextNote, Content: "hello", Tags: nostr.Tags{{"t", "nostr"}, {"p", "ignored"}}}, "hello\nnostr"},
+		{"profile", &nostr.Event{Kind: nostr.KindProfileMetadata, Content: `{"name":"alice","picture":"https://example.com/a.png"}`}, "alice"},
+		{"NIP-44 payload", &nostr.Event{Kind: 30078, Content: encrypted}, ""},
+		{"NIP-04 payload", &nostr.Event{Kind: nostr.KindEncryptedDirectMessage, Content: "abc?iv=def"}, ""},
+	}
+	for _, tt := range tests {
+		if got := searchableText(tt.event); got != tt.want {
+			t.Errorf("%s: searchableText() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSearchStore(t *testing.T) {
+	ctx := context.Background()
+	index := &SearchIndex{path: filepath.Join(t.TempDir(), "search")}
+	if err := index.open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { index.Close() })
+	store := searchStore{DBBackend: newTestDB(t), index: index}
+
+	author := testPubkey()
+	event := func(kind int, content string, createdAt nostr.Timestamp) *nostr.Event {
+		e := &nostr.Event{PubKey: author, Kind: kind, Content: content, CreatedAt: createdAt}
+		e.ID = e.GetID()
+		return e
+	}
+	note := event(nostr.KindTextNote, "running a bitcoin node", 10)
+	other := event(nostr.KindTextNote, "gardening tips", 11)
+	oldProfile := event(nostr.KindProfileMetadata, `{"name":"bitcoin maximalist"}`, 10)
+	newProfile := event(nostr.KindProfileMetadata, `{"name":"gardener"}`, 20)
+	for _, e := range []*nostr.Event{note, other} {
+		if err := store.SaveEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, e := range []*nostr.Event{oldProfile, newProfile} {
+		if err := store.ReplaceEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(filter nostr.Filter) []string {
+		events, err := store.QueryEvents(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for e := range events {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+
+	// the replaced profile isn't found anymore
+	if got := search(nostr.Filter{Search: "bitcoin"}); len(got) != 1 || got[0] != note.ID {
+		t.Errorf("search bitcoin = %v, want only the note", got)
+	}
+	if got := search(nostr.Filter{Search: "gardener", Kinds: []int{nostr.KindProfileMetadata}}); len(got) != 1 || got[0] != newProfile.ID {
+		t.Errorf("search gardener = %v, want the latest profile", got)
+	}
+	if got := search(nostr.Filter{Search: "bitcoin", Kinds: []int{nostr.KindProfileMetadata}}); len(got) != 0 {
+		t.Errorf("search bitcoin in profiles = %v, want nothing", got)
+	}
+
+	if err := store.DeleteEvent(ctx, note); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(nostr.Filter{Search: "bitcoin"}); len(got) != 0 {
+		t.Errorf("search after deleting = %v, want nothing", got)
+	}
+}
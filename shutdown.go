@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// connections tracks the open websockets of every relay, so they can be told to go away on shutdown.
+// khatru's Relay.Shutdown can't be used because the relays are served through our own http.Server.
+var connections = &connectionTracker{conns: make(map[*khatru.WebSocket]struct{})}
+
+// background tracks the work that must finish before the databases are closed: blasts, backups and the
+// inbox subscriptions.
+var background = &workGroup{}
+
+type connectionTracker struct {
+	mu    sync.Mutex
+	conns map[*khatru.WebSocket]struct{}
+}
+
+func (c *connectionTracker) track(relay *khatru.Relay) {
+	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.conns[khatru.GetConnection(ctx)] = struct{}{}
+	})
+	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.conns, khatru.GetConnection(ctx))
+	})
+}
+
+func (c *connectionTracker) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.conns)
+}
+
+// closeAll sends a NOTICE and a close frame to every client, then waits for them to disconnect.
+func (c *connectionTracker) closeAll(ctx context.Context, reason string) {
+	c.mu.Lock()
+	conns := make([]*khatru.WebSocket, 0, len(c.conns))
+	for ws := range c.conns {
+		conns = append(conns, ws)
+	}
+	c.mu.Unlock()
+
+	for _, ws := range conns {
+		_ = ws.WriteJSON(nostr.NoticeEnvelope(reason))
+		_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, reason))
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for c.count() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Println("⚠️", c.count(), "connections did not close in time")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// workGroup is a sync.WaitGroup that refuses new work once it is draining.
+type workGroup struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+}
+
+// Go runs fn in a goroutine unless the group is draining.
+func (g *workGroup) Go(fn func()) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.draining {
+		return false
+	}
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+func (g *workGroup) drain(ctx context.Context) {
+	g.mu.Lock()
+	g.draining = true
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("⚠️ background work did not finish in time")
+	}
+}
+
+// shutdown stops accepting connections, disconnects the clients, waits for the background work and
+// closes the databases of every tenant.
+func shutdown(server *http.Server, replicationServer *http.Server, adminServer *http.Server) {
+	log.Println("🛑 shutting down, waiting up to", config.ShutdownTimeout)
+	shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("🚫 error stopping server:", err)
+	}
+	if replicationServer != nil {
+		if err := replicationServer.Shutdown(ctx); err != nil {
+			log.Println("🚫 error stopping replication server:", err)
+		}
+	}
+	connections.closeAll(ctx, "relay is shutting down")
+	background.drain(ctx)
+
+	for _, t := range tenants {
+		t.closeDBs()
+	}
+
+	// metrics are served until the end so the shutdown itself can be observed
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			log.Println("🚫 error stopping admin server:", err)
+		}
+	}
+}
+
+func (t *Tenant) closeDBs() {
+	for _, r := range t.relays {
+		r.db.Close()
+		if r.search != nil {
+			if err := r.search.Close(); err != nil {
+				log.Println("🚫 error closing search index:", err)
+			}
+		}
+	}
+	if t.blossomDB != nil {
+		t.blossomDB.Close()
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/joho/godotenv"
+
+	"github.com/bitvora/haven/wot"
+)
+
+// Tenant is one owner served by this process, with its own relays, databases, Blossom directory,
+// WoT model and limits. Without a tenants file HAVEN runs a single tenant configured by .env.
+type Tenant struct {
+	Host    string
+	cfg     atomic.Pointer[Config]
+	env     envSource
+	envFile string
+	dbPath  string
+
+	relays []*TenantRelay
+
+	// the relays with the chat, inbox and outbox roles, nil when no relay has the role
+	chat   *TenantRelay
+	inbox  *TenantRelay
+	outbox *TenantRelay
+
+	// blossomDB is nil when no relay serves Blossom
+	blossomDB DBBackend
+
+	chatGroups *ChatGroups
+	wot        wot.Model
+
+	// replicationRelays serve the databases to the replicas, by database name
+	replicationRelays map[string]*khatru.Relay
+	// replicatedAt is when each database last matched the primary, in unix seconds, while this is a replica
+	replicatedAt map[string]*atomic.Int64
+	// syncState is where each database of a replica stands, loaded by its first sync
+	syncState *replicationSync
+	// pulling is set once the inbox and chat subscriptions are started
+	pulling atomic.Bool
+
+	// resubscribeInbox cancels the current inbox subscription so it starts again with new seed relays
+	resubscribeInbox atomic.Pointer[context.CancelFunc]
+
+	// reported by /healthz and /readyz
+	wotReady               atomic.Bool
+	inboxSubscriptionAlive atomic.Bool
+	lastBackup             atomic.Int64
+}
+
+type TenantConfig struct {
+	Host    string `json:"host"`
+	EnvFile string `json:"env_file"`
+	DBPath  string `json:"db_path"`
+}
+
+var tenants []*Tenant
+
+// tenantEnv layers the env file of a tenant over .env. BLOSSOM_PATH defaults to a directory next to the
+// databases of the tenant, the blobs of a tenant are deleted along with its own index.
+func tenantEnv(vars map[string]string, base envSource, dbPath string) envSource {
+	return func(key string) (string, bool) {
+		if value, ok := vars[key]; ok {
+			return value, true
+		}
+		if key == "BLOSSOM_PATH" {
+			return filepath.Join(dbPath, "blobs") + string(filepath.Separator), true
+		}
+		return base(key)
+	}
+}
+
+// loadTenants reads the tenants file, if any. Variables in a tenant env file override the ones in .env.
+func loadTenants() []*Tenant {
+	base, err := baseEnv()
+	if err != nil {
+		log.Fatalf("🚫 %s", err)
+	}
+
+	result, err := readTenants(&config, base)
+	if err != nil {
+		log.Fatalf("🚫 %s", err)
+	}
+	if config.TenantsFile != "" {
+		log.Println("🏘️ loaded", len(result), "tenants from", config.TenantsFile)
+	}
+	return result
+}
+
+// readTenants builds the tenants of a configuration, it reports the problems of every tenant at once.
+func readTenants(cfg *Config, base envSource) ([]*Tenant, error) {
+	if cfg.TenantsFile == "" {
+		t := &Tenant{env: base, dbPath: "db"}
+		t.cfg.Store(cfg)
+		return []*Tenant{t}, nil
+	}
+
+	file, err := os.ReadFile(cfg.TenantsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file: %w", err)
+	}
+
+	var tenantConfigs []TenantConfig
+	if err := json.Unmarshal(file, &tenantConfigs); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file: %w", err)
+	}
+	if len(tenantConfigs) == 0 {
+		return nil, fmt.Errorf("no tenants defined in %s", cfg.TenantsFile)
+	}
+
+	var result []*Tenant
+	var problems []error
+	hosts := make(map[string]bool)
+	dbPaths := make(map[string]string)
+	blossomPaths := make(map[string]string)
+	for _, tc := range tenantConfigs {
+		if tc.Host == "" {
+			problems = append(problems, fmt.Errorf("every tenant in %s must have a host", cfg.TenantsFile))
+			continue
+		}
+		host := strings.ToLower(tc.Host)
+		if hosts[host] {
+			problems = append(problems, fmt.Errorf("tenant %s is defined twice in %s", host, cfg.TenantsFile))
+			continue
+		}
+		hosts[host] = true
+
+		dbPath := tc.DBPath
+		if dbPath == "" {
+			dbPath = filepath.Join("db", host)
+		}
+		if other, ok := dbPaths[filepath.Clean(dbPath)]; ok {
+			problems = append(problems, fmt.Errorf("tenants %s and %s share the db_path %s", other, host, dbPath))
+			continue
+		}
+		dbPaths[filepath.Clean(dbPath)] = host
+
+		vars := map[string]string{}
+		if tc.EnvFile != "" {
+			vars, err = godotenv.Read(tc.EnvFile)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("failed to read env file for tenant %s: %w", tc.Host, err))
+				continue
+			}
+		}
+
+		env := tenantEnv(vars, base, dbPath)
+
+		tenantCfg, err := loadConfigFrom(env)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("invalid configuration for tenant %s:\n%w", tc.Host, err))
+			continue
+		}
+		blossomPath := filepath.Clean(tenantCfg.BlossomPath)
+		if other, ok := blossomPaths[blossomPath]; ok {
+			problems = append(problems, fmt.Errorf("tenants %s and %s share the BLOSSOM_PATH %s", other, host, tenantCfg.BlossomPath))
+			continue
+		}
+		blossomPaths[blossomPath] = host
+
+		t := &Tenant{
+			Host:    host,
+			env:     env,
+			envFile: tc.EnvFile,
+			dbPath:  dbPath,
+		}
+		t.cfg.Store(&tenantCfg)
+		result = append(result, t)
+	}
+
+	return result, errors.Join(problems...)
+}
+
+// config is the current configuration of the tenant, it is replaced as a whole when the configuration is
+// reloaded.
+func (t *Tenant) config() *Config {
+	return t.cfg.Load()
+}
+
+// tenantForHost picks the tenant serving a request by its Host header, it returns nil for unknown hosts
+// in multi-tenant mode.
+func tenantForHost(host string) *Tenant {
+	if config.TenantsFile == "" {
+		return tenants[0]
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, t := range tenants {
+		if t.Host == host {
+			return t
+		}
+	}
+	return nil
+}
+
+// tenantByName is used by the CLI commands, an empty name selects the default tenant.
+func tenantByName(name string) *Tenant {
+	if name == "" {
+		return tenants[0]
+	}
+	for _, t := range tenants {
+		if t.Host == strings.ToLower(name) {
+			return t
+		}
+	}
+	log.Fatalf("🚫 unknown tenant: %s", name)
+	return nil
+}
+
+// initWoT builds the WoT of a tenant and marks it ready.
+func (t *Tenant) initWoT(ctx context.Context) {
+	wot.Init(ctx, t.wot)
+	t.wotReady.Store(true)
+}
+
+// notInWoT is the reason a pubkey outside the WoT is rejected with. Until the WoT is built, members are missing
+// from it too, so they get an error to retry later instead.
+func (t *Tenant) notInWoT(reason string) string {
+	if !t.wotReady.Load() {
+		return "error: the web of trust is still loading, try again in a few minutes"
+	}
+	return reason
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joho/godotenv"
+)
+
+// exampleEnv is .env.example without the relay list files, which aren't part of the repository.
+func exampleEnv(t *testing.T, overrides map[string]string) envSource {
+	t.Helper()
+
+	vars, err := godotenv.Read(".env.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars["IMPORT_SEED_RELAYS_FILE"] = ""
+	vars["BLASTR_RELAYS_FILE"] = ""
+	for key, value := range overrides {
+		vars[key] = value
+	}
+	return func(key string) (string, bool) {
+		value, ok := vars[key]
+		return value, ok
+	}
+}
+
+func writeTenantsFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadTenantsBlossomPath(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "b.env")
+	if err := os.WriteFile(envFile, []byte("BLOSSOM_PATH=\"media/b/\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{TenantsFile: writeTenantsFile(t, `[
+		{"host": "A.example.com"},
+		{"host": "b.example.com", "env_file": "`+envFile+`"}
+	]`)}
+
+	result, err := readTenants(cfg, exampleEnv(t, map[string]string{"BLOSSOM_PATH": "blossom/"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := result[0].config().BlossomPath, filepath.Join("db", "a.example.com", "blobs")+"/"; got != want {
+		t.Errorf("default BLOSSOM_PATH = %q, want %q", got, want)
+	}
+	if got := result[1].config().BlossomPath; got != "media/b/" {
+		t.Errorf("BLOSSOM_PATH of the env file = %q, want media/b/", got)
+	}
+}
+
+func TestReadTenantsRejectsDuplicates(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "shared.env")
+	if err := os.WriteFile(envFile, []byte("BLOSSOM_PATH=\"media/\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tenants := range map[string]string{
+		"host":            `[{"host": "a.example.com"}, {"host": "A.example.com", "db_path": "db/other"}]`,
+		"db path":         `[{"host": "a.example.com", "db_path": "db/shared"}, {"host": "b.example.com", "db_path": "db/shared/"}]`,
+		"default db path": `[{"host": "a.example.com"}, {"host": "b.example.com", "db_path": "db/a.example.com"}]`,
+		"blossom path":    `[{"host": "a.example.com", "env_file": "` + envFile + `"}, {"host": "b.example.com", "env_file": "` + envFile + `"}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{TenantsFile: writeTenantsFile(t, tenants)}
+			_, err := readTenants(cfg, exampleEnv(t, nil))
+			if err == nil || !strings.Contains(err.Error(), "a.example.com") {
+				t.Errorf("readTenants() error = %v, want a duplicate error", err)
+			}
+		})
+	}
+}
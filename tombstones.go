@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+var errEventDeleted = errors.New("blocked: this event has been deleted")
+
+// Tombstones keep the events deleted by NIP-09 deletions and NIP-62 requests to vanish from coming back from an
+// import, a restore or a client republishing them. The deletions stay in the database of the relay, indexed by
+// the events and addresses they target, so they can be broadcast again and looked up without a copy of their
+// targets. The requests to vanish apply to every relay, the pubkeys that vanished are persisted as JSON next to
+// the management lists.
+type Tombstones struct {
+	mu   sync.RWMutex
+	dir  string
+	path string
+	db   DBBackend
+
+	// pubkey -> created_at of its latest request to vanish, its older events and the gift wraps to it are deleted
+	Vanished map[string]nostr.Timestamp `json:"vanished"`
+}
+
+// loadTombstones reads the tombstones of a relay, the first time they are rebuilt from the kind 62 events already
+// stored in db.
+func (t *Tenant) loadTombstones(ctx context.Context, name string, db DBBackend) *Tombstones {
+	dir := filepath.Join(t.dbPath, "tombstones")
+	ts := &Tombstones{
+		dir:      dir,
+		path:     filepath.Join(dir, name+".json"),
+		db:       db,
+		Vanished: make(map[string]nostr.Timestamp),
+	}
+
+	data, err := afero.ReadFile(fs, ts.path)
+	if err == nil {
+		if err := json.Unmarshal(data, ts); err != nil {
+			log.Fatalf("🚫 error parsing %s: %s", ts.path, err)
+		}
+		return ts
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Fatalf("🚫 error reading %s: %s", ts.path, err)
+	}
+
+	err = forEachEvent(ctx, db, nostr.Filter{Kinds: []int{kindRequestToVanish}}, func(request *nostr.Event) {
+		ts.add(request)
+	})
+	if err != nil {
+		log.Fatalf("🚫 error reading the requests to vanish of %s: %s", name, err)
+	}
+	if err := ts.save(); err != nil {
+		log.Fatalf("🚫 error writing %s: %s", ts.path, err)
+	}
+	slog.Info("🪦 indexed vanished pubkeys", "relay", name, "vanished", len(ts.Vanished))
+	return ts
+}
+
+// save must be called with the write lock held.
+func (ts *Tombstones) save() error {
+	if err := fs.MkdirAll(ts.dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(ts)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ts.path, data)
+}
+
+// writeFileAtomic replaces a file through a temporary file in the same directory, a crash mid-write leaves the
+// previous version in place instead of a truncated file.
+func writeFileAtomic(path string, data []byte) error {
+	file, err := afero.TempFile(fs, filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fs.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = fs.Rename(file.Name(), path)
+	}
+	if err != nil {
+		_ = fs.Remove(file.Name())
+	}
+	return err
+}
+
+// add indexes a request to vanish and reports whether it is newer than the one indexed, the deletions are found in
+// the database. The write lock must be held, or the tombstones must not be shared yet.
+func (ts *Tombstones) add(deletion *nostr.Event) bool {
+	if deletion.Kind != kindRequestToVanish || deletion.CreatedAt <= ts.Vanished[deletion.PubKey] {
+		return false
+	}
+	ts.Vanished[deletion.PubKey] = deletion.CreatedAt
+	return true
+}
+
+// replace takes over the tombstones of the primary on a replica, and reports whether they changed.
+func (ts *Tombstones) replace(from *Tombstones) (bool, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if maps.Equal(ts.Vanished, from.Vanished) {
+		return false, nil
+	}
+	ts.Vanished = from.Vanished
+	if ts.Vanished == nil {
+		ts.Vanished = make(map[string]nostr.Timestamp)
+	}
+	return true, ts.save()
+}
+
+// record indexes a request to vanish and persists it.
+func (ts *Tombstones) record(deletion *nostr.Event) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if !ts.add(deletion) {
+		return nil
+	}
+	return ts.save()
+}
+
+// isDeleted reports whether the author of event has deleted it or vanished since, or event is a gift wrap to
+// a pubkey that vanished since. Deletions and requests to vanish can't be deleted.
+func (ts *Tombstones) isDeleted(ctx context.Context, event *nostr.Event) bool {
+	if event.Kind == nostr.KindDeletion || event.Kind == kindRequestToVanish {
+		return false
+	}
+
+	if ts.hasVanished(event) {
+		return true
+	}
+	if ts.hasDeletion(ctx, nostr.Filter{Authors: []string{event.PubKey}, Tags: nostr.TagMap{"e": []string{event.ID}}}) {
+		return true
+	}
+	if nostr.IsReplaceableKind(event.Kind) || nostr.IsAddressableKind(event.Kind) {
+		coordinate := fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, event.Tags.GetD())
+		return ts.hasDeletion(ctx, nostr.Filter{Authors: []string{event.PubKey}, Tags: nostr.TagMap{"a": []string{coordinate}}, Since: &event.CreatedAt})
+	}
+	return false
+}
+
+func (ts *Tombstones) hasVanished(event *nostr.Event) bool {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	if vanishedAt, vanished := ts.Vanished[event.PubKey]; vanished && event.CreatedAt <= vanishedAt {
+		return true
+	}
+	if event.Kind == nostr.KindGiftWrap {
+		for tag := range event.Tags.FindAll("p") {
+			if vanishedAt, vanished := ts.Vanished[tag[1]]; vanished && event.CreatedAt <= vanishedAt {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasDeletion reports whether the database of the relay holds a deletion matching filter.
+func (ts *Tombstones) hasDeletion(ctx context.Context, filter nostr.Filter) bool {
+	filter.Kinds = []int{nostr.KindDeletion}
+	filter.Limit = 1
+	events, err := ts.db.QueryEvents(ctx, filter)
+	if err != nil {
+		slog.Error("🚫 error looking up deletions", "error", err)
+		return false
+	}
+	found := false
+	for range events {
+		found = true
+	}
+	return found
+}
+
+func (ts *Tombstones) rejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	if ts.isDeleted(ctx, event) {
+		return true, errEventDeleted.Error()
+	}
+	return false, ""
+}
+
+func parseCoordinate(coordinate string) (kind int, pubkey string, d string, ok bool) {
+	parts := strings.SplitN(coordinate, ":", 3)
+	if len(parts) != 3 {
+		return 0, "", "", false
+	}
+	kind, err := strconv.Atoi(parts[0])
+	if err != nil || !nostr.IsValid32ByteHex(parts[1]) {
+		return 0, "", "", false
+	}
+	return kind, parts[1], parts[2], true
+}
+
+// tombstoneStore is the database of a relay as imports and restores write to it: it refuses deleted events
+// and applies the deletions it saves, even when they arrive after their targets.
+type tombstoneStore struct {
+	DBBackend
+	tombstones *Tombstones
+}
+
+func (s tombstoneStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	if s.tombstones.isDeleted(ctx, event) {
+		return errEventDeleted
+	}
+	if err := s.DBBackend.SaveEvent(ctx, event); err != nil {
+		return err
+	}
+	if event.Kind == nostr.KindDeletion || event.Kind == kindRequestToVanish {
+		_, err := s.applyDeletion(ctx, event)
+		return err
+	}
+	return nil
+}
+
+func (s tombstoneStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	if s.tombstones.isDeleted(ctx, event) {
+		return errEventDeleted
+	}
+	return s.DBBackend.ReplaceEvent(ctx, event)
+}
+
+// applyDeletion records a request to vanish and deletes the targets of a deletion or a request to vanish already
+// stored, khatru has done it already for the deletions sent by clients. It returns the number of events deleted.
+func (s tombstoneStore) applyDeletion(ctx context.Context, deletion *nostr.Event) (int, error) {
+	if err := s.tombstones.record(deletion); err != nil {
+		return 0, err
+	}
+
+	var targets []*nostr.Event
+	for _, filter := range deletionTargets(deletion) {
+		err := forEachEvent(ctx, s.DBBackend, filter, func(event *nostr.Event) {
+			if event.Kind != nostr.KindDeletion && event.Kind != kindRequestToVanish {
+				targets = append(targets, event)
+			}
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for i, target := range targets {
+		if err := s.DBBackend.DeleteEvent(ctx, target); err != nil {
+			return i, err
+		}
+	}
+	return len(targets), nil
+}
+
+// deletionTargets are the filters matching the events a deletion or a request to vanish deletes.
+func deletionTargets(deletion *nostr.Event) []nostr.Filter {
+	if deletion.Kind == kindRequestToVanish {
+		return []nostr.Filter{
+			{Authors: []string{deletion.PubKey}, Until: &deletion.CreatedAt},
+			{Kinds: []int{nostr.KindGiftWrap}, Tags: nostr.TagMap{"p": []string{deletion.PubKey}}, Until: &deletion.CreatedAt},
+		}
+	}
+
+	var filters []nostr.Filter
+	for _, tag := range deletion.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+
+		switch tag[0] {
+		case "e":
+			filters = append(filters, nostr.Filter{IDs: []string{tag[1]}, Authors: []string{deletion.PubKey}})
+		case "a":
+			kind, pubkey, d, ok := parseCoordinate(tag[1])
+			if !ok || pubkey != deletion.PubKey {
+				continue
+			}
+			filter := nostr.Filter{Kinds: []int{kind}, Authors: []string{pubkey}, Until: &deletion.CreatedAt}
+			if nostr.IsAddressableKind(kind) {
+				filter.Tags = nostr.TagMap{"d": []string{d}}
+			}
+			filters = append(filters, filter)
+		}
+	}
+	return filters
+}
+
+// keepDeletions is the DeleteEvent of khatru: deleting a deletion or a request to vanish has no effect, it
+// stays to be broadcast.
+func keepDeletions(deleteEvent func(ctx context.Context, event *nostr.Event) error) func(ctx context.Context, event *nostr.Event) error {
+	return func(ctx context.Context, event *nostr.Event) error {
+		if event.Kind == nostr.KindDeletion || event.Kind == kindRequestToVanish {
+			return nil
+		}
+		return deleteEvent(ctx, event)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestTombstonesIsDeleted(t *testing.T) {
+	ctx := context.Background()
+	author, other := testPubkey(), testPubkey()
+	tenant := newTestTenant(t, author, nil)
+	db := newTestDB(t)
+	ts := tenant.loadTombstones(ctx, "private", db)
+	store := tombstoneStore{DBBackend: db, tombstones: ts}
+
+	note := &nostr.Event{PubKey: author, Kind: nostr.KindTextNote, CreatedAt: 100}
+	note.ID = note.GetID()
+	article := &nostr.Event{PubKey: author, Kind: 30023, CreatedAt: 100, Tags: nostr.Tags{{"d", "post"}}}
+	newerArticle := &nostr.Event{PubKey: author, Kind: 30023, CreatedAt: 300, Tags: nostr.Tags{{"d", "post"}}}
+	giftWrap := &nostr.Event{PubKey: other, Kind: nostr.KindGiftWrap, CreatedAt: 100, Tags: nostr.Tags{{"p", author}}}
+	laterGiftWrap := &nostr.Event{PubKey: other, Kind: nostr.KindGiftWrap, CreatedAt: 500, Tags: nostr.Tags{{"p", author}}}
+
+	save := func(event *nostr.Event) {
+		event.ID = event.GetID()
+		if err := store.SaveEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// someone else can't delete the note
+	save(&nostr.Event{PubKey: other, Kind: nostr.KindDeletion, CreatedAt: 200, Tags: nostr.Tags{{"e", note.ID}}})
+	save(&nostr.Event{PubKey: author, Kind: nostr.KindDeletion, CreatedAt: 200, Tags: nostr.Tags{{"a", fmt.Sprintf("30023:%s:post", author)}}})
+	if ts.isDeleted(ctx, note) {
+		t.Error("a note deleted by someone else is deleted")
+	}
+	if !ts.isDeleted(ctx, article) || ts.isDeleted(ctx, newerArticle) {
+		t.Error("only the versions of an address older than its deletion are deleted")
+	}
+
+	// a deletion stored before its target keeps it out
+	save(&nostr.Event{PubKey: author, Kind: nostr.KindDeletion, CreatedAt: 200, Tags: nostr.Tags{{"e", note.ID}}})
+	if err := store.SaveEvent(ctx, note); err != errEventDeleted {
+		t.Errorf("saving a deleted note = %v, want %v", err, errEventDeleted)
+	}
+	save(&nostr.Event{PubKey: author, Kind: kindRequestToVanish, CreatedAt: 400})
+	if !ts.isDeleted(ctx, giftWrap) || ts.isDeleted(ctx, laterGiftWrap) {
+		t.Error("only the gift wraps sent to a vanished pubkey before it vanished are deleted")
+	}
+
+	// the pubkeys that vanished are read back from their file, without going through the requests
+	reloaded := tenant.loadTombstones(ctx, "private", newTestDB(t))
+	if !reloaded.isDeleted(ctx, giftWrap) {
+		t.Error("the pubkeys that vanished weren't persisted")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/state.json"
+
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := afero.ReadFile(fs, path); string(data) != content {
+			t.Errorf("content = %q, want %q", data, content)
+		}
+	}
+
+	entries, err := afero.ReadDir(fs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files left in the directory, want only the written one", len(entries))
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// kindRequestToVanish is the NIP-62 request to delete everything a pubkey published.
+const kindRequestToVanish = 62
+
+const allRelays = "ALL_RELAYS"
+
+// vanishTargets reports whether a request to vanish names the relay, by its URL or with ALL_RELAYS.
+func (t *Tenant) vanishTargets(r *TenantRelay, request *nostr.Event) bool {
+	url := nostr.NormalizeURL(r.wsURL(t.config().RelayURL))
+	for tag := range request.Tags.FindAll("relay") {
+		if tag[1] == allRelays || nostr.NormalizeURL(tag[1]) == url {
+			return true
+		}
+	}
+	return false
+}
+
+// canVanish reports whether pubkey may vanish from the relay: anyone from the inbox and chat relays, which
+// store what others send to the owner, only the owner from the others.
+func (t *Tenant) canVanish(r *TenantRelay, pubkey string) bool {
+	return r == t.inbox || r == t.chat || pubkey == t.config().OwnerNpubKey
+}
+
+func (t *Tenant) isVanishRequest(r *TenantRelay, event *nostr.Event) bool {
+	return event.Kind == kindRequestToVanish && t.canVanish(r, event.PubKey) && t.vanishTargets(r, event)
+}
+
+// rejectVanish refuses the requests to vanish the relay can't honor.
+func (t *Tenant) rejectVanish(r *TenantRelay) func(ctx context.Context, event *nostr.Event) (bool, string) {
+	return func(ctx context.Context, event *nostr.Event) (bool, string) {
+		if event.Kind != kindRequestToVanish {
+			return false, ""
+		}
+		if !t.canVanish(r, event.PubKey) {
+			return true, "blocked: only the owner of this relay can vanish from it"
+		}
+		if !t.vanishTargets(r, event) {
+			return true, fmt.Sprintf("invalid: the request to vanish must name %s or %s", r.wsURL(t.config().RelayURL), allRelays)
+		}
+		return false, ""
+	}
+}
+
+// exceptVanish lets the requests to vanish through a write policy or kind list, anyone allowed to vanish may
+// send one even if they can't publish anything else.
+func (t *Tenant) exceptVanish(r *TenantRelay, reject func(ctx context.Context, event *nostr.Event) (bool, string)) func(ctx context.Context, event *nostr.Event) (bool, string) {
+	return func(ctx context.Context, event *nostr.Event) (bool, string) {
+		if t.isVanishRequest(r, event) {
+			return false, ""
+		}
+		return reject(ctx, event)
+	}
+}
+
+// vanish honors a request to vanish saved by one of the relays: the events of the pubkey and the gift wraps to
+// it are deleted from every relay, with the blobs it uploaded, and can't be published or imported again.
+func (t *Tenant) vanish(ctx context.Context, request *nostr.Event) {
+	// the tombstones are recorded first, so nothing comes back while the events are deleted
+	for _, r := range t.relays {
+		if err := r.tombstones.record(request); err != nil {
+			slog.Error("🚫 error recording request to vanish", "tenant", t.Host, "relay", r.spec.Name, "error", err)
+		}
+	}
+
+	deleted := 0
+	for _, r := range t.relays {
+		n, err := r.store().applyDeletion(ctx, request)
+		deleted += n
+		if err != nil {
+			slog.Error("🚫 error deleting the events of a vanished pubkey", "tenant", t.Host, "relay", r.spec.Name, "error", err)
+		}
+	}
+
+	blobs, err := t.deleteBlobs(ctx, request.PubKey)
+	if err != nil {
+		slog.Error("🚫 error deleting the blobs of a vanished pubkey", "tenant", t.Host, "error", err)
+	}
+
+	slog.Info("👻 pubkey vanished", "tenant", t.Host, "pubkey", request.PubKey, "events", deleted, "blobs", blobs)
+}
+
+// deleteBlobs deletes the Blossom blobs uploaded by pubkey, a blob also uploaded by someone else stays theirs.
+func (t *Tenant) deleteBlobs(ctx context.Context, pubkey string) (int, error) {
+	if t.blossomDB == nil {
+		return 0, nil
+	}
+
+	var index []*nostr.Event
+	err := forEachEvent(ctx, t.blossomDB, nostr.Filter{Kinds: []int{24242}, Authors: []string{pubkey}}, func(event *nostr.Event) {
+		index = append(index, event)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, event := range index {
+		if err := t.blossomDB.DeleteEvent(ctx, event); err != nil {
+			return deleted, err
+		}
+
+		tag := event.Tags.Find("x")
+		if tag == nil {
+			continue
+		}
+		removed, err := t.removeOrphanBlob(ctx, tag[1])
+		if err != nil {
+			slog.Warn("⚠️ error removing blob", "sha256", tag[1], "error", err)
+			continue
+		}
+		if removed {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// removeOrphanBlob removes the file of a blob once no index event refers to it anymore.
+func (t *Tenant) removeOrphanBlob(ctx context.Context, sha256 string) (bool, error) {
+	owners, err := t.blossomDB.QueryEvents(ctx, nostr.Filter{Kinds: []int{24242}, Tags: nostr.TagMap{"x": []string{sha256}}, Limit: 1})
+	if err != nil {
+		return false, err
+	}
+	if owner := <-owners; owner != nil {
+		return false, nil
+	}
+	if err := fs.Remove(t.config().BlossomPath + sha256); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// newVanishTenant returns a tenant with an outbox and an inbox relay and Blossom, on relay.example.com.
+func newVanishTenant(t *testing.T, owner string) (*Tenant, *TenantRelay, *TenantRelay) {
+	t.Helper()
+
+	tenant := &Tenant{dbPath: t.TempDir(), blossomDB: newTestDB(t)}
+	tenant.cfg.Store(&Config{OwnerNpubKey: owner, RelayURL: "relay.example.com", BlossomPath: t.TempDir() + "/"})
+	outbox := newTestStoredRelay(t, tenant, RelaySpec{Name: "outbox", Path: "/"})
+	inbox := newTestStoredRelay(t, tenant, RelaySpec{Name: "inbox", Path: "/inbox"})
+	tenant.inbox = inbox
+	return tenant, outbox, inbox
+}
+
+func TestRejectVanish(t *testing.T) {
+	owner, other := testPubkey(), testPubkey()
+	tenant, outbox, inbox := newVanishTenant(t, owner)
+
+	request := func(pubkey string, relay string) *nostr.Event {
+		return &nostr.Event{PubKey: pubkey, Kind: kindRequestToVanish, Tags: nostr.Tags{{"relay", relay}}}
+	}
+	tests := []struct {
+		name   string
+		relay  *TenantRelay
+		event  *nostr.Event
+		reject bool
+	}{
+		{"owner from the outbox", outbox, request(owner, "wss://relay.example.com"), false},
+		{"owner from every relay", outbox, request(owner, allRelays), false},
+		{"another relay", outbox, request(owner, "wss://elsewhere.example.com"), true},
+		{"someone else from the outbox", outbox, request(other, allRelays), true},
+		{"someone else from the inbox", inbox, request(other, "wss://relay.example.com/inbox"), false},
+		{"another kind", outbox, &nostr.Event{PubKey: other, Kind: nostr.KindTextNote}, false},
+	}
+	for _, tt := range tests {
+		if rejected, msg := tenant.rejectVanish(tt.relay)(context.Background(), tt.event); rejected != tt.reject {
+			t.Errorf("%s: rejected %v (%s), want %v", tt.name, rejected, msg, tt.reject)
+		}
+	}
+}
+
+func TestVanish(t *testing.T) {
+	ctx := context.Background()
+	owner, vanishing, other := testPubkey(), testPubkey(), testPubkey()
+	tenant, outbox, inbox := newVanishTenant(t, owner)
+
+	before, after := nostr.Timestamp(100), nostr.Timestamp(300)
+	gone := []*nostr.Event{
+		{ID: "01" + vanishing[2:], PubKey: vanishing, Kind: nostr.KindTextNote, CreatedAt: before},
+		{ID: "02" + vanishing[2:], PubKey: other, Kind: nostr.KindGiftWrap, CreatedAt: before, Tags: nostr.Tags{{"p", vanishing}}},
+	}
+	kept := []*nostr.Event{
+		{ID: "03" + vanishing[2:], PubKey: vanishing, Kind: nostr.KindTextNote, CreatedAt: after},
+		{ID: "04" + vanishing[2:], PubKey: other, Kind: nostr.KindTextNote, CreatedAt: before},
+	}
+	for _, r := range []*TenantRelay{outbox, inbox} {
+		for _, event := range append(gone, kept...) {
+			if err := r.db.SaveEvent(ctx, event); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// a blob only the vanishing pubkey uploaded goes, one someone else also uploaded stays
+	own, shared := "aa"+vanishing[2:], "bb"+vanishing[2:]
+	uploads := []*nostr.Event{
+		{ID: "05" + vanishing[2:], PubKey: vanishing, Kind: 24242, CreatedAt: before, Tags: nostr.Tags{{"x", own}}},
+		{ID: "06" + vanishing[2:], PubKey: vanishing, Kind: 24242, CreatedAt: before, Tags: nostr.Tags{{"x", shared}}},
+		{ID: "07" + vanishing[2:], PubKey: other, Kind: 24242, CreatedAt: before, Tags: nostr.Tags{{"x", shared}}},
+	}
+	for _, upload := range uploads {
+		if err := tenant.blossomDB.SaveEvent(ctx, upload); err != nil {
+			t.Fatal(err)
+		}
+		if err := afero.WriteFile(fs, tenant.config().BlossomPath+upload.Tags.Find("x")[1], []byte("blob"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	request := &nostr.Event{PubKey: vanishing, Kind: kindRequestToVanish, CreatedAt: 200, Tags: nostr.Tags{{"relay", allRelays}}}
+	tenant.vanish(ctx, request)
+
+	stored := func(db DBBackend, event *nostr.Event) bool {
+		events, err := db.QueryEvents(ctx, nostr.Filter{IDs: []string{event.ID}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for range events {
+			found = true
+		}
+		return found
+	}
+	for _, r := range []*TenantRelay{outbox, inbox} {
+		for _, event := range gone {
+			if stored(r.db, event) {
+				t.Errorf("%s: event %s of the vanished pubkey is still stored", r.spec.Name, event.ID[:2])
+			}
+			if !r.tombstones.isDeleted(ctx, event) {
+				t.Errorf("%s: event %s of the vanished pubkey can come back", r.spec.Name, event.ID[:2])
+			}
+		}
+		for _, event := range kept {
+			if !stored(r.db, event) {
+				t.Errorf("%s: event %s was deleted", r.spec.Name, event.ID[:2])
+			}
+		}
+	}
+
+	if exists, _ := afero.Exists(fs, tenant.config().BlossomPath+own); exists {
+		t.Error("the blob of the vanished pubkey is still stored")
+	}
+	if exists, _ := afero.Exists(fs, tenant.config().BlossomPath+shared); !exists {
+		t.Error("a blob someone else also uploaded was deleted")
+	}
+}
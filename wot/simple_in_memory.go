@@ -17,26 +17,28 @@ import (
 const DefaultWotLevel = 3
 
 type SimpleInMemory struct {
-	pubkeys atomic.Pointer[map[string]bool]
+	pubkeys             atomic.Pointer[map[string]bool]
+	lastRefreshDuration atomic.Int64
+	seedRelays          atomic.Pointer[[]string]
 
 	// Dependencies for Refresh
 	Pool            *nostr.SimplePool
 	OwnerPubkey     string
-	SeedRelays      []string
 	WotDepth        int
 	MinFollowers    int
 	WotFetchTimeout int
 }
 
 func NewSimpleInMemory(pool *nostr.SimplePool, ownerPubkey string, seedRelays []string, wotDepth int, minFollowers int, wotFetchTimeout int) *SimpleInMemory {
-	return &SimpleInMemory{
+	wt := &SimpleInMemory{
 		Pool:            pool,
 		OwnerPubkey:     ownerPubkey,
-		SeedRelays:      seedRelays,
 		WotDepth:        wotDepth,
 		MinFollowers:    minFollowers,
 		WotFetchTimeout: wotFetchTimeout,
 	}
+	wt.seedRelays.Store(&seedRelays)
+	return wt
 }
 
 func (wt *SimpleInMemory) Has(_ context.Context, pubkey string) bool {
@@ -50,6 +52,24 @@ func (wt *SimpleInMemory) Has(_ context.Context, pubkey string) bool {
 	return (*m)[pubkey]
 }
 
+// Size is the number of pubkeys in the WoT, 0 when the WoT is disabled.
+func (wt *SimpleInMemory) Size() int {
+	m := wt.pubkeys.Load()
+	if m == nil {
+		return 0
+	}
+	return len(*m)
+}
+
+func (wt *SimpleInMemory) LastRefreshDuration() time.Duration {
+	return time.Duration(wt.lastRefreshDuration.Load())
+}
+
+// SetSeedRelays changes the relays the next refresh fetches follow lists from.
+func (wt *SimpleInMemory) SetSeedRelays(relays []string) {
+	wt.seedRelays.Store(&relays)
+}
+
 func (wt *SimpleInMemory) Init(ctx context.Context) {
 	switch wt.WotDepth {
 	case 0:
@@ -75,6 +95,11 @@ func (wt *SimpleInMemory) Refresh(ctx context.Context) {
 		return
 	}
 
+	start := time.Now()
+	defer func() {
+		wt.lastRefreshDuration.Store(int64(time.Since(start)))
+	}()
+
 	var eventsAnalysed atomic.Int64
 	pubkeyFollowers := xsync.NewMap[string, *xsync.Map[string, bool]]()
 	relaysDiscovered := xsync.NewMap[string, bool]()
@@ -90,6 +115,7 @@ func (wt *SimpleInMemory) Refresh(ctx context.Context) {
 		return
 	}
 
+	seedRelays := *wt.seedRelays.Load()
 	timeout := time.Duration(wt.WotFetchTimeout) * time.Second
 	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
@@ -101,7 +127,7 @@ func (wt *SimpleInMemory) Refresh(ctx context.Context) {
 
 	slog.Info("🛜 fetching Nostr events to build WoT")
 
-	events := wt.Pool.FetchMany(timeoutCtx, wt.SeedRelays, filter)
+	events := wt.Pool.FetchMany(timeoutCtx, seedRelays, filter)
 	for ev := range latestEventByKindAndPubkey(timeoutCtx, events, &eventsAnalysed) {
 		for contact := range ev.Tags.FindAll("p") {
 			if len(contact) > 1 {
@@ -118,7 +144,7 @@ func (wt *SimpleInMemory) Refresh(ctx context.Context) {
 
 	if wt.WotDepth == 2 {
 		slog.Info("🕸️ analysed Nostr events", "count", eventsAnalysed.Load())
-		slog.Info("📈 direct followers in import relays", "🫂pubkeys", len(newWot), "🔗relays", len(wt.SeedRelays))
+		slog.Info("📈 direct followers in import relays", "🫂pubkeys", len(newWot), "🔗relays", len(seedRelays))
 		wt.pubkeys.Store(&newWot)
 		return
 	}
@@ -137,7 +163,7 @@ func (wt *SimpleInMemory) Refresh(ctx context.Context) {
 		go func() {
 			defer cancel()
 
-			events := wt.Pool.FetchMany(timeoutCtx, wt.SeedRelays, filter)
+			events := wt.Pool.FetchMany(timeoutCtx, seedRelays, filter)
 			for ev := range latestEventByKindAndPubkey(timeoutCtx, events, &eventsAnalysed) {
 				for contact := range ev.Tags.FindAll("p") {
 					if len(contact) > 1 {
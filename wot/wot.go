@@ -20,6 +20,17 @@ type Initializer interface {
 	Init(ctx context.Context)
 }
 
+// Stats is implemented by models that can report their size and how long their last refresh took.
+type Stats interface {
+	Size() int
+	LastRefreshDuration() time.Duration
+}
+
+// SeedRelaysSetter is implemented by models whose seed relays can change while they run.
+type SeedRelaysSetter interface {
+	SetSeedRelays(relays []string)
+}
+
 var wotInstance atomic.Value
 
 func GetInstance() Model {
@@ -32,6 +43,11 @@ func GetInstance() Model {
 
 func Initialize(ctx context.Context, model Model) {
 	wotInstance.Store(model)
+	Init(ctx, model)
+}
+
+// Init initializes a model without making it the global instance, it is used when each tenant has its own model.
+func Init(ctx context.Context, model Model) {
 	if initializer, ok := model.(Initializer); ok {
 		slog.Info("🌐 Initializing WoT", "model", fmt.Sprintf("%T", model))
 		initializer.Init(ctx)
@@ -40,6 +56,11 @@ func Initialize(ctx context.Context, model Model) {
 }
 
 func PeriodicRefresh(ctx context.Context, interval time.Duration) {
+	PeriodicRefreshModel(ctx, GetInstance(), interval)
+}
+
+// PeriodicRefreshModel refreshes the given model every interval until ctx is done.
+func PeriodicRefreshModel(ctx context.Context, model Model, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
@@ -48,8 +69,7 @@ func PeriodicRefresh(ctx context.Context, interval time.Duration) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			instance := GetInstance()
-			if refresher, ok := instance.(Refresher); ok {
+			if refresher, ok := model.(Refresher); ok {
 				slog.Info("🌐 Refreshing WoT")
 				refresher.Refresh(ctx)
 				slog.Info("✅ WoT refreshed")